@@ -0,0 +1,111 @@
+package analytics
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	BotReasonUserAgent   string = "user_agent"
+	BotReasonNoUserAgent string = "no_user_agent"
+	BotReasonPrefetch    string = "prefetch"
+	BotReasonHead        string = "head_request"
+	BotReasonHeaders     string = "missing_browser_headers"
+)
+
+// botUserAgentTokens are lower case substrings of the user agents of link
+// unfurlers, crawlers and http libraries. iMessage previews identify themselves
+// with the facebookexternalhit and twitterbot tokens. Short words such as "bot"
+// or "preview" on their own also appear in the model names of phones, for example
+// Cubot, so crawlers are listed by name instead
+var botUserAgentTokens = []string{
+	"googlebot",
+	"bingbot",
+	"bingpreview",
+	"applebot",
+	"duckduckbot",
+	"yandexbot",
+	"baiduspider",
+	"slackbot",
+	"twitterbot",
+	"facebot",
+	"linkedinbot",
+	"discordbot",
+	"telegrambot",
+	"redditbot",
+	"crawler",
+	"spider",
+	"slurp",
+	"facebookexternalhit",
+	"slack-imgproxy",
+	"skypeuripreview",
+	"google web preview",
+	"embedly",
+	"iframely",
+	"pinterestbot",
+	"bitlybot",
+	"mastodon",
+	"headlesschrome",
+	"lighthouse",
+	"curl/",
+	"wget/",
+	"python-requests",
+	"python-urllib",
+	"aiohttp",
+	"go-http-client",
+	"java/",
+	"okhttp",
+	"axios/",
+	"node-fetch",
+	"libwww-perl",
+	"httpclient",
+}
+
+// botUserAgentPrefixes are the lower case product tokens that link unfurlers put
+// at the start of their user agents. The in-app browsers of the same apps mention
+// the app name later in a browser user agent, for example [Pinterest/iOS], and are
+// used by people
+var botUserAgentPrefixes = []string{
+	"whatsapp/",
+	"pinterest/",
+}
+
+// ClassifyRequest decides whether a redirect request was made by a bot. Besides
+// the user agent it looks at signals that browsers navigating to a link always
+// or never send. The reason is empty for requests classified as human
+func ClassifyRequest(r *http.Request) (bool, string) {
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return true, BotReasonNoUserAgent
+	}
+	for _, token := range botUserAgentTokens {
+		if strings.Contains(ua, token) {
+			return true, BotReasonUserAgent
+		}
+	}
+	for _, prefix := range botUserAgentPrefixes {
+		if strings.HasPrefix(ua, prefix) {
+			return true, BotReasonUserAgent
+		}
+	}
+	// crawlers that are not listed usually name themselves in a product token
+	// such as AhrefsBot/7.0, a phone model is never followed by a version
+	if strings.Contains(ua, "bot/") {
+		return true, BotReasonUserAgent
+	}
+	// link previews and speculative loads are not visits even when they come from
+	// a real browser
+	if r.Method == http.MethodHead {
+		return true, BotReasonHead
+	}
+	purpose := strings.ToLower(r.Header.Get("Sec-Purpose") + r.Header.Get("Purpose") + r.Header.Get("X-Purpose"))
+	if strings.Contains(purpose, "prefetch") || strings.Contains(purpose, "preview") {
+		return true, BotReasonPrefetch
+	}
+	// every mainstream browser sends Accept-Language on navigations, scripts that
+	// copy a browser user agent usually do not
+	if strings.HasPrefix(ua, "mozilla/") && r.Header.Get("Accept-Language") == "" {
+		return true, BotReasonHeaders
+	}
+	return false, ""
+}
@@ -0,0 +1,65 @@
+package analytics
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	chrome := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/126.0 Safari/537.36"
+	tests := []struct {
+		name      string
+		method    string
+		userAgent string
+		headers   map[string]string
+		bot       bool
+		reason    string
+	}{
+		{"browser", "GET", chrome, map[string]string{"Accept-Language": "en-US"}, false, ""},
+		{"no user agent", "GET", "", nil, true, BotReasonNoUserAgent},
+		{"slack", "GET", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", nil, true, BotReasonUserAgent},
+		{"imessage", "GET", "Mozilla/5.0 (Macintosh) AppleWebKit/601.2.4 facebookexternalhit/1.1 Facebot Twitterbot/1.0", nil, true, BotReasonUserAgent},
+		{"curl", "GET", "curl/8.7.1", nil, true, BotReasonUserAgent},
+		{"whatsapp preview", "GET", "WhatsApp/2.23.20.0 A", nil, true, BotReasonUserAgent},
+		{"pinterest crawler", "GET", "Pinterest/0.2 (+https://www.pinterest.com/bot.html)", nil, true, BotReasonUserAgent},
+		{
+			"pinterest in-app browser",
+			"GET",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 [Pinterest/iOS]",
+			map[string]string{"Accept-Language": "en-US"},
+			false,
+			"",
+		},
+		{
+			"whatsapp in-app browser",
+			"GET",
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8 Build/UD1A; wv) AppleWebKit/537.36 Version/4.0 Chrome/126.0 Mobile Safari/537.36 WhatsApp/2.24.13.80",
+			map[string]string{"Accept-Language": "en-US"},
+			false,
+			"",
+		},
+		{"crawler product token", "GET", "Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)", nil, true, BotReasonUserAgent},
+		{
+			"cubot phone",
+			"GET",
+			"Mozilla/5.0 (Linux; Android 12; CUBOT KINGKONG 7) AppleWebKit/537.36 Chrome/126.0 Mobile Safari/537.36",
+			map[string]string{"Accept-Language": "de-DE"},
+			false,
+			"",
+		},
+		{"head", "HEAD", chrome, map[string]string{"Accept-Language": "en-US"}, true, BotReasonHead},
+		{"prefetch", "GET", chrome, map[string]string{"Accept-Language": "en-US", "Sec-Purpose": "prefetch;prerender"}, true, BotReasonPrefetch},
+		{"copied user agent", "GET", chrome, nil, true, BotReasonHeaders},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/api/abcd1234", nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		bot, reason := ClassifyRequest(req)
+		if bot != test.bot || reason != test.reason {
+			t.Errorf("%s: ClassifyRequest = %v, %q, want %v, %q", test.name, bot, reason, test.bot, test.reason)
+		}
+	}
+}
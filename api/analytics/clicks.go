@@ -0,0 +1,136 @@
+package analytics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/util"
+)
+
+// ClickEvent is recorded for every redirect to the destination of a mapping
+type ClickEvent struct {
+	ShortUrlId string
+	OccurredAt time.Time
+	Referrer   string
+	UserAgent  string
+	// Bot is set for clicks from crawlers and link unfurlers, they are counted
+	// separately from the visits of people. BotReason records which signal of
+	// ClassifyRequest matched so that the classification can be audited
+	Bot       bool
+	BotReason string
+	// ClientIP is only set until the VisitorRecorder has hashed it into VisitorId,
+	// it is never buffered or stored
+	ClientIP string
+	// VisitorId identifies the visitor for one day, it is empty for bots and when
+	// unique visitors are not counted
+	VisitorId string
+}
+
+// NewClickEvent builds the click event for a redirect request
+func NewClickEvent(r *http.Request, shortUrlId string) ClickEvent {
+	bot, botReason := ClassifyRequest(r)
+	return ClickEvent{
+		ShortUrlId: shortUrlId,
+		OccurredAt: time.Now().UTC(),
+		Referrer:   r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Bot:        bot,
+		BotReason:  botReason,
+		ClientIP:   util.ClientIP(r),
+	}
+}
+
+// Recorder accepts click events from the redirect handler. Record must not block
+// for long because it is called before the redirect is written
+type Recorder interface {
+	Record(event ClickEvent)
+}
+
+// NoopRecorder discards every event, it is used by tests that do not look at clicks
+type NoopRecorder struct{}
+
+func (NoopRecorder) Record(event ClickEvent) {}
+
+// Store persists a batch of click events
+type Store interface {
+	WriteClicks(ctx context.Context, events []ClickEvent) error
+}
+
+// PostgresStore copies click events into the click_events table and adds them to
+// the visit counts of the mappings and to the hourly and daily rollups in the
+// same transaction. When Visitors is set the visitor ids of the events are added
+// to the unique visitor estimates first, adding them is idempotent so a batch that
+// fails afterwards can be retried
+type PostgresStore struct {
+	Pool     *pgxpool.Pool
+	Visitors *UniqueVisitors
+}
+
+func (s *PostgresStore) WriteClicks(ctx context.Context, events []ClickEvent) error {
+	rows := make([]db.InsertClickEventsParams, 0, len(events))
+	// index 0 counts human visits and index 1 counts bot visits
+	visits := make(map[string]*[2]int32)
+	for _, event := range events {
+		rows = append(rows, db.InsertClickEventsParams{
+			MappingID:  event.ShortUrlId,
+			OccurredAt: pgtype.Timestamp{Time: event.OccurredAt, Valid: true},
+			Referrer:   event.Referrer,
+			UserAgent:  event.UserAgent,
+			IsBot:      event.Bot,
+			BotReason:  event.BotReason,
+		})
+		if visits[event.ShortUrlId] == nil {
+			visits[event.ShortUrlId] = &[2]int32{}
+		}
+		if event.Bot {
+			visits[event.ShortUrlId][1]++
+		} else {
+			visits[event.ShortUrlId][0]++
+		}
+	}
+	params := db.IncrementVisitsParams{}
+	for id := range visits {
+		params.Ids = append(params.Ids, id)
+	}
+	for _, id := range params.Ids {
+		params.Visits = append(params.Visits, visits[id][0])
+		params.BotVisits = append(params.BotVisits, visits[id][1])
+	}
+
+	if s.Visitors != nil {
+		if err := s.Visitors.Add(ctx, events); err != nil {
+			return err
+		}
+	}
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	queries := db.New(tx)
+	if _, err = queries.InsertClickEvents(ctx, rows); err != nil {
+		return err
+	}
+	// the rows of url_mapping are locked in id order before they are updated so
+	// that workers writing overlapping batches cannot deadlock
+	if err = queries.LockMappingsInOrder(ctx, params.Ids); err != nil {
+		return err
+	}
+	if err = queries.IncrementVisits(ctx, params); err != nil {
+		return err
+	}
+	// batches that share rollup rows of an existing mapping are serialized by the
+	// mapping locks above, the rows are also upserted in sorted order
+	if err = queries.UpsertHourlyRollups(ctx, newRollup(events, HourBucket).hourlyParams()); err != nil {
+		return err
+	}
+	if err = queries.UpsertDailyRollups(ctx, newRollup(events, DayBucket).dailyParams()); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
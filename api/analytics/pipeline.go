@@ -0,0 +1,230 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OverflowPolicy decides what happens to an event when the queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDrop drops the event immediately so the redirect is never delayed
+	OverflowDrop OverflowPolicy = "drop"
+	// OverflowBlock applies backpressure by waiting up to EnqueueTimeout for space
+	// in the queue before the event is dropped
+	OverflowBlock OverflowPolicy = "block"
+)
+
+const (
+	dropReasonQueueFull   string = "queue_full"
+	dropReasonClosed      string = "closed"
+	dropReasonWriteFailed string = "write_failed"
+)
+
+type Config struct {
+	QueueSize int
+	Workers   int
+	// a worker writes its batch when it holds BatchSize events or when
+	// FlushInterval has passed, whichever comes first
+	BatchSize      int
+	FlushInterval  time.Duration
+	WriteTimeout   time.Duration
+	Overflow       OverflowPolicy
+	EnqueueTimeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		QueueSize:      10000,
+		Workers:        2,
+		BatchSize:      500,
+		FlushInterval:  time.Second,
+		WriteTimeout:   5 * time.Second,
+		Overflow:       OverflowDrop,
+		EnqueueTimeout: 10 * time.Millisecond,
+	}
+}
+
+func (c Config) validate() error {
+	if c.QueueSize < 1 || c.Workers < 1 || c.BatchSize < 1 {
+		return errors.New("queue size, workers and batch size must be at least 1")
+	}
+	if c.FlushInterval <= 0 || c.WriteTimeout <= 0 {
+		return errors.New("flush interval and write timeout must be positive")
+	}
+	if c.Overflow != OverflowDrop && c.Overflow != OverflowBlock {
+		return fmt.Errorf("invalid overflow policy: %q, must be %s or %s", c.Overflow, OverflowDrop, OverflowBlock)
+	}
+	return nil
+}
+
+// Pipeline moves click events off the redirect path. Events are buffered in a
+// bounded queue and written to the store in batches by a pool of workers
+type Pipeline struct {
+	store  Store
+	config Config
+	logger *slog.Logger
+	queue  chan ClickEvent
+	// mu guards closed so that no event is sent on the queue after it is closed
+	mu           sync.RWMutex
+	closed       bool
+	workers      sync.WaitGroup
+	dropped      metric.Int64Counter
+	written      metric.Int64Counter
+	registration metric.Registration
+}
+
+func NewPipeline(store Store, config Config, logger *slog.Logger) (*Pipeline, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	p := &Pipeline{
+		store:  store,
+		config: config,
+		logger: logger,
+		queue:  make(chan ClickEvent, config.QueueSize),
+	}
+	meter := otel.Meter("analytics")
+	var err error
+	p.dropped, err = meter.Int64Counter(
+		"click_events.dropped",
+		metric.WithDescription("click events that were never written to the store"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.written, err = meter.Int64Counter(
+		"click_events.written",
+		metric.WithDescription("click events written to the store"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	depth, err := meter.Int64ObservableGauge(
+		"click_events.queue.depth",
+		metric.WithDescription("click events waiting in the queue"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.registration, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		o.ObserveInt64(depth, int64(len(p.queue)))
+		return nil
+	}, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for range config.Workers {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p, nil
+}
+
+func (p *Pipeline) drop(reason string, events int) {
+	p.dropped.Add(context.Background(), int64(events), metric.WithAttributes(attribute.String("reason", reason)))
+}
+
+// Record adds the event to the queue. When the queue is full the event is dropped
+// according to the overflow policy
+func (p *Pipeline) Record(event ClickEvent) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.drop(dropReasonClosed, 1)
+		return
+	}
+	select {
+	case p.queue <- event:
+		return
+	default:
+	}
+	if p.config.Overflow == OverflowBlock {
+		timer := time.NewTimer(p.config.EnqueueTimeout)
+		defer timer.Stop()
+		select {
+		case p.queue <- event:
+			return
+		case <-timer.C:
+		}
+	}
+	p.drop(dropReasonQueueFull, 1)
+}
+
+func (p *Pipeline) flush(batch []ClickEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.WriteTimeout)
+	defer cancel()
+	if err := p.store.WriteClicks(ctx, batch); err != nil {
+		p.logger.Error("unable to write click events", "error", err, "events", len(batch))
+		p.drop(dropReasonWriteFailed, len(batch))
+		return
+	}
+	p.written.Add(ctx, int64(len(batch)))
+}
+
+func (p *Pipeline) work() {
+	defer p.workers.Done()
+	// the store does not keep the batch so the same slice is reused for every batch
+	batch := make([]ClickEvent, 0, p.config.BatchSize)
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-p.queue:
+			if !ok {
+				// the queue is closed and drained
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= p.config.BatchSize {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			p.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// Shutdown stops accepting events and waits until the workers have written every
+// queued event. It returns the error of the context if the context is done first,
+// the workers keep draining the queue in that case
+func (p *Pipeline) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+		p.registration.Unregister()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
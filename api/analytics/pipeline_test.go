@@ -0,0 +1,144 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore keeps every batch it receives, it blocks writes until release is
+// closed when release is set
+type memoryStore struct {
+	mu      sync.Mutex
+	batches [][]ClickEvent
+	release chan struct{}
+	err     error
+}
+
+func (s *memoryStore) WriteClicks(ctx context.Context, events []ClickEvent) error {
+	if s.release != nil {
+		<-s.release
+	}
+	if s.err != nil {
+		return s.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the pipeline reuses the slice after the write returns
+	s.batches = append(s.batches, append([]ClickEvent(nil), events...))
+	return nil
+}
+
+func (s *memoryStore) events() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for _, batch := range s.batches {
+		total += len(batch)
+	}
+	return total
+}
+
+func testConfig() Config {
+	config := DefaultConfig()
+	config.Workers = 1
+	config.BatchSize = 3
+	// long enough that only full batches and shutdown cause writes
+	config.FlushInterval = time.Hour
+	return config
+}
+
+func TestPipelineBatchesAndFlushesOnShutdown(t *testing.T) {
+	store := &memoryStore{}
+	p, err := NewPipeline(store, testConfig(), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 7 {
+		p.Record(ClickEvent{ShortUrlId: "abcd1234"})
+	}
+	if err = p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed with %v", err)
+	}
+	if len(store.batches) != 3 || len(store.batches[0]) != 3 || len(store.batches[2]) != 1 {
+		t.Errorf("events were not written in batches of 3: %v", store.batches)
+	}
+	// events recorded after shutdown are dropped instead of panicking
+	p.Record(ClickEvent{ShortUrlId: "abcd1234"})
+	if store.events() != 7 {
+		t.Errorf("store received %d events, expected 7", store.events())
+	}
+}
+
+func TestPipelineFlushesOnInterval(t *testing.T) {
+	store := &memoryStore{}
+	config := testConfig()
+	config.FlushInterval = 10 * time.Millisecond
+	p, err := NewPipeline(store, config, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+	p.Record(ClickEvent{ShortUrlId: "abcd1234"})
+	deadline := time.Now().Add(time.Second)
+	for store.events() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if store.events() != 1 {
+		t.Errorf("a partial batch was not written after the flush interval")
+	}
+}
+
+func TestPipelineDropsWhenQueueIsFull(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowBlock} {
+		store := &memoryStore{release: make(chan struct{})}
+		config := testConfig()
+		config.QueueSize = 2
+		config.BatchSize = 1
+		config.Overflow = policy
+		p, err := NewPipeline(store, config, slog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the worker takes one event and blocks in the store, two more fill the queue
+		for range 10 {
+			p.Record(ClickEvent{ShortUrlId: "abcd1234"})
+		}
+		close(store.release)
+		if err = p.Shutdown(context.Background()); err != nil {
+			t.Fatalf("shutdown failed with %v", err)
+		}
+		if events := store.events(); events < 2 || events > 3 {
+			t.Errorf("%s policy wrote %d events, expected the queue size plus at most one in flight", policy, events)
+		}
+	}
+}
+
+func TestPipelineShutdownTimeout(t *testing.T) {
+	store := &memoryStore{release: make(chan struct{})}
+	p, err := NewPipeline(store, testConfig(), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Record(ClickEvent{ShortUrlId: "abcd1234"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown with a blocked store returned %v, expected a deadline error", err)
+	}
+	close(store.release)
+	if err = p.Shutdown(context.Background()); err != nil {
+		t.Errorf("second shutdown failed with %v", err)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Overflow = "spill"
+	if _, err := NewPipeline(&memoryStore{}, config, slog.Default()); err == nil {
+		t.Errorf("invalid overflow policy was accepted")
+	}
+}
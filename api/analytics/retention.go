@@ -0,0 +1,80 @@
+package analytics
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+
+	"townsag/url_shortener/api/db"
+)
+
+// RETENTION_BATCH_SIZE limits how many rows one delete statement removes so that
+// the retention job never holds locks on a large part of click_events
+const RETENTION_BATCH_SIZE int32 = 10000
+
+// RetentionJob deletes raw click events that are older than the retention window.
+// The rollups are not touched, they keep the counts of the deleted events
+type RetentionJob struct {
+	pool     *pgxpool.Pool
+	window   time.Duration
+	interval time.Duration
+	logger   *slog.Logger
+	expired  metric.Int64Counter
+}
+
+func NewRetentionJob(pool *pgxpool.Pool, window time.Duration, interval time.Duration, logger *slog.Logger) (*RetentionJob, error) {
+	expired, err := otel.Meter("analytics").Int64Counter(
+		"click_events.expired",
+		metric.WithDescription("raw click events deleted by the retention job"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &RetentionJob{pool: pool, window: window, interval: interval, logger: logger, expired: expired}, nil
+}
+
+// RunOnce deletes every click event that is older than the window and returns the
+// number of deleted events
+func (j *RetentionJob) RunOnce(ctx context.Context) (int64, error) {
+	// occurred_at is stored in UTC
+	cutoff := pgtype.Timestamp{Time: time.Now().UTC().Add(-j.window), Valid: true}
+	queries := db.New(j.pool)
+	var total int64
+	for {
+		deleted, err := queries.DeleteClickEventsBefore(ctx, db.DeleteClickEventsBeforeParams{
+			Cutoff:  cutoff,
+			MaxRows: RETENTION_BATCH_SIZE,
+		})
+		total += deleted
+		j.expired.Add(ctx, deleted)
+		if err != nil || deleted < int64(RETENTION_BATCH_SIZE) {
+			return total, err
+		}
+	}
+}
+
+// Run calls RunOnce every interval until the context is done. Several processes
+// may run the job at the same time, deleting the same events twice is harmless
+func (j *RetentionJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		deleted, err := j.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			j.logger.Error("unable to delete expired click events", "error", err)
+		} else if deleted > 0 {
+			j.logger.Info("deleted expired click events", "events", deleted)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package analytics
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"townsag/url_shortener/api/db"
+)
+
+const (
+	DeviceDesktop string = "desktop"
+	DeviceMobile  string = "mobile"
+	DeviceTablet  string = "tablet"
+	DeviceOther   string = "other"
+	// DeviceBot is used in the rollups for every click that was classified as a bot
+	DeviceBot string = "bot"
+	// DeviceUnknown is used for requests without a user agent
+	DeviceUnknown string = "unknown"
+)
+
+// DeviceClass sorts a user agent into a small number of classes. It only looks at
+// well known tokens, the classes are meant for dashboards and not for content
+// negotiation
+func DeviceClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return DeviceUnknown
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		(strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		return DeviceTablet
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") ||
+		strings.Contains(ua, "ipod") || strings.Contains(ua, "windows phone"):
+		return DeviceMobile
+	case strings.Contains(ua, "windows") || strings.Contains(ua, "macintosh") ||
+		strings.Contains(ua, "x11") || strings.Contains(ua, "cros") || strings.Contains(ua, "linux"):
+		return DeviceDesktop
+	default:
+		return DeviceOther
+	}
+}
+
+// ReferrerHost returns the lower case host of the referrer without a www. prefix,
+// it returns an empty string for clicks without a valid referrer
+func ReferrerHost(referrer string) string {
+	parsed, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+}
+
+// HourBucket and DayBucket return the start of the rollup bucket of a click in UTC
+func HourBucket(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour)
+}
+
+func DayBucket(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+type rollupKey struct {
+	shortUrlId   string
+	bucket       time.Time
+	referrerHost string
+	deviceClass  string
+}
+
+// rollup counts the events of a batch per rollup key. The rows are sorted so that
+// they are always upserted in the same order
+type rollup map[rollupKey]int64
+
+func newRollup(events []ClickEvent, bucket func(time.Time) time.Time) rollup {
+	counts := rollup{}
+	for _, event := range events {
+		deviceClass := DeviceClass(event.UserAgent)
+		if event.Bot {
+			deviceClass = DeviceBot
+		}
+		counts[rollupKey{
+			shortUrlId:   event.ShortUrlId,
+			bucket:       bucket(event.OccurredAt),
+			referrerHost: ReferrerHost(event.Referrer),
+			deviceClass:  deviceClass,
+		}]++
+	}
+	return counts
+}
+
+func (r rollup) sortedKeys() []rollupKey {
+	keys := make([]rollupKey, 0, len(r))
+	for key := range r {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b rollupKey) int {
+		if c := strings.Compare(a.shortUrlId, b.shortUrlId); c != 0 {
+			return c
+		}
+		if c := a.bucket.Compare(b.bucket); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.referrerHost, b.referrerHost); c != 0 {
+			return c
+		}
+		return strings.Compare(a.deviceClass, b.deviceClass)
+	})
+	return keys
+}
+
+func (r rollup) hourlyParams() db.UpsertHourlyRollupsParams {
+	params := db.UpsertHourlyRollupsParams{}
+	for _, key := range r.sortedKeys() {
+		params.MappingIds = append(params.MappingIds, key.shortUrlId)
+		params.Buckets = append(params.Buckets, pgtype.Timestamp{Time: key.bucket, Valid: true})
+		params.ReferrerHosts = append(params.ReferrerHosts, key.referrerHost)
+		params.DeviceClasses = append(params.DeviceClasses, key.deviceClass)
+		params.Clicks = append(params.Clicks, r[key])
+	}
+	return params
+}
+
+// the daily upsert takes the same columns as the hourly upsert
+func (r rollup) dailyParams() db.UpsertDailyRollupsParams {
+	return db.UpsertDailyRollupsParams(r.hourlyParams())
+}
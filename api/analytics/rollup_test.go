@@ -0,0 +1,74 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceClass(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		class     string
+	}{
+		{"", DeviceUnknown},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/126.0 Safari/537.36", DeviceDesktop},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 Version/17.5 Safari/605.1.15", DeviceDesktop},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148", DeviceMobile},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/126.0 Mobile Safari/537.36", DeviceMobile},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 Chrome/126.0 Safari/537.36", DeviceTablet},
+		{"Mozilla/5.0 (iPad; CPU OS 17_5 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148", DeviceTablet},
+		{"curl/8.7.1", DeviceOther},
+	}
+	for _, test := range tests {
+		if class := DeviceClass(test.userAgent); class != test.class {
+			t.Errorf("DeviceClass(%q) = %s, want %s", test.userAgent, class, test.class)
+		}
+	}
+}
+
+func TestReferrerHost(t *testing.T) {
+	tests := map[string]string{
+		"":                               "",
+		"https://WWW.News.example.com/a": "news.example.com",
+		"http://localhost:5173/":         "localhost",
+		"android-app://com.slack":        "com.slack",
+		"://broken":                      "",
+	}
+	for referrer, host := range tests {
+		if got := ReferrerHost(referrer); got != host {
+			t.Errorf("ReferrerHost(%q) = %q, want %q", referrer, got, host)
+		}
+	}
+}
+
+func TestRollup(t *testing.T) {
+	// 23:30 in UTC-8 is 07:30 on the next day in UTC
+	at := time.Date(2025, 3, 1, 23, 30, 0, 0, time.FixedZone("PST", -8*60*60))
+	if hour := HourBucket(at); !hour.Equal(time.Date(2025, 3, 2, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("HourBucket(%v) = %v", at, hour)
+	}
+	if day := DayBucket(at); !day.Equal(time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("DayBucket(%v) = %v", at, day)
+	}
+
+	events := []ClickEvent{
+		{ShortUrlId: "bbbbbbbb", OccurredAt: at, Referrer: "https://a.com"},
+		{ShortUrlId: "aaaaaaaa", OccurredAt: at, Referrer: "https://www.a.com/x"},
+		{ShortUrlId: "aaaaaaaa", OccurredAt: at.Add(time.Minute), Referrer: "https://a.com/y"},
+		{ShortUrlId: "aaaaaaaa", OccurredAt: at.Add(time.Hour)},
+	}
+	params := newRollup(events, HourBucket).hourlyParams()
+	if len(params.MappingIds) != 3 {
+		t.Fatalf("hourly rollup has %d rows, expected 3: %+v", len(params.MappingIds), params)
+	}
+	if params.MappingIds[0] != "aaaaaaaa" || params.Clicks[0] != 2 || params.ReferrerHosts[0] != "a.com" {
+		t.Errorf("first hourly row is not the two clicks from a.com: %+v", params)
+	}
+	if params.MappingIds[2] != "bbbbbbbb" {
+		t.Errorf("hourly rows are not sorted by mapping id: %v", params.MappingIds)
+	}
+	daily := newRollup(events, DayBucket).dailyParams()
+	if len(daily.MappingIds) != 3 || daily.Clicks[0] != 1 || daily.Clicks[1] != 2 {
+		t.Errorf("daily rollup does not combine the hours of a day: %+v", daily)
+	}
+}
@@ -0,0 +1,399 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const dropReasonStreamUnavailable string = "stream_unavailable"
+
+// StreamConfig configures the redis stream mode. In this mode click events survive
+// a crash of the process that recorded them because they are only removed from the
+// pending entries of the consumer group after they have been written to the store.
+// The stream names contain a colon so that they cannot collide with the cached
+// mappings, which are keyed by the short url id
+type StreamConfig struct {
+	Stream string
+	Group  string
+	// Consumer names this process within the group, it must be unique per process
+	Consumer string
+	// MaxLen caps the length of the stream. Trimming is approximate and removes
+	// the oldest entries, even if they have not been consumed yet
+	MaxLen     int64
+	AddTimeout time.Duration
+	// BatchSize is the maximum number of entries read by one XREADGROUP
+	BatchSize    int
+	Block        time.Duration
+	WriteTimeout time.Duration
+	// entries that were read by a consumer but not acknowledged within MinIdle are
+	// claimed by another consumer, this is checked every ReclaimInterval
+	MinIdle         time.Duration
+	ReclaimInterval time.Duration
+	// entries that were delivered more than MaxDeliveries times are moved to
+	// DeadLetterStream and acknowledged so that an entry that can never be
+	// written does not keep being reclaimed
+	MaxDeliveries    int64
+	DeadLetterStream string
+}
+
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		Stream:           "click_events:stream",
+		Group:            "click_writers",
+		Consumer:         "consumer",
+		MaxLen:           1000000,
+		AddTimeout:       50 * time.Millisecond,
+		BatchSize:        500,
+		Block:            time.Second,
+		WriteTimeout:     5 * time.Second,
+		MinIdle:          time.Minute,
+		ReclaimInterval:  30 * time.Second,
+		MaxDeliveries:    10,
+		DeadLetterStream: "click_events:dead_letter",
+	}
+}
+
+func encodeClickEvent(event ClickEvent) map[string]any {
+	return map[string]any{
+		"shortUrlId": event.ShortUrlId,
+		"occurredAt": event.OccurredAt.UTC().Format(time.RFC3339Nano),
+		"referrer":   event.Referrer,
+		"userAgent":  event.UserAgent,
+		"bot":        strconv.FormatBool(event.Bot),
+		"botReason":  event.BotReason,
+		"visitorId":  event.VisitorId,
+	}
+}
+
+func decodeClickEvent(values map[string]any) (ClickEvent, error) {
+	field := func(name string) string {
+		value, _ := values[name].(string)
+		return value
+	}
+	event := ClickEvent{
+		ShortUrlId: field("shortUrlId"),
+		Referrer:   field("referrer"),
+		UserAgent:  field("userAgent"),
+		// entries written before bots were classified have no bot field
+		Bot:       field("bot") == "true",
+		BotReason: field("botReason"),
+		VisitorId: field("visitorId"),
+	}
+	if event.ShortUrlId == "" {
+		return ClickEvent{}, errors.New("stream entry has no shortUrlId")
+	}
+	occurredAt, err := time.Parse(time.RFC3339Nano, field("occurredAt"))
+	if err != nil {
+		return ClickEvent{}, fmt.Errorf("stream entry has an invalid occurredAt: %w", err)
+	}
+	event.OccurredAt = occurredAt
+	return event, nil
+}
+
+// StreamRecorder appends click events to a redis stream with XADD
+type StreamRecorder struct {
+	client  *redis.Client
+	config  StreamConfig
+	logger  *slog.Logger
+	dropped metric.Int64Counter
+}
+
+func NewStreamRecorder(client *redis.Client, config StreamConfig, logger *slog.Logger) (*StreamRecorder, error) {
+	dropped, err := otel.Meter("analytics").Int64Counter(
+		"click_events.dropped",
+		metric.WithDescription("click events that were never written to the store"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamRecorder{client: client, config: config, logger: logger, dropped: dropped}, nil
+}
+
+// Record adds the event to the stream. The event is dropped when redis does not
+// respond within AddTimeout so that a slow redis cannot stall redirects
+func (s *StreamRecorder) Record(event ClickEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.AddTimeout)
+	defer cancel()
+	err := s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.config.Stream,
+		MaxLen: s.config.MaxLen,
+		Approx: true,
+		Values: encodeClickEvent(event),
+	}).Err()
+	if err != nil {
+		s.logger.Warn("unable to add click event to the stream", "error", err, "shortUrl", event.ShortUrlId)
+		s.dropped.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", dropReasonStreamUnavailable)))
+	}
+}
+
+// StreamConsumer reads click events from the stream as a member of the consumer
+// group and writes them to the store. Delivery is at least once, an entry that was
+// written but not acknowledged before a crash is written again by the consumer
+// that reclaims it
+type StreamConsumer struct {
+	client       *redis.Client
+	store        Store
+	config       StreamConfig
+	logger       *slog.Logger
+	written      metric.Int64Counter
+	reclaimed    metric.Int64Counter
+	deadLettered metric.Int64Counter
+}
+
+func NewStreamConsumer(client *redis.Client, store Store, config StreamConfig, logger *slog.Logger) (*StreamConsumer, error) {
+	meter := otel.Meter("analytics")
+	written, err := meter.Int64Counter(
+		"click_events.written",
+		metric.WithDescription("click events written to the store"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	reclaimed, err := meter.Int64Counter(
+		"click_events.reclaimed",
+		metric.WithDescription("stream entries claimed from consumers that stopped processing them"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	deadLettered, err := meter.Int64Counter(
+		"click_events.dead_lettered",
+		metric.WithDescription("stream entries moved to the dead letter stream after too many deliveries"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamConsumer{
+		client:       client,
+		store:        store,
+		config:       config,
+		logger:       logger.With("consumer", config.Consumer),
+		written:      written,
+		reclaimed:    reclaimed,
+		deadLettered: deadLettered,
+	}, nil
+}
+
+func (c *StreamConsumer) ensureGroup(ctx context.Context) error {
+	// start at 0 so that entries added before the group existed are consumed too
+	err := c.client.XGroupCreateMkStream(ctx, c.config.Stream, c.config.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("unable to create consumer group %s: %w", c.config.Group, err)
+	}
+	return nil
+}
+
+// process writes the events of the messages and acknowledges them. Messages are
+// left pending when the write fails so that they are retried after MinIdle
+func (c *StreamConsumer) process(messages []redis.XMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	events := make([]ClickEvent, 0, len(messages))
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+		event, err := decodeClickEvent(message.Values)
+		if err != nil {
+			// retrying cannot fix a malformed entry so it is acknowledged and dropped
+			c.logger.Error("dropping malformed click event", "error", err, "entry", message.ID)
+			continue
+		}
+		events = append(events, event)
+	}
+	// the write is not tied to the context of Run so that a shutdown does not
+	// abort a batch halfway
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.WriteTimeout)
+	defer cancel()
+	if len(events) > 0 {
+		if err := c.store.WriteClicks(ctx, events); err != nil {
+			return fmt.Errorf("unable to write %d click events: %w", len(events), err)
+		}
+		c.written.Add(ctx, int64(len(events)))
+	}
+	return c.client.XAck(ctx, c.config.Stream, c.config.Group, ids...).Err()
+}
+
+// partitionByDeliveries splits messages into the ones that may be retried and the
+// ones that were delivered more than maxDeliveries times. Messages without a
+// delivery count are retried
+func partitionByDeliveries(messages []redis.XMessage, deliveries map[string]int64, maxDeliveries int64) ([]redis.XMessage, []redis.XMessage) {
+	var retry, dead []redis.XMessage
+	for _, message := range messages {
+		if deliveries[message.ID] > maxDeliveries {
+			dead = append(dead, message)
+		} else {
+			retry = append(retry, message)
+		}
+	}
+	return retry, dead
+}
+
+// deadLetter moves the messages that were delivered more than MaxDeliveries times
+// to the dead letter stream and returns the messages that should be retried. The
+// delivery counts are read with one XPENDING per message since the pending entries
+// of the consumer between the claimed ids are not necessarily all claimed
+func (c *StreamConsumer) deadLetter(ctx context.Context, messages []redis.XMessage) ([]redis.XMessage, error) {
+	if len(messages) == 0 {
+		return messages, nil
+	}
+	pipe := c.client.Pipeline()
+	commands := make([]*redis.XPendingExtCmd, 0, len(messages))
+	for _, message := range messages {
+		commands = append(commands, pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: c.config.Stream,
+			Group:  c.config.Group,
+			Start:  message.ID,
+			End:    message.ID,
+			Count:  1,
+		}))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("unable to read the delivery counts of pending click events: %w", err)
+	}
+	deliveries := make(map[string]int64, len(messages))
+	for _, command := range commands {
+		for _, pending := range command.Val() {
+			deliveries[pending.ID] = pending.RetryCount
+		}
+	}
+	retry, dead := partitionByDeliveries(messages, deliveries, c.config.MaxDeliveries)
+	for _, message := range dead {
+		// the entry is added before it is acknowledged so that it is never lost,
+		// a crash in between adds it to the dead letter stream twice
+		values := make(map[string]any, len(message.Values)+2)
+		for key, value := range message.Values {
+			values[key] = value
+		}
+		values["sourceEntry"] = message.ID
+		values["deliveries"] = strconv.FormatInt(deliveries[message.ID], 10)
+		err := c.client.XAdd(ctx, &redis.XAddArgs{
+			Stream: c.config.DeadLetterStream,
+			MaxLen: c.config.MaxLen,
+			Approx: true,
+			Values: values,
+		}).Err()
+		if err != nil {
+			return nil, fmt.Errorf("unable to move click event %s to the dead letter stream: %w", message.ID, err)
+		}
+		if err = c.client.XAck(ctx, c.config.Stream, c.config.Group, message.ID).Err(); err != nil {
+			return nil, fmt.Errorf("unable to acknowledge dead lettered click event %s: %w", message.ID, err)
+		}
+		c.logger.Error(
+			"moved click event to the dead letter stream",
+			"entry", message.ID,
+			"deliveries", deliveries[message.ID],
+			"stream", c.config.DeadLetterStream,
+		)
+		c.deadLettered.Add(ctx, 1)
+	}
+	return retry, nil
+}
+
+// processReclaimed processes reclaimed messages in one batch and falls back to one
+// message at a time when the batch fails, so that a single entry that cannot be
+// written does not hold back the rest of its batch
+func (c *StreamConsumer) processReclaimed(messages []redis.XMessage) error {
+	err := c.process(messages)
+	if err == nil || len(messages) < 2 {
+		return err
+	}
+	c.logger.Warn("unable to process reclaimed click events as a batch, retrying them one at a time", "error", err)
+	var failed []error
+	for _, message := range messages {
+		if err := c.process([]redis.XMessage{message}); err != nil {
+			failed = append(failed, fmt.Errorf("entry %s: %w", message.ID, err))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// reclaim takes over entries that other consumers read but did not acknowledge
+// within MinIdle, for example because the consumer crashed or failed to write
+// them. Entries that keep failing are moved to the dead letter stream
+func (c *StreamConsumer) reclaim(ctx context.Context) error {
+	start := "0-0"
+	for {
+		messages, next, err := c.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   c.config.Stream,
+			Group:    c.config.Group,
+			MinIdle:  c.config.MinIdle,
+			Start:    start,
+			Count:    int64(c.config.BatchSize),
+			Consumer: c.config.Consumer,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			c.logger.Info("reclaimed pending click events", "entries", len(messages))
+			c.reclaimed.Add(ctx, int64(len(messages)))
+		}
+		if messages, err = c.deadLetter(ctx, messages); err != nil {
+			return err
+		}
+		if err = c.processReclaimed(messages); err != nil {
+			return err
+		}
+		// XAUTOCLAIM returns 0-0 once the whole pending entries list was scanned
+		if next == "0-0" {
+			return nil
+		}
+		start = next
+	}
+}
+
+// Run consumes the stream until the context is done
+func (c *StreamConsumer) Run(ctx context.Context) error {
+	if err := c.ensureGroup(ctx); err != nil {
+		return err
+	}
+	var lastReclaim time.Time
+	for ctx.Err() == nil {
+		if time.Since(lastReclaim) >= c.config.ReclaimInterval {
+			if err := c.reclaim(ctx); err != nil && ctx.Err() == nil {
+				c.logger.Error("unable to reclaim pending click events", "error", err)
+			}
+			lastReclaim = time.Now()
+		}
+		streams, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.config.Group,
+			Consumer: c.config.Consumer,
+			Streams:  []string{c.config.Stream, ">"},
+			Count:    int64(c.config.BatchSize),
+			Block:    c.config.Block,
+		}).Result()
+		if errors.Is(err, redis.Nil) || ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			c.logger.Error("unable to read click events from the stream", "error", err)
+			// back off so that an unavailable redis is not polled in a tight loop
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.config.Block):
+			}
+			continue
+		}
+		for _, stream := range streams {
+			if err = c.process(stream.Messages); err != nil {
+				c.logger.Error("unable to process click events, they will be reclaimed", "error", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestClickEventStreamEncoding(t *testing.T) {
+	event := ClickEvent{
+		ShortUrlId: "abcd1234",
+		OccurredAt: time.Date(2025, 1, 2, 3, 4, 5, 6, time.UTC),
+		Referrer:   "https://news.example.com",
+		UserAgent:  "curl/8.0",
+		Bot:        true,
+		BotReason:  BotReasonUserAgent,
+		VisitorId:  "5f0e2b8c9d1a4e7f",
+	}
+	// redis returns every field of a stream entry as a string
+	values := map[string]any{}
+	for key, value := range encodeClickEvent(event) {
+		values[key] = value.(string)
+	}
+	decoded, err := decodeClickEvent(values)
+	if err != nil {
+		t.Fatalf("decoding an encoded event failed with %v", err)
+	}
+	if decoded != event {
+		t.Errorf("decoded event %+v does not match %+v", decoded, event)
+	}
+
+	for _, values := range []map[string]any{
+		{"occurredAt": "2025-01-02T03:04:05Z"},
+		{"shortUrlId": "abcd1234", "occurredAt": "yesterday"},
+	} {
+		if _, err := decodeClickEvent(values); err == nil {
+			t.Errorf("malformed entry %v was decoded", values)
+		}
+	}
+}
+
+func TestPartitionByDeliveries(t *testing.T) {
+	messages := []redis.XMessage{{ID: "1-0"}, {ID: "2-0"}, {ID: "3-0"}}
+	deliveries := map[string]int64{"1-0": 3, "2-0": 4}
+	retry, dead := partitionByDeliveries(messages, deliveries, 3)
+	if len(dead) != 1 || dead[0].ID != "2-0" {
+		t.Errorf("expected only 2-0 to be dead lettered, received %v", dead)
+	}
+	// 3-0 has no delivery count, it is retried rather than dropped
+	if len(retry) != 2 || retry[0].ID != "1-0" || retry[1].ID != "3-0" {
+		t.Errorf("expected 1-0 and 3-0 to be retried, received %v", retry)
+	}
+}
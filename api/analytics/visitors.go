@@ -0,0 +1,167 @@
+package analytics
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	VISITOR_SALT_BYTES int = 32
+	// the salt of a day is kept a little longer than the day so that clicks that
+	// are recorded around midnight still find it
+	VISITOR_SALT_TTL time.Duration = 48 * time.Hour
+	// UNIQUE_VISITORS_TTL is how long the daily HyperLogLog of a mapping is kept
+	UNIQUE_VISITORS_TTL time.Duration = 400 * 24 * time.Hour
+	SALT_TIMEOUT        time.Duration = 50 * time.Millisecond
+)
+
+func dayKey(t time.Time) string {
+	return DayBucket(t).Format(time.DateOnly)
+}
+
+func visitorSaltKey(day string) string {
+	return fmt.Sprintf("visitor_salt:%s", day)
+}
+
+func uniqueVisitorsKey(shortUrlId string, day string) string {
+	return fmt.Sprintf("unique_visitors:%s:%s", shortUrlId, day)
+}
+
+// VisitorHasher turns the address and user agent of a client into an id that is
+// only stable for one day. The salt of each day is random and shared by every
+// instance through redis, it expires after the day so that ids from different
+// days cannot be linked and the address cannot be recovered by brute force
+type VisitorHasher struct {
+	client *redis.Client
+	// the salt of the current day is cached so that redis is only asked once a day
+	mu   sync.Mutex
+	day  string
+	salt string
+}
+
+func NewVisitorHasher(client *redis.Client) *VisitorHasher {
+	return &VisitorHasher{client: client}
+}
+
+func (h *VisitorHasher) saltFor(ctx context.Context, day string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.day == day {
+		return h.salt, nil
+	}
+	candidate := make([]byte, VISITOR_SALT_BYTES)
+	if _, err := rand.Read(candidate); err != nil {
+		return "", err
+	}
+	// the first instance to set the salt of a day wins, every other instance reads
+	// the winning salt back
+	key := visitorSaltKey(day)
+	if err := h.client.SetNX(ctx, key, hex.EncodeToString(candidate), VISITOR_SALT_TTL).Err(); err != nil {
+		return "", err
+	}
+	salt, err := h.client.Get(ctx, key).Result()
+	if err != nil {
+		return "", err
+	}
+	h.day, h.salt = day, salt
+	return salt, nil
+}
+
+// Hash returns the visitor id of the client on the day of at
+func (h *VisitorHasher) Hash(ctx context.Context, at time.Time, clientIP string, userAgent string) (string, error) {
+	salt, err := h.saltFor(ctx, dayKey(at))
+	if err != nil {
+		return "", fmt.Errorf("unable to get the visitor salt: %w", err)
+	}
+	sum := sha256.Sum256([]byte(salt + "\x00" + clientIP + "\x00" + userAgent))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// VisitorRecorder replaces the client address of each event with its visitor id
+// before the event is passed on, so the address never leaves the request
+type VisitorRecorder struct {
+	next   Recorder
+	hasher *VisitorHasher
+	logger *slog.Logger
+}
+
+func NewVisitorRecorder(next Recorder, hasher *VisitorHasher, logger *slog.Logger) *VisitorRecorder {
+	return &VisitorRecorder{next: next, hasher: hasher, logger: logger}
+}
+
+func (v *VisitorRecorder) Record(event ClickEvent) {
+	if !event.Bot {
+		ctx, cancel := context.WithTimeout(context.Background(), SALT_TIMEOUT)
+		visitorId, err := v.hasher.Hash(ctx, event.OccurredAt, event.ClientIP, event.UserAgent)
+		cancel()
+		if err != nil {
+			// the click is still recorded, it is only missing from the unique visitors
+			v.logger.Warn("unable to hash visitor", "error", err, "shortUrl", event.ShortUrlId)
+		}
+		event.VisitorId = visitorId
+	}
+	event.ClientIP = ""
+	v.next.Record(event)
+}
+
+// UniqueVisitors keeps a HyperLogLog of visitor ids per mapping and day. Because
+// visitor ids change every day the estimates of different days cannot be combined
+type UniqueVisitors struct {
+	Client *redis.Client
+}
+
+// Add is idempotent, adding the same events twice does not change the estimates
+func (u *UniqueVisitors) Add(ctx context.Context, events []ClickEvent) error {
+	visitors := map[string][]any{}
+	for _, event := range events {
+		if event.VisitorId == "" {
+			continue
+		}
+		key := uniqueVisitorsKey(event.ShortUrlId, dayKey(event.OccurredAt))
+		visitors[key] = append(visitors[key], event.VisitorId)
+	}
+	if len(visitors) == 0 {
+		return nil
+	}
+	pipe := u.Client.Pipeline()
+	for key, ids := range visitors {
+		pipe.PFAdd(ctx, key, ids...)
+		pipe.Expire(ctx, key, UNIQUE_VISITORS_TTL)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// UniqueVisitorsRetained reports whether the HyperLogLog of the day has not yet
+// expired. The key of a day is last written during that day so it is kept at
+// least until UNIQUE_VISITORS_TTL after the start of the day
+func UniqueVisitorsRetained(day time.Time, now time.Time) bool {
+	return DayBucket(day).After(DayBucket(now).Add(-UNIQUE_VISITORS_TTL))
+}
+
+// Estimate returns the estimated number of unique visitors of the mapping on each
+// of the days. The estimate of a day that is no longer retained is 0, see
+// UniqueVisitorsRetained
+func (u *UniqueVisitors) Estimate(ctx context.Context, shortUrlId string, days []time.Time) ([]int64, error) {
+	pipe := u.Client.Pipeline()
+	counts := make([]*redis.IntCmd, 0, len(days))
+	for _, day := range days {
+		counts = append(counts, pipe.PFCount(ctx, uniqueVisitorsKey(shortUrlId, dayKey(day))))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	estimates := make([]int64, 0, len(days))
+	for _, count := range counts {
+		estimates = append(estimates, count.Val())
+	}
+	return estimates, nil
+}
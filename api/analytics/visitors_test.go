@@ -0,0 +1,25 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUniqueVisitorsRetained(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		day      time.Time
+		retained bool
+	}{
+		{now, true},
+		{now.Add(-UNIQUE_VISITORS_TTL + 24*time.Hour), true},
+		// the estimates of this day may already have expired
+		{now.Add(-UNIQUE_VISITORS_TTL), false},
+		{now.Add(-2 * UNIQUE_VISITORS_TTL), false},
+	}
+	for _, test := range tests {
+		if retained := UniqueVisitorsRetained(test.day, now); retained != test.retained {
+			t.Errorf("UniqueVisitorsRetained(%s) = %v, want %v", test.day.Format(time.DateOnly), retained, test.retained)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package blocklist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+Entries in the blocklist come in three forms:
+  - example.com        blocks exactly the host example.com
+  - *.example.com      blocks every subdomain of example.com but not example.com itself
+  - https://example.com/path
+                       blocks example.com/path and every path below it
+
+Entries are normalized to lower case so matching is case insensitive. Url entries
+are compared by host and path rather than by the raw url, the scheme, user info,
+port and a trailing dot on the host do not change the host that a browser ends
+up at and are ignored. Paths are matched by whole segments so /path does not
+block /pathway
+*/
+
+type urlPrefix struct {
+	host string
+	path string
+}
+
+type Blocklist struct {
+	mu        sync.RWMutex
+	domains   map[string]struct{}
+	wildcards map[string]struct{}
+	prefixes  map[string]urlPrefix
+	// entries loaded from the blocklist file, they are kept when the stored
+	// entries are replaced
+	fileEntries map[string]struct{}
+}
+
+func New() *Blocklist {
+	return &Blocklist{
+		domains:     make(map[string]struct{}),
+		wildcards:   make(map[string]struct{}),
+		prefixes:    make(map[string]urlPrefix),
+		fileEntries: make(map[string]struct{}),
+	}
+}
+
+// LoadFile creates a blocklist from a file with one entry per line. Blank lines
+// and lines starting with # are ignored
+func LoadFile(path string) (*Blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open blocklist file: %w", err)
+	}
+	defer file.Close()
+
+	b := New()
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, err := b.Add(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocklist entry on line %d: %w", lineNumber, err)
+		}
+		b.fileEntries[entry] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read blocklist file: %w", err)
+	}
+	return b, nil
+}
+
+func isUrlEntry(entry string) bool {
+	return strings.HasPrefix(entry, "http://") || strings.HasPrefix(entry, "https://")
+}
+
+// normalizeHost drops the port, user info and trailing dot of the host of a url
+func normalizeHost(parsed *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+}
+
+// normalizePath resolves dot segments and drops the trailing slash so that paths
+// can be compared segment by segment, the root path normalizes to ""
+func normalizePath(rawPath string) string {
+	if rawPath == "" {
+		return ""
+	}
+	return strings.TrimSuffix(path.Clean("/"+strings.ToLower(rawPath)), "/")
+}
+
+func parseUrlEntry(entry string) (urlPrefix, error) {
+	parsed, err := url.Parse(entry)
+	if err != nil || normalizeHost(parsed) == "" {
+		return urlPrefix{}, fmt.Errorf("url entry %q must be an absolute url", entry)
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return urlPrefix{}, fmt.Errorf("url entry %q must not have a query or fragment", entry)
+	}
+	return urlPrefix{host: normalizeHost(parsed), path: normalizePath(parsed.Path)}, nil
+}
+
+// NormalizeEntry validates an entry and returns the form it is stored in. Url
+// entries are stored as https urls without a port or user info since neither
+// the scheme nor the port is part of the match
+func NormalizeEntry(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if isUrlEntry(entry) {
+		prefix, err := parseUrlEntry(entry)
+		if err != nil {
+			return "", err
+		}
+		return "https://" + prefix.host + prefix.path, nil
+	}
+	domain := strings.TrimSuffix(strings.TrimPrefix(entry, "*."), ".")
+	if domain == "" || strings.ContainsAny(domain, "/:*?# ") {
+		return "", fmt.Errorf("domain entry %q must be a domain, optionally prefixed with *.", entry)
+	}
+	if strings.HasPrefix(entry, "*.") {
+		return "*." + domain, nil
+	}
+	return domain, nil
+}
+
+// Add adds an entry and returns it in its normalized form
+func (b *Blocklist) Add(entry string) (string, error) {
+	normalized, err := NormalizeEntry(entry)
+	if err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.add(normalized)
+	return normalized, nil
+}
+
+// add must be called while holding the lock with a normalized entry
+func (b *Blocklist) add(normalized string) {
+	switch {
+	case isUrlEntry(normalized):
+		// the normalized form always parses
+		prefix, _ := parseUrlEntry(normalized)
+		b.prefixes[normalized] = prefix
+	case strings.HasPrefix(normalized, "*."):
+		b.wildcards[normalized] = struct{}{}
+	default:
+		b.domains[normalized] = struct{}{}
+	}
+}
+
+// Replace swaps every entry that was not loaded from the blocklist file for the
+// given entries. It is used to apply the entries that are shared between
+// instances, invalid entries are skipped and returned in the error
+func (b *Blocklist) Replace(entries []string) error {
+	var invalid []error
+	normalized := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		n, err := NormalizeEntry(entry)
+		if err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		normalized = append(normalized, n)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.domains = make(map[string]struct{})
+	b.wildcards = make(map[string]struct{})
+	b.prefixes = make(map[string]urlPrefix)
+	for entry := range b.fileEntries {
+		b.add(entry)
+	}
+	for _, entry := range normalized {
+		b.add(entry)
+	}
+	return errors.Join(invalid...)
+}
+
+// FromFile reports whether the normalized entry was loaded from the blocklist file
+func (b *Blocklist) FromFile(normalized string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.fileEntries[normalized]
+	return ok
+}
+
+// Remove removes an entry and reports whether it was present
+func (b *Blocklist) Remove(entry string) (bool, error) {
+	normalized, err := NormalizeEntry(entry)
+	if err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ok bool
+	switch {
+	case isUrlEntry(normalized):
+		_, ok = b.prefixes[normalized]
+		delete(b.prefixes, normalized)
+	case strings.HasPrefix(normalized, "*."):
+		_, ok = b.wildcards[normalized]
+		delete(b.wildcards, normalized)
+	default:
+		_, ok = b.domains[normalized]
+		delete(b.domains, normalized)
+	}
+	return ok, nil
+}
+
+// Entries returns every entry in the blocklist in sorted order
+func (b *Blocklist) Entries() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	entries := make([]string, 0, len(b.domains)+len(b.wildcards)+len(b.prefixes))
+	for _, set := range []map[string]struct{}{b.domains, b.wildcards} {
+		for entry := range set {
+			entries = append(entries, entry)
+		}
+	}
+	for entry := range b.prefixes {
+		entries = append(entries, entry)
+	}
+	slices.Sort(entries)
+	return entries
+}
+
+// Match returns the entry that blocks the url. Urls that cannot be parsed are
+// not matched, callers are expected to validate urls before checking them
+func (b *Blocklist) Match(rawUrl string) (string, bool) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", false
+	}
+	host := normalizeHost(parsed)
+	urlPath := normalizePath(parsed.Path)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if _, ok := b.domains[host]; ok {
+		return host, true
+	}
+	// check every parent domain of the host against the wildcard entries,
+	// a.b.example.com is matched by *.b.example.com and *.example.com
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels); i++ {
+		wildcard := "*." + strings.Join(labels[i:], ".")
+		if _, ok := b.wildcards[wildcard]; ok {
+			return wildcard, true
+		}
+	}
+	for entry, prefix := range b.prefixes {
+		if prefix.host != host {
+			continue
+		}
+		if urlPath == prefix.path || strings.HasPrefix(urlPath, prefix.path+"/") {
+			return entry, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,162 @@
+package blocklist
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	b := New()
+	for _, entry := range []string{"evil.com", "*.phish.net", "https://docs.example.com/malware/"} {
+		if _, err := b.Add(entry); err != nil {
+			t.Fatalf("Add(%s) returned an unexpected error: %v", entry, err)
+		}
+	}
+	tests := []struct {
+		url     string
+		blocked bool
+	}{
+		{"https://evil.com/login", true},
+		{"https://EVIL.com.", true},
+		{"https://sub.evil.com", false},
+		{"https://phish.net", false},
+		{"https://a.phish.net", true},
+		{"http://a.b.phish.net/x", true},
+		{"https://docs.example.com/malware/payload.exe", true},
+		{"https://docs.example.com/safe", false},
+		{"https://google.com", false},
+	}
+	for _, test := range tests {
+		if _, blocked := b.Match(test.url); blocked != test.blocked {
+			t.Errorf("Match(%s) = %v, want %v", test.url, blocked, test.blocked)
+		}
+	}
+}
+
+func TestMatchUrlEntry(t *testing.T) {
+	b := New()
+	for _, entry := range []string{"https://evil.com", "http://Example.org/phish/"} {
+		if _, err := b.Add(entry); err != nil {
+			t.Fatalf("Add(%s) returned an unexpected error: %v", entry, err)
+		}
+	}
+	tests := []struct {
+		url     string
+		blocked bool
+	}{
+		// forms of the same destination that a raw prefix comparison misses
+		{"https://user@evil.com/x", true},
+		{"https://evil.com:443/x", true},
+		{"https://evil.com./x", true},
+		{"http://evil.com/x", true},
+		{"https://example.org/phish", true},
+		{"https://example.org/phish/login", true},
+		{"https://example.org/safe/../phish/login", true},
+		{"https://example.org/phish%2Flogin", true},
+		// hosts and paths that only share a prefix with an entry
+		{"https://evil.com.example.org", false},
+		{"https://evil.community", false},
+		{"https://example.org/phishing", false},
+		{"https://example.org", false},
+	}
+	for _, test := range tests {
+		if _, blocked := b.Match(test.url); blocked != test.blocked {
+			t.Errorf("Match(%s) = %v, want %v", test.url, blocked, test.blocked)
+		}
+	}
+	if entries := b.Entries(); !slices.Equal(entries, []string{"https://evil.com", "https://example.org/phish"}) {
+		t.Fatalf("url entries were not normalized: %v", entries)
+	}
+	if removed, err := b.Remove("http://evil.com:80/"); err != nil || !removed {
+		t.Fatalf("Remove returned removed: %v, error: %v", removed, err)
+	}
+}
+
+func TestAddInvalidEntry(t *testing.T) {
+	b := New()
+	for _, entry := range []string{"", "*.", "evil.com/path", "https://", "https://evil.com/?id=1"} {
+		if _, err := b.Add(entry); err == nil {
+			t.Errorf("Add(%q) expected an error, received nil", entry)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	b := New()
+	b.Add("*.Evil.com")
+	removed, err := b.Remove("*.evil.com")
+	if err != nil || !removed {
+		t.Fatalf("Remove returned removed: %v, error: %v", removed, err)
+	}
+	if _, blocked := b.Match("https://a.evil.com"); blocked {
+		t.Fatal("removed entry still blocks urls")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	contents := "# known phishing domains\nevil.com\n\n*.phish.net\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile returned an unexpected error: %v", err)
+	}
+	if entries := b.Entries(); !slices.Equal(entries, []string{"*.phish.net", "evil.com"}) {
+		t.Fatalf("LoadFile loaded the wrong entries: %v", entries)
+	}
+}
+
+func TestReplaceKeepsFileEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("evil.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile returned an unexpected error: %v", err)
+	}
+	b.Add("stale.example")
+	if err = b.Replace([]string{"*.phish.net", "not a domain/"}); err == nil {
+		t.Error("Replace expected an error for the invalid entry, received nil")
+	}
+	if entries := b.Entries(); !slices.Equal(entries, []string{"*.phish.net", "evil.com"}) {
+		t.Fatalf("Replace left the wrong entries: %v", entries)
+	}
+	if !b.FromFile("evil.com") || b.FromFile("*.phish.net") {
+		t.Fatal("FromFile does not report the entries of the blocklist file")
+	}
+}
+
+func TestGuardCheck(t *testing.T) {
+	b := New()
+	b.Add("evil.com")
+	scanner := &StubScanner{Verdicts: map[string]Verdict{
+		"https://malware.example": {Blocked: true, Reason: "known malware"},
+	}}
+	guard := NewGuard(b, scanner)
+
+	for url, blocked := range map[string]bool{
+		"https://evil.com":        true,
+		"https://malware.example": true,
+		"https://google.com":      false,
+	} {
+		verdict, err := guard.Check(context.Background(), url)
+		if err != nil {
+			t.Fatalf("Check(%s) returned an unexpected error: %v", url, err)
+		}
+		if verdict.Blocked != blocked {
+			t.Errorf("Check(%s) = %v, want %v", url, verdict.Blocked, blocked)
+		}
+	}
+
+	scanner.Err = errors.New("reputation service unavailable")
+	if _, err := guard.Check(context.Background(), "https://google.com"); err == nil {
+		t.Fatal("expected the scanner error to be returned")
+	}
+}
@@ -0,0 +1,69 @@
+package blocklist
+
+import (
+	"context"
+	"fmt"
+)
+
+// Verdict is the result of checking a url
+type Verdict struct {
+	Blocked bool
+	Reason  string
+}
+
+// URLScanner checks a url against a reputation service. Implementations for
+// external services can be added without changing the handlers
+type URLScanner interface {
+	Scan(ctx context.Context, url string) (Verdict, error)
+}
+
+// NoopScanner allows every url, it is used when no reputation service is configured
+type NoopScanner struct{}
+
+func (NoopScanner) Scan(ctx context.Context, url string) (Verdict, error) {
+	return Verdict{}, nil
+}
+
+// StubScanner returns fixed verdicts, it is meant for tests and local development
+type StubScanner struct {
+	Verdicts map[string]Verdict
+	Err      error
+}
+
+func (s *StubScanner) Scan(ctx context.Context, url string) (Verdict, error) {
+	if s.Err != nil {
+		return Verdict{}, s.Err
+	}
+	return s.Verdicts[url], nil
+}
+
+// Guard combines the local blocklist with a scanner
+type Guard struct {
+	Blocklist *Blocklist
+	Scanner   URLScanner
+}
+
+func NewGuard(blocklist *Blocklist, scanner URLScanner) *Guard {
+	return &Guard{Blocklist: blocklist, Scanner: scanner}
+}
+
+// CheckBlocklist only consults the local blocklist, it is cheap enough to be used
+// on the redirect path
+func (g *Guard) CheckBlocklist(url string) Verdict {
+	if entry, ok := g.Blocklist.Match(url); ok {
+		return Verdict{Blocked: true, Reason: fmt.Sprintf("destination matches blocklist entry %s", entry)}
+	}
+	return Verdict{}
+}
+
+// Check consults the local blocklist and then the scanner
+func (g *Guard) Check(ctx context.Context, url string) (Verdict, error) {
+	if verdict := g.CheckBlocklist(url); verdict.Blocked {
+		return verdict, nil
+	}
+	verdict, err := g.Scanner.Scan(ctx, url)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("unable to scan url: %w", err)
+	}
+	return verdict, nil
+}
@@ -0,0 +1,56 @@
+package blocklist
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"townsag/url_shortener/api/db"
+)
+
+// Syncer loads the entries that were added through the admin api from postgres.
+// Edits are written to postgres by whichever instance receives them, every
+// instance picks them up on its next sync
+type Syncer struct {
+	pool      *pgxpool.Pool
+	blocklist *Blocklist
+	interval  time.Duration
+	logger    *slog.Logger
+}
+
+func NewSyncer(pool *pgxpool.Pool, blocklist *Blocklist, interval time.Duration, logger *slog.Logger) *Syncer {
+	return &Syncer{pool: pool, blocklist: blocklist, interval: interval, logger: logger}
+}
+
+// RunOnce replaces the stored entries of the blocklist with the entries in postgres
+func (s *Syncer) RunOnce(ctx context.Context) error {
+	entries, err := db.New(s.pool).ListBlocklistEntries(ctx)
+	if err != nil {
+		return err
+	}
+	if err = s.blocklist.Replace(entries); err != nil {
+		// entries are validated before they are stored, this only happens when
+		// the table was edited by hand
+		s.logger.Warn("skipped invalid stored blocklist entries", "error", err)
+	}
+	return nil
+}
+
+// Run calls RunOnce every interval until the context is done. The blocklist keeps
+// the entries of the last successful sync while postgres is unavailable
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("unable to load the stored blocklist entries", "error", err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.29.0
+// source: copyfrom.go
+
+package db
+
+import (
+	"context"
+)
+
+// iteratorForInsertClickEvents implements pgx.CopyFromSource.
+type iteratorForInsertClickEvents struct {
+	rows                 []InsertClickEventsParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForInsertClickEvents) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForInsertClickEvents) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].MappingID,
+		r.rows[0].OccurredAt,
+		r.rows[0].Referrer,
+		r.rows[0].UserAgent,
+		r.rows[0].IsBot,
+		r.rows[0].BotReason,
+	}, nil
+}
+
+func (r iteratorForInsertClickEvents) Err() error {
+	return nil
+}
+
+func (q *Queries) InsertClickEvents(ctx context.Context, arg []InsertClickEventsParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"click_events"}, []string{"mapping_id", "occurred_at", "referrer", "user_agent", "is_bot", "bot_reason"}, &iteratorForInsertClickEvents{rows: arg})
+}
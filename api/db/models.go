@@ -8,9 +8,64 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
-type UrlMapping struct {
-	ID        string
-	LongUrl   string
+type AuditEvent struct {
+	ID          int64
+	OccurredAt  pgtype.Timestamp
+	RequestID   string
+	Actor       string
+	ClientIp    string
+	Action      string
+	MappingID   string
+	BeforeValue []byte
+	AfterValue  []byte
+}
+
+type BlocklistEntry struct {
+	Entry     string
 	CreatedAt pgtype.Timestamp
-	Visits    pgtype.Int4
+}
+
+type ClickEvent struct {
+	ID         int64
+	MappingID  string
+	OccurredAt pgtype.Timestamp
+	Referrer   string
+	UserAgent  string
+	IsBot      bool
+	BotReason  string
+}
+
+type ClickRollupDaily struct {
+	MappingID    string
+	Bucket       pgtype.Timestamp
+	ReferrerHost string
+	DeviceClass  string
+	Clicks       int64
+}
+
+type ClickRollupHourly struct {
+	MappingID    string
+	Bucket       pgtype.Timestamp
+	ReferrerHost string
+	DeviceClass  string
+	Clicks       int64
+}
+
+type UrlMapping struct {
+	ID              string
+	LongUrl         string
+	CreatedAt       pgtype.Timestamp
+	Visits          pgtype.Int4
+	RedirectStatus  int32
+	ForwardQuery    bool
+	ForwardPath     bool
+	UtmQuery        string
+	PasswordHash    pgtype.Text
+	Title           string
+	Status          string
+	StatusCode      int32
+	StatusMessage   string
+	StatusChangedAt pgtype.Timestamp
+	CreatedBy       string
+	BotVisits       int32
 }
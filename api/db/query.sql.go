@@ -7,29 +7,708 @@ package db
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const countMappingsByStatus = `-- name: CountMappingsByStatus :many
+SELECT
+    status,
+    COUNT(*) AS mappings,
+    COALESCE(SUM(visits), 0)::BIGINT AS visits,
+    COALESCE(SUM(bot_visits), 0)::BIGINT AS bot_visits
+FROM url_mapping
+GROUP BY status
+`
+
+type CountMappingsByStatusRow struct {
+	Status    string
+	Mappings  int64
+	Visits    int64
+	BotVisits int64
+}
+
+func (q *Queries) CountMappingsByStatus(ctx context.Context) ([]CountMappingsByStatusRow, error) {
+	rows, err := q.db.Query(ctx, countMappingsByStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CountMappingsByStatusRow
+	for rows.Next() {
+		var i CountMappingsByStatusRow
+		if err := rows.Scan(
+			&i.Status,
+			&i.Mappings,
+			&i.Visits,
+			&i.BotVisits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const countMappingsCreatedLastDay = `-- name: CountMappingsCreatedLastDay :one
+SELECT COUNT(*) FROM url_mapping
+WHERE created_at >= NOW() - INTERVAL '24 hours'
+`
+
+func (q *Queries) CountMappingsCreatedLastDay(ctx context.Context) (int64, error) {
+	row := q.db.QueryRow(ctx, countMappingsCreatedLastDay)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const deleteBlocklistEntry = `-- name: DeleteBlocklistEntry :execrows
+DELETE FROM blocklist_entries
+WHERE entry = $1
+`
+
+func (q *Queries) DeleteBlocklistEntry(ctx context.Context, entry string) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteBlocklistEntry, entry)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteClickEventsBefore = `-- name: DeleteClickEventsBefore :execrows
+DELETE FROM click_events
+WHERE id IN (
+    SELECT old.id FROM click_events AS old
+    WHERE old.occurred_at < $1
+    LIMIT $2
+)
+`
+
+type DeleteClickEventsBeforeParams struct {
+	Cutoff  pgtype.Timestamp
+	MaxRows int32
+}
+
+func (q *Queries) DeleteClickEventsBefore(ctx context.Context, arg DeleteClickEventsBeforeParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteClickEventsBefore, arg.Cutoff, arg.MaxRows)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteMapping = `-- name: DeleteMapping :one
+DELETE FROM url_mapping
+WHERE id = $1
+RETURNING id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits
+`
+
+func (q *Queries) DeleteMapping(ctx context.Context, id string) (UrlMapping, error) {
+	row := q.db.QueryRow(ctx, deleteMapping, id)
+	var i UrlMapping
+	err := row.Scan(
+		&i.ID,
+		&i.LongUrl,
+		&i.CreatedAt,
+		&i.Visits,
+		&i.RedirectStatus,
+		&i.ForwardQuery,
+		&i.ForwardPath,
+		&i.UtmQuery,
+		&i.PasswordHash,
+		&i.Title,
+		&i.Status,
+		&i.StatusCode,
+		&i.StatusMessage,
+		&i.StatusChangedAt,
+		&i.CreatedBy,
+		&i.BotVisits,
+	)
+	return i, err
+}
+
+const importMapping = `-- name: ImportMapping :one
+INSERT INTO url_mapping (id, long_url, title, redirect_status, created_at, visits, created_by)
+VALUES ($1, $2, $3, $4, COALESCE($5::TIMESTAMP, NOW()), $6, $7)
+ON CONFLICT (id) DO NOTHING
+RETURNING id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits
+`
+
+type ImportMappingParams struct {
+	ID             string
+	LongUrl        string
+	Title          string
+	RedirectStatus int32
+	CreatedAt      pgtype.Timestamp
+	Visits         pgtype.Int4
+	CreatedBy      string
+}
+
+func (q *Queries) ImportMapping(ctx context.Context, arg ImportMappingParams) (UrlMapping, error) {
+	row := q.db.QueryRow(ctx, importMapping,
+		arg.ID,
+		arg.LongUrl,
+		arg.Title,
+		arg.RedirectStatus,
+		arg.CreatedAt,
+		arg.Visits,
+		arg.CreatedBy,
+	)
+	var i UrlMapping
+	err := row.Scan(
+		&i.ID,
+		&i.LongUrl,
+		&i.CreatedAt,
+		&i.Visits,
+		&i.RedirectStatus,
+		&i.ForwardQuery,
+		&i.ForwardPath,
+		&i.UtmQuery,
+		&i.PasswordHash,
+		&i.Title,
+		&i.Status,
+		&i.StatusCode,
+		&i.StatusMessage,
+		&i.StatusChangedAt,
+		&i.CreatedBy,
+		&i.BotVisits,
+	)
+	return i, err
+}
+
+const incrementVisits = `-- name: IncrementVisits :exec
+UPDATE url_mapping
+SET
+    visits = COALESCE(url_mapping.visits, 0) + clicks.visits,
+    bot_visits = url_mapping.bot_visits + clicks.bot_visits
+FROM (
+    SELECT
+        unnest($1::TEXT[]) AS id,
+        unnest($2::INTEGER[]) AS visits,
+        unnest($3::INTEGER[]) AS bot_visits
+) AS clicks
+WHERE url_mapping.id = clicks.id
+`
+
+type IncrementVisitsParams struct {
+	Ids       []string
+	Visits    []int32
+	BotVisits []int32
+}
+
+func (q *Queries) IncrementVisits(ctx context.Context, arg IncrementVisitsParams) error {
+	_, err := q.db.Exec(ctx, incrementVisits, arg.Ids, arg.Visits, arg.BotVisits)
+	return err
+}
+
+const insertAuditEvent = `-- name: InsertAuditEvent :exec
+INSERT INTO audit_events (request_id, actor, client_ip, action, mapping_id, before_value, after_value)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+type InsertAuditEventParams struct {
+	RequestID   string
+	Actor       string
+	ClientIp    string
+	Action      string
+	MappingID   string
+	BeforeValue []byte
+	AfterValue  []byte
+}
+
+func (q *Queries) InsertAuditEvent(ctx context.Context, arg InsertAuditEventParams) error {
+	_, err := q.db.Exec(ctx, insertAuditEvent,
+		arg.RequestID,
+		arg.Actor,
+		arg.ClientIp,
+		arg.Action,
+		arg.MappingID,
+		arg.BeforeValue,
+		arg.AfterValue,
+	)
+	return err
+}
+
+const insertBlocklistEntry = `-- name: InsertBlocklistEntry :exec
+INSERT INTO blocklist_entries (entry)
+VALUES ($1)
+ON CONFLICT (entry) DO NOTHING
+`
+
+func (q *Queries) InsertBlocklistEntry(ctx context.Context, entry string) error {
+	_, err := q.db.Exec(ctx, insertBlocklistEntry, entry)
+	return err
+}
+
+type InsertClickEventsParams struct {
+	MappingID  string
+	OccurredAt pgtype.Timestamp
+	Referrer   string
+	UserAgent  string
+	IsBot      bool
+	BotReason  string
+}
+
 const insertMapping = `-- name: InsertMapping :one
-INSERT INTO url_mapping (id, long_url)
-VALUES ($1, $2)
+INSERT INTO url_mapping (id, long_url, redirect_status, forward_query, forward_path, utm_query, password_hash, title, created_by)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 ON CONFLICT (id) DO NOTHING
-RETURNING id
+RETURNING id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits
 `
 
 type InsertMappingParams struct {
-	ID      string
-	LongUrl string
+	ID             string
+	LongUrl        string
+	RedirectStatus int32
+	ForwardQuery   bool
+	ForwardPath    bool
+	UtmQuery       string
+	PasswordHash   pgtype.Text
+	Title          string
+	CreatedBy      string
 }
 
-func (q *Queries) InsertMapping(ctx context.Context, arg InsertMappingParams) (string, error) {
-	row := q.db.QueryRow(ctx, insertMapping, arg.ID, arg.LongUrl)
-	var id string
-	err := row.Scan(&id)
-	return id, err
+func (q *Queries) InsertMapping(ctx context.Context, arg InsertMappingParams) (UrlMapping, error) {
+	row := q.db.QueryRow(ctx, insertMapping,
+		arg.ID,
+		arg.LongUrl,
+		arg.RedirectStatus,
+		arg.ForwardQuery,
+		arg.ForwardPath,
+		arg.UtmQuery,
+		arg.PasswordHash,
+		arg.Title,
+		arg.CreatedBy,
+	)
+	var i UrlMapping
+	err := row.Scan(
+		&i.ID,
+		&i.LongUrl,
+		&i.CreatedAt,
+		&i.Visits,
+		&i.RedirectStatus,
+		&i.ForwardQuery,
+		&i.ForwardPath,
+		&i.UtmQuery,
+		&i.PasswordHash,
+		&i.Title,
+		&i.Status,
+		&i.StatusCode,
+		&i.StatusMessage,
+		&i.StatusChangedAt,
+		&i.CreatedBy,
+		&i.BotVisits,
+	)
+	return i, err
+}
+
+const listAuditEvents = `-- name: ListAuditEvents :many
+SELECT id, occurred_at, request_id, actor, client_ip, action, mapping_id, before_value, after_value FROM audit_events
+WHERE ($1::TEXT IS NULL OR mapping_id = $1)
+    AND ($2::TEXT IS NULL OR actor = $2)
+    AND ($3::TEXT IS NULL OR action = $3)
+    AND ($4::TEXT IS NULL OR request_id = $4)
+    AND ($5::TIMESTAMP IS NULL OR occurred_at >= $5)
+    AND ($6::TIMESTAMP IS NULL OR occurred_at < $6)
+    AND ($7::BIGINT IS NULL OR id < $7)
+ORDER BY id DESC
+LIMIT $8
+`
+
+type ListAuditEventsParams struct {
+	MappingID pgtype.Text
+	Actor     pgtype.Text
+	Action    pgtype.Text
+	RequestID pgtype.Text
+	Since     pgtype.Timestamp
+	Until     pgtype.Timestamp
+	BeforeID  pgtype.Int8
+	MaxEvents int32
+}
+
+func (q *Queries) ListAuditEvents(ctx context.Context, arg ListAuditEventsParams) ([]AuditEvent, error) {
+	rows, err := q.db.Query(ctx, listAuditEvents,
+		arg.MappingID,
+		arg.Actor,
+		arg.Action,
+		arg.RequestID,
+		arg.Since,
+		arg.Until,
+		arg.BeforeID,
+		arg.MaxEvents,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AuditEvent
+	for rows.Next() {
+		var i AuditEvent
+		if err := rows.Scan(
+			&i.ID,
+			&i.OccurredAt,
+			&i.RequestID,
+			&i.Actor,
+			&i.ClientIp,
+			&i.Action,
+			&i.MappingID,
+			&i.BeforeValue,
+			&i.AfterValue,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listBlocklistEntries = `-- name: ListBlocklistEntries :many
+SELECT entry FROM blocklist_entries
+ORDER BY entry
+`
+
+func (q *Queries) ListBlocklistEntries(ctx context.Context) ([]string, error) {
+	rows, err := q.db.Query(ctx, listBlocklistEntries)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var entry string
+		if err := rows.Scan(&entry); err != nil {
+			return nil, err
+		}
+		items = append(items, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDailyClicks = `-- name: ListDailyClicks :many
+SELECT
+    bucket,
+    COALESCE(SUM(clicks) FILTER (WHERE device_class <> 'bot'), 0)::BIGINT AS clicks,
+    COALESCE(SUM(clicks) FILTER (WHERE device_class = 'bot'), 0)::BIGINT AS bot_clicks
+FROM click_rollup_daily
+WHERE mapping_id = $1 AND bucket >= $2 AND bucket < $3
+GROUP BY bucket
+ORDER BY bucket
+`
+
+type ListDailyClicksParams struct {
+	MappingID string
+	Since     pgtype.Timestamp
+	Until     pgtype.Timestamp
+}
+
+type ListDailyClicksRow struct {
+	Bucket    pgtype.Timestamp
+	Clicks    int64
+	BotClicks int64
+}
+
+func (q *Queries) ListDailyClicks(ctx context.Context, arg ListDailyClicksParams) ([]ListDailyClicksRow, error) {
+	rows, err := q.db.Query(ctx, listDailyClicks, arg.MappingID, arg.Since, arg.Until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDailyClicksRow
+	for rows.Next() {
+		var i ListDailyClicksRow
+		if err := rows.Scan(&i.Bucket, &i.Clicks, &i.BotClicks); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDailyClicksByDevice = `-- name: ListDailyClicksByDevice :many
+SELECT device_class, SUM(clicks)::BIGINT AS clicks
+FROM click_rollup_daily
+WHERE mapping_id = $1 AND bucket >= $2 AND bucket < $3
+GROUP BY device_class
+ORDER BY clicks DESC, device_class
+`
+
+type ListDailyClicksByDeviceParams struct {
+	MappingID string
+	Since     pgtype.Timestamp
+	Until     pgtype.Timestamp
+}
+
+type ListDailyClicksByDeviceRow struct {
+	DeviceClass string
+	Clicks      int64
+}
+
+func (q *Queries) ListDailyClicksByDevice(ctx context.Context, arg ListDailyClicksByDeviceParams) ([]ListDailyClicksByDeviceRow, error) {
+	rows, err := q.db.Query(ctx, listDailyClicksByDevice, arg.MappingID, arg.Since, arg.Until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDailyClicksByDeviceRow
+	for rows.Next() {
+		var i ListDailyClicksByDeviceRow
+		if err := rows.Scan(&i.DeviceClass, &i.Clicks); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDailyClicksByReferrer = `-- name: ListDailyClicksByReferrer :many
+SELECT referrer_host, SUM(clicks)::BIGINT AS clicks
+FROM click_rollup_daily
+WHERE mapping_id = $1 AND bucket >= $2 AND bucket < $3
+    AND device_class <> 'bot'
+GROUP BY referrer_host
+ORDER BY clicks DESC, referrer_host
+LIMIT $4
+`
+
+type ListDailyClicksByReferrerParams struct {
+	MappingID string
+	Since     pgtype.Timestamp
+	Until     pgtype.Timestamp
+	MaxRows   int32
+}
+
+type ListDailyClicksByReferrerRow struct {
+	ReferrerHost string
+	Clicks       int64
+}
+
+func (q *Queries) ListDailyClicksByReferrer(ctx context.Context, arg ListDailyClicksByReferrerParams) ([]ListDailyClicksByReferrerRow, error) {
+	rows, err := q.db.Query(ctx, listDailyClicksByReferrer,
+		arg.MappingID,
+		arg.Since,
+		arg.Until,
+		arg.MaxRows,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDailyClicksByReferrerRow
+	for rows.Next() {
+		var i ListDailyClicksByReferrerRow
+		if err := rows.Scan(&i.ReferrerHost, &i.Clicks); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listHourlyClicks = `-- name: ListHourlyClicks :many
+SELECT
+    bucket,
+    COALESCE(SUM(clicks) FILTER (WHERE device_class <> 'bot'), 0)::BIGINT AS clicks,
+    COALESCE(SUM(clicks) FILTER (WHERE device_class = 'bot'), 0)::BIGINT AS bot_clicks
+FROM click_rollup_hourly
+WHERE mapping_id = $1 AND bucket >= $2 AND bucket < $3
+GROUP BY bucket
+ORDER BY bucket
+`
+
+type ListHourlyClicksParams struct {
+	MappingID string
+	Since     pgtype.Timestamp
+	Until     pgtype.Timestamp
+}
+
+type ListHourlyClicksRow struct {
+	Bucket    pgtype.Timestamp
+	Clicks    int64
+	BotClicks int64
+}
+
+func (q *Queries) ListHourlyClicks(ctx context.Context, arg ListHourlyClicksParams) ([]ListHourlyClicksRow, error) {
+	rows, err := q.db.Query(ctx, listHourlyClicks, arg.MappingID, arg.Since, arg.Until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListHourlyClicksRow
+	for rows.Next() {
+		var i ListHourlyClicksRow
+		if err := rows.Scan(&i.Bucket, &i.Clicks, &i.BotClicks); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listInactiveMappings = `-- name: ListInactiveMappings :many
+SELECT id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits FROM url_mapping
+WHERE status <> 'active'
+ORDER BY status_changed_at DESC NULLS LAST
+LIMIT $1
+`
+
+func (q *Queries) ListInactiveMappings(ctx context.Context, limit int32) ([]UrlMapping, error) {
+	rows, err := q.db.Query(ctx, listInactiveMappings, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []UrlMapping
+	for rows.Next() {
+		var i UrlMapping
+		if err := rows.Scan(
+			&i.ID,
+			&i.LongUrl,
+			&i.CreatedAt,
+			&i.Visits,
+			&i.RedirectStatus,
+			&i.ForwardQuery,
+			&i.ForwardPath,
+			&i.UtmQuery,
+			&i.PasswordHash,
+			&i.Title,
+			&i.Status,
+			&i.StatusCode,
+			&i.StatusMessage,
+			&i.StatusChangedAt,
+			&i.CreatedBy,
+			&i.BotVisits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRecentMappings = `-- name: ListRecentMappings :many
+SELECT id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits FROM url_mapping
+ORDER BY created_at DESC
+LIMIT $1
+`
+
+func (q *Queries) ListRecentMappings(ctx context.Context, limit int32) ([]UrlMapping, error) {
+	rows, err := q.db.Query(ctx, listRecentMappings, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []UrlMapping
+	for rows.Next() {
+		var i UrlMapping
+		if err := rows.Scan(
+			&i.ID,
+			&i.LongUrl,
+			&i.CreatedAt,
+			&i.Visits,
+			&i.RedirectStatus,
+			&i.ForwardQuery,
+			&i.ForwardPath,
+			&i.UtmQuery,
+			&i.PasswordHash,
+			&i.Title,
+			&i.Status,
+			&i.StatusCode,
+			&i.StatusMessage,
+			&i.StatusChangedAt,
+			&i.CreatedBy,
+			&i.BotVisits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTopMappings = `-- name: ListTopMappings :many
+SELECT id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits FROM url_mapping
+ORDER BY visits DESC NULLS LAST, created_at DESC
+LIMIT $1
+`
+
+func (q *Queries) ListTopMappings(ctx context.Context, limit int32) ([]UrlMapping, error) {
+	rows, err := q.db.Query(ctx, listTopMappings, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []UrlMapping
+	for rows.Next() {
+		var i UrlMapping
+		if err := rows.Scan(
+			&i.ID,
+			&i.LongUrl,
+			&i.CreatedAt,
+			&i.Visits,
+			&i.RedirectStatus,
+			&i.ForwardQuery,
+			&i.ForwardPath,
+			&i.UtmQuery,
+			&i.PasswordHash,
+			&i.Title,
+			&i.Status,
+			&i.StatusCode,
+			&i.StatusMessage,
+			&i.StatusChangedAt,
+			&i.CreatedBy,
+			&i.BotVisits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const lockMappingsInOrder = `-- name: LockMappingsInOrder :exec
+SELECT id FROM url_mapping
+WHERE id = ANY($1::TEXT[])
+ORDER BY id
+FOR UPDATE
+`
+
+func (q *Queries) LockMappingsInOrder(ctx context.Context, ids []string) error {
+	_, err := q.db.Exec(ctx, lockMappingsInOrder, ids)
+	return err
 }
 
 const selectMapping = `-- name: SelectMapping :one
-SELECT id, long_url, created_at, visits FROM url_mapping
+SELECT id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits FROM url_mapping
 WHERE id = $1 LIMIT 1
 `
 
@@ -41,6 +720,165 @@ func (q *Queries) SelectMapping(ctx context.Context, id string) (UrlMapping, err
 		&i.LongUrl,
 		&i.CreatedAt,
 		&i.Visits,
+		&i.RedirectStatus,
+		&i.ForwardQuery,
+		&i.ForwardPath,
+		&i.UtmQuery,
+		&i.PasswordHash,
+		&i.Title,
+		&i.Status,
+		&i.StatusCode,
+		&i.StatusMessage,
+		&i.StatusChangedAt,
+		&i.CreatedBy,
+		&i.BotVisits,
 	)
 	return i, err
 }
+
+const selectMappingForUpdate = `-- name: SelectMappingForUpdate :one
+SELECT id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits FROM url_mapping
+WHERE id = $1
+FOR UPDATE
+`
+
+func (q *Queries) SelectMappingForUpdate(ctx context.Context, id string) (UrlMapping, error) {
+	row := q.db.QueryRow(ctx, selectMappingForUpdate, id)
+	var i UrlMapping
+	err := row.Scan(
+		&i.ID,
+		&i.LongUrl,
+		&i.CreatedAt,
+		&i.Visits,
+		&i.RedirectStatus,
+		&i.ForwardQuery,
+		&i.ForwardPath,
+		&i.UtmQuery,
+		&i.PasswordHash,
+		&i.Title,
+		&i.Status,
+		&i.StatusCode,
+		&i.StatusMessage,
+		&i.StatusChangedAt,
+		&i.CreatedBy,
+		&i.BotVisits,
+	)
+	return i, err
+}
+
+const selectPasswordHash = `-- name: SelectPasswordHash :one
+SELECT password_hash FROM url_mapping
+WHERE id = $1
+`
+
+func (q *Queries) SelectPasswordHash(ctx context.Context, id string) (pgtype.Text, error) {
+	row := q.db.QueryRow(ctx, selectPasswordHash, id)
+	var password_hash pgtype.Text
+	err := row.Scan(&password_hash)
+	return password_hash, err
+}
+
+const updateMappingStatus = `-- name: UpdateMappingStatus :one
+UPDATE url_mapping
+SET status = $2, status_code = $3, status_message = $4, status_changed_at = NOW()
+WHERE id = $1
+RETURNING id, long_url, created_at, visits, redirect_status, forward_query, forward_path, utm_query, password_hash, title, status, status_code, status_message, status_changed_at, created_by, bot_visits
+`
+
+type UpdateMappingStatusParams struct {
+	ID            string
+	Status        string
+	StatusCode    int32
+	StatusMessage string
+}
+
+func (q *Queries) UpdateMappingStatus(ctx context.Context, arg UpdateMappingStatusParams) (UrlMapping, error) {
+	row := q.db.QueryRow(ctx, updateMappingStatus,
+		arg.ID,
+		arg.Status,
+		arg.StatusCode,
+		arg.StatusMessage,
+	)
+	var i UrlMapping
+	err := row.Scan(
+		&i.ID,
+		&i.LongUrl,
+		&i.CreatedAt,
+		&i.Visits,
+		&i.RedirectStatus,
+		&i.ForwardQuery,
+		&i.ForwardPath,
+		&i.UtmQuery,
+		&i.PasswordHash,
+		&i.Title,
+		&i.Status,
+		&i.StatusCode,
+		&i.StatusMessage,
+		&i.StatusChangedAt,
+		&i.CreatedBy,
+		&i.BotVisits,
+	)
+	return i, err
+}
+
+const upsertDailyRollups = `-- name: UpsertDailyRollups :exec
+INSERT INTO click_rollup_daily (mapping_id, bucket, referrer_host, device_class, clicks)
+SELECT
+    unnest($1::TEXT[]),
+    unnest($2::TIMESTAMP[]),
+    unnest($3::TEXT[]),
+    unnest($4::TEXT[]),
+    unnest($5::BIGINT[])
+ON CONFLICT (mapping_id, bucket, referrer_host, device_class)
+DO UPDATE SET clicks = click_rollup_daily.clicks + EXCLUDED.clicks
+`
+
+type UpsertDailyRollupsParams struct {
+	MappingIds    []string
+	Buckets       []pgtype.Timestamp
+	ReferrerHosts []string
+	DeviceClasses []string
+	Clicks        []int64
+}
+
+func (q *Queries) UpsertDailyRollups(ctx context.Context, arg UpsertDailyRollupsParams) error {
+	_, err := q.db.Exec(ctx, upsertDailyRollups,
+		arg.MappingIds,
+		arg.Buckets,
+		arg.ReferrerHosts,
+		arg.DeviceClasses,
+		arg.Clicks,
+	)
+	return err
+}
+
+const upsertHourlyRollups = `-- name: UpsertHourlyRollups :exec
+INSERT INTO click_rollup_hourly (mapping_id, bucket, referrer_host, device_class, clicks)
+SELECT
+    unnest($1::TEXT[]),
+    unnest($2::TIMESTAMP[]),
+    unnest($3::TEXT[]),
+    unnest($4::TEXT[]),
+    unnest($5::BIGINT[])
+ON CONFLICT (mapping_id, bucket, referrer_host, device_class)
+DO UPDATE SET clicks = click_rollup_hourly.clicks + EXCLUDED.clicks
+`
+
+type UpsertHourlyRollupsParams struct {
+	MappingIds    []string
+	Buckets       []pgtype.Timestamp
+	ReferrerHosts []string
+	DeviceClasses []string
+	Clicks        []int64
+}
+
+func (q *Queries) UpsertHourlyRollups(ctx context.Context, arg UpsertHourlyRollupsParams) error {
+	_, err := q.db.Exec(ctx, upsertHourlyRollups,
+		arg.MappingIds,
+		arg.Buckets,
+		arg.ReferrerHosts,
+		arg.DeviceClasses,
+		arg.Clicks,
+	)
+	return err
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"townsag/url_shortener/api/blocklist"
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
+)
+
+type blocklistEntryRequestBody struct {
+	Entry string `json:"entry"`
+}
+
+type blocklistResponseBody struct {
+	Msg     string   `json:"message"`
+	Status  int      `json:"status"`
+	Entries []string `json:"entries"`
+}
+
+func listBlocklistHandlerFactory(b *blocklist.Blocklist) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&blocklistResponseBody{
+			Msg:     "successfully listed blocklist entries",
+			Status:  http.StatusOK,
+			Entries: b.Entries(),
+		})
+	}
+}
+
+// edits to the blocklist are stored in postgres and applied to the instance that
+// received the request right away, the other instances apply them on their next
+// sync, see blocklist.Syncer
+func addBlocklistEntryHandlerFactory(pool *pgxpool.Pool, b *blocklist.Blocklist) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		var body blocklistEntryRequestBody
+		err := util.DecodeJSONBody(w, r, &body)
+		if err != nil {
+			var problem *util.Problem
+			if errors.As(err, &problem) {
+				util.WriteProblem(w, problem)
+			} else {
+				logger.Error("server error encountered when decoding request body", "error", err)
+				writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			}
+			return
+		}
+		entry, err := blocklist.NormalizeEntry(body.Entry)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the add blocklist entry handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		if err = db.New(conn).InsertBlocklistEntry(r.Context(), entry); err != nil {
+			logger.Error("database error encountered when storing blocklist entry", "error", err, "entry", entry)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		b.Add(entry)
+		logger.Info("added blocklist entry", "entry", entry)
+		writeMessageResponse(w, http.StatusCreated, fmt.Sprintf("added blocklist entry %s", entry))
+	}
+}
+
+func removeBlocklistEntryHandlerFactory(pool *pgxpool.Pool, b *blocklist.Blocklist) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		// url entries contain slashes so the entry is passed as a query parameter
+		// instead of a path segment
+		entry := r.URL.Query().Get("entry")
+		normalized, err := blocklist.NormalizeEntry(entry)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if b.FromFile(normalized) {
+			writeProblem(
+				w,
+				http.StatusConflict,
+				fmt.Sprintf("%s is loaded from the blocklist file and can only be removed from the file", normalized),
+			)
+			return
+		}
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the remove blocklist entry handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		deleted, err := db.New(conn).DeleteBlocklistEntry(r.Context(), normalized)
+		if err != nil {
+			logger.Error("database error encountered when deleting blocklist entry", "error", err, "entry", normalized)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		// the entry may have been added by another instance that this instance
+		// has not synced with yet, or removed by one that it has not synced with
+		removed, _ := b.Remove(normalized)
+		if deleted == 0 && !removed {
+			writeProblem(w, http.StatusNotFound, fmt.Sprintf("blocklist does not contain %s", entry))
+			return
+		}
+		logger.Info("removed blocklist entry", "entry", entry)
+		writeMessageResponse(w, http.StatusOK, fmt.Sprintf("removed blocklist entry %s", entry))
+	}
+}
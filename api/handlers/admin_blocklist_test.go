@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"townsag/url_shortener/api/blocklist"
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/middleware"
+)
+
+func newBlocklistTestMux(pool *pgxpool.Pool, b *blocklist.Blocklist) *http.ServeMux {
+	admin := func(next http.Handler) http.Handler {
+		return middleware.AdminAuthMiddleware("test-token", next)
+	}
+	testMux := http.NewServeMux()
+	testMux.Handle("GET /api/admin/blocklist", admin(listBlocklistHandlerFactory(b)))
+	testMux.Handle("POST /api/admin/blocklist", admin(addBlocklistEntryHandlerFactory(pool, b)))
+	testMux.Handle("DELETE /api/admin/blocklist", admin(removeBlocklistEntryHandlerFactory(pool, b)))
+	return testMux
+}
+
+func TestAdminBlocklistRequiresToken(t *testing.T) {
+	testMux := newBlocklistTestMux(nil, blocklist.New())
+	req := httptest.NewRequest("GET", "/api/admin/blocklist", nil)
+	req.Header.Set("Authorization", "Bearer wrong-token")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("admin route returned incorrect status code: expected: %d, received: %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestAdminBlocklistAddListRemove(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocklist.New()
+	testMux := newBlocklistTestMux(pool, b)
+	send := func(method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send("POST", "/api/admin/blocklist", `{"entry": "*.Phish.net"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("add entry returned incorrect status code: expected: %d, received: %d", http.StatusCreated, rr.Code)
+	}
+	if rr := send("POST", "/api/admin/blocklist", `{"entry": "not a domain/"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("add invalid entry returned incorrect status code: expected: %d, received: %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr := send("GET", "/api/admin/blocklist", "")
+	var responseBody blocklistResponseBody
+	if err := json.NewDecoder(rr.Body).Decode(&responseBody); err != nil {
+		t.Fatalf("failed to decode list blocklist response body with %v", err)
+	}
+	if !slices.Equal(responseBody.Entries, []string{"*.phish.net"}) {
+		t.Fatalf("list blocklist returned the wrong entries: %v", responseBody.Entries)
+	}
+
+	// other instances load the entry from postgres
+	other := blocklist.New()
+	if err = blocklist.NewSyncer(pool, other, 0, middleware.BuildLogger()).RunOnce(context.Background()); err != nil {
+		t.Fatalf("failed to sync the stored blocklist entries: %v", err)
+	}
+	if _, blocked := other.Match("https://a.phish.net"); !blocked {
+		t.Fatal("stored blocklist entry was not applied to another instance")
+	}
+
+	if rr := send("DELETE", "/api/admin/blocklist?entry=*.phish.net", ""); rr.Code != http.StatusOK {
+		t.Fatalf("remove entry returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	if rr := send("DELETE", "/api/admin/blocklist?entry=*.phish.net", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("remove missing entry returned incorrect status code: expected: %d, received: %d", http.StatusNotFound, rr.Code)
+	}
+	if entries, err := db.New(pool).ListBlocklistEntries(context.Background()); err != nil || len(entries) != 0 {
+		t.Fatalf("removed entry is still stored: %v, error: %v", entries, err)
+	}
+}
+
+func TestBlockedDestination(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	createMapping := func(longUrl string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "`+longUrl+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	testGuard.Blocklist.Add("blocked-at-creation.example")
+	if rr := createMapping("https://blocked-at-creation.example/login"); rr.Code != http.StatusForbidden {
+		t.Fatalf("create mapping for a blocked url returned incorrect status code: expected: %d, received: %d", http.StatusForbidden, rr.Code)
+	}
+
+	// a destination that is blocked after the mapping was created stops redirecting
+	rr := createMapping("https://blocked-later.example")
+	var responseBody createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&responseBody); err != nil || responseBody.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	testGuard.Blocklist.Add("blocked-later.example")
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/"+*responseBody.ShortUrl, nil))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("redirect to a blocked url returned incorrect status code: expected: %d, received: %d", http.StatusForbidden, rr.Code)
+	}
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+
+	"townsag/url_shortener/api/analytics"
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
+)
+
+const (
+	CLICK_GRANULARITY_HOUR string = "hour"
+	CLICK_GRANULARITY_DAY  string = "day"
+)
+
+// MAX_CLICK_BUCKETS bounds the length of the time series, it allows a month of
+// hourly buckets or about two years of daily buckets
+const MAX_CLICK_BUCKETS int = 744
+const MAX_CLICK_REFERRERS int32 = 20
+
+// clickBucket counts human clicks and bot clicks separately. UniqueVisitors is an
+// estimate that is only reported for daily buckets because visitor ids change
+// every day, and only for days whose estimate has not expired
+type clickBucket struct {
+	Bucket         time.Time `json:"bucket"`
+	Clicks         int64     `json:"clicks"`
+	BotClicks      int64     `json:"botClicks"`
+	UniqueVisitors *int64    `json:"uniqueVisitors,omitempty"`
+}
+
+// referrerClicks only counts human clicks
+type referrerClicks struct {
+	// Host is empty for clicks without a referrer
+	Host   string `json:"host"`
+	Clicks int64  `json:"clicks"`
+}
+
+// deviceClicks includes the bot device class for clicks from bots
+type deviceClicks struct {
+	DeviceClass string `json:"deviceClass"`
+	Clicks      int64  `json:"clicks"`
+}
+
+type mappingClicksResponseBody struct {
+	Msg         string           `json:"message"`
+	Status      int              `json:"status"`
+	ShortUrlId  string           `json:"shortUrlId"`
+	Granularity string           `json:"granularity"`
+	Since       time.Time        `json:"since"`
+	Until       time.Time        `json:"until"`
+	Series      []clickBucket    `json:"series"`
+	Referrers   []referrerClicks `json:"referrers"`
+	Devices     []deviceClicks   `json:"devices"`
+}
+
+// clickRange is the time range of a clicks request, since is inclusive and until
+// is exclusive. Both are aligned to the buckets of the granularity
+type clickRange struct {
+	granularity string
+	since       time.Time
+	until       time.Time
+}
+
+func parseClickRange(query url.Values, now time.Time) (*clickRange, error) {
+	r := &clickRange{granularity: query.Get("granularity")}
+	if r.granularity == "" {
+		r.granularity = CLICK_GRANULARITY_DAY
+	}
+	var bucket func(time.Time) time.Time
+	var step time.Duration
+	switch r.granularity {
+	case CLICK_GRANULARITY_HOUR:
+		bucket, step = analytics.HourBucket, time.Hour
+	case CLICK_GRANULARITY_DAY:
+		bucket, step = analytics.DayBucket, 24*time.Hour
+	default:
+		return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("invalid granularity: %q, must be %s or %s", r.granularity, CLICK_GRANULARITY_HOUR, CLICK_GRANULARITY_DAY)).WithField("granularity")
+	}
+	parse := func(name string, defaultValue time.Time) (time.Time, error) {
+		raw := query.Get(name)
+		if raw == "" {
+			return defaultValue, nil
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp", name)).WithField(name)
+		}
+		return t, nil
+	}
+	// until is rounded up so that the bucket that contains it is included
+	until, err := parse("until", now)
+	if err != nil {
+		return nil, err
+	}
+	r.until = bucket(until.Add(step - time.Nanosecond))
+	since, err := parse("since", r.until.Add(-30*step))
+	if err != nil {
+		return nil, err
+	}
+	r.since = bucket(since)
+	if !r.since.Before(r.until) {
+		return nil, util.NewProblem(http.StatusBadRequest, "since must be before until").WithField("since")
+	}
+	if r.until.Sub(r.since) > time.Duration(MAX_CLICK_BUCKETS)*step {
+		return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("the range must not contain more than %d buckets", MAX_CLICK_BUCKETS))
+	}
+	return r, nil
+}
+
+func listClickSeries(ctx context.Context, queries *db.Queries, shortUrlId string, r *clickRange) ([]clickBucket, error) {
+	since := pgtype.Timestamp{Time: r.since, Valid: true}
+	until := pgtype.Timestamp{Time: r.until, Valid: true}
+	series := []clickBucket{}
+	if r.granularity == CLICK_GRANULARITY_HOUR {
+		rows, err := queries.ListHourlyClicks(ctx, db.ListHourlyClicksParams{MappingID: shortUrlId, Since: since, Until: until})
+		for _, row := range rows {
+			series = append(series, clickBucket{Bucket: row.Bucket.Time, Clicks: row.Clicks, BotClicks: row.BotClicks})
+		}
+		return series, err
+	}
+	rows, err := queries.ListDailyClicks(ctx, db.ListDailyClicksParams{MappingID: shortUrlId, Since: since, Until: until})
+	for _, row := range rows {
+		series = append(series, clickBucket{Bucket: row.Bucket.Time, Clicks: row.Clicks, BotClicks: row.BotClicks})
+	}
+	return series, err
+}
+
+// mappingClicksHandlerFactory reports the clicks of a mapping from the rollup
+// tables. The referrer and device breakdowns always come from the daily rollups,
+// for hourly requests they cover the whole days that overlap the range
+func mappingClicksHandlerFactory(pool *pgxpool.Pool, rdb *redis.Client) http.HandlerFunc {
+	visitors := &analytics.UniqueVisitors{Client: rdb}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		shortUrlId := r.PathValue("shortUrlId")
+		if !isValidShortUrlId(shortUrlId) {
+			writeInvalidShortUrlId(w, shortUrlId)
+			return
+		}
+		clicks, err := parseClickRange(r.URL.Query(), time.Now())
+		if err != nil {
+			var problem *util.Problem
+			errors.As(err, &problem)
+			util.WriteProblem(w, problem)
+			return
+		}
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the clicks handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		queries := db.New(conn)
+
+		response := mappingClicksResponseBody{
+			Msg:         "successfully collected clicks",
+			Status:      http.StatusOK,
+			ShortUrlId:  shortUrlId,
+			Granularity: clicks.granularity,
+			Since:       clicks.since,
+			Until:       clicks.until,
+			Referrers:   []referrerClicks{},
+			Devices:     []deviceClicks{},
+		}
+		response.Series, err = listClickSeries(r.Context(), queries, shortUrlId, clicks)
+		if err != nil {
+			logger.Error("database error encountered when listing clicks", "error", err, "shortUrl", shortUrlId)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if clicks.granularity == CLICK_GRANULARITY_DAY {
+			// days whose estimate has expired are left out rather than reported
+			// as 0 unique visitors
+			now := time.Now()
+			days := make([]time.Time, 0, len(response.Series))
+			indexes := make([]int, 0, len(response.Series))
+			for i, bucket := range response.Series {
+				if analytics.UniqueVisitorsRetained(bucket.Bucket, now) {
+					days = append(days, bucket.Bucket)
+					indexes = append(indexes, i)
+				}
+			}
+			// the clicks are still reported when the estimates are unavailable
+			if len(days) > 0 {
+				estimates, err := visitors.Estimate(r.Context(), shortUrlId, days)
+				if err != nil {
+					logger.Warn("unable to estimate unique visitors", "error", err, "shortUrl", shortUrlId)
+				} else {
+					for j, i := range indexes {
+						response.Series[i].UniqueVisitors = &estimates[j]
+					}
+				}
+			}
+		}
+		since := pgtype.Timestamp{Time: analytics.DayBucket(clicks.since), Valid: true}
+		until := pgtype.Timestamp{Time: analytics.DayBucket(clicks.until.Add(24*time.Hour - time.Nanosecond)), Valid: true}
+		referrers, err := queries.ListDailyClicksByReferrer(r.Context(), db.ListDailyClicksByReferrerParams{
+			MappingID: shortUrlId,
+			Since:     since,
+			Until:     until,
+			MaxRows:   MAX_CLICK_REFERRERS,
+		})
+		if err != nil {
+			logger.Error("database error encountered when listing clicks by referrer", "error", err, "shortUrl", shortUrlId)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		for _, row := range referrers {
+			response.Referrers = append(response.Referrers, referrerClicks{Host: row.ReferrerHost, Clicks: row.Clicks})
+		}
+		devices, err := queries.ListDailyClicksByDevice(r.Context(), db.ListDailyClicksByDeviceParams{
+			MappingID: shortUrlId,
+			Since:     since,
+			Until:     until,
+		})
+		if err != nil {
+			logger.Error("database error encountered when listing clicks by device", "error", err, "shortUrl", shortUrlId)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		for _, row := range devices {
+			response.Devices = append(response.Devices, deviceClicks{DeviceClass: row.DeviceClass, Clicks: row.Clicks})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&response)
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"townsag/url_shortener/api/analytics"
+)
+
+func TestParseClickRange(t *testing.T) {
+	now := time.Date(2025, 3, 2, 7, 30, 0, 0, time.UTC)
+	r, err := parseClickRange(url.Values{}, now)
+	if err != nil {
+		t.Fatalf("parsing the default range failed with %v", err)
+	}
+	// the default range ends with the day that contains now
+	if r.granularity != CLICK_GRANULARITY_DAY || !r.until.Equal(time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("default range is %+v", r)
+	}
+	if r.until.Sub(r.since) != 30*24*time.Hour {
+		t.Errorf("default range does not cover 30 days: %+v", r)
+	}
+
+	r, err = parseClickRange(url.Values{
+		"granularity": {"hour"},
+		"since":       {"2025-03-01T10:15:00Z"},
+		"until":       {"2025-03-01T12:00:00Z"},
+	}, now)
+	if err != nil {
+		t.Fatalf("parsing an hourly range failed with %v", err)
+	}
+	if !r.since.Equal(time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)) || !r.until.Equal(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("hourly range was not aligned to hours: %+v", r)
+	}
+
+	for _, query := range []url.Values{
+		{"granularity": {"minute"}},
+		{"since": {"last week"}},
+		{"since": {"2025-03-05T00:00:00Z"}},
+		{"granularity": {"hour"}, "since": {"2024-01-01T00:00:00Z"}},
+	} {
+		if _, err := parseClickRange(query, now); err == nil {
+			t.Errorf("invalid range %v was accepted", query)
+		}
+	}
+}
+
+func TestRollupsOutliveRawClickEvents(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.HandleFunc("GET /api/admin/mapping/{shortUrlId}/clicks", mappingClicksHandlerFactory(pool, rdb))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com/rollups"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	shortUrlId := *created.ShortUrl
+
+	// two clicks from two months ago and one click from a bot now
+	old := time.Now().UTC().Add(-60 * 24 * time.Hour)
+	mobile := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) Mobile/15E148"
+	store := &analytics.PostgresStore{Pool: pool}
+	err = store.WriteClicks(context.Background(), []analytics.ClickEvent{
+		{ShortUrlId: shortUrlId, OccurredAt: old, Referrer: "https://news.example.com/a", UserAgent: mobile},
+		{ShortUrlId: shortUrlId, OccurredAt: old, Referrer: "https://news.example.com/b", UserAgent: mobile},
+		{ShortUrlId: shortUrlId, OccurredAt: time.Now().UTC(), Bot: true},
+	})
+	if err != nil {
+		t.Fatalf("failed to write click events with %v", err)
+	}
+	job, err := analytics.NewRetentionJob(pool, 30*24*time.Hour, time.Hour, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = job.RunOnce(context.Background()); err != nil {
+		t.Fatalf("retention job failed with %v", err)
+	}
+	var remaining int
+	err = pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM click_events WHERE mapping_id = $1", shortUrlId).Scan(&remaining)
+	if err != nil {
+		t.Fatalf("failed to count click events with %v", err)
+	}
+	if remaining != 1 {
+		t.Errorf("%d raw click events remain after the retention job, expected 1", remaining)
+	}
+
+	since := old.Add(-24 * time.Hour).Format(time.RFC3339)
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/mapping/"+shortUrlId+"/clicks?since="+since, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("clicks returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	var response mappingClicksResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode clicks response body with %v", err)
+	}
+	if len(response.Series) != 2 || response.Series[0].Clicks != 2 || response.Series[1].BotClicks != 1 || response.Series[1].Clicks != 0 {
+		t.Errorf("series does not contain the expired and the recent clicks: %+v", response.Series)
+	}
+	if len(response.Referrers) == 0 || response.Referrers[0].Host != "news.example.com" || response.Referrers[0].Clicks != 2 {
+		t.Errorf("referrers do not start with news.example.com: %+v", response.Referrers)
+	}
+	if len(response.Devices) == 0 || response.Devices[0].DeviceClass != analytics.DeviceMobile {
+		t.Errorf("devices do not start with mobile: %+v", response.Devices)
+	}
+}
+
+func TestUniqueVisitorsAreEstimatedPerDay(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &analytics.PostgresStore{Pool: pool, Visitors: &analytics.UniqueVisitors{Client: rdb}}
+	pipeline, err := analytics.NewPipeline(store, analytics.DefaultConfig(), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clicks := analytics.NewVisitorRecorder(pipeline, analytics.NewVisitorHasher(rdb), slog.Default())
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, clicks))
+	testMux.HandleFunc("GET /api/admin/mapping/{shortUrlId}/clicks", mappingClicksHandlerFactory(pool, rdb))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com/visitors"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	shortUrlId := *created.ShortUrl
+
+	// three clicks from one visitor, one click from another and one from a bot
+	for _, address := range []string{"192.0.2.1:4000", "192.0.2.1:4001", "192.0.2.1:4002", "192.0.2.2:4000"} {
+		req := newBrowserRequest("GET", "/api/"+shortUrlId)
+		req.RemoteAddr = address
+		testMux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req = httptest.NewRequest("GET", "/api/"+shortUrlId, nil)
+	req.Header.Set("User-Agent", "Googlebot/2.1 (+http://www.google.com/bot.html)")
+	testMux.ServeHTTP(httptest.NewRecorder(), req)
+	if err = pipeline.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to flush click events with %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/mapping/"+shortUrlId+"/clicks", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("clicks returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	var response mappingClicksResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode clicks response body with %v", err)
+	}
+	if len(response.Series) != 1 || response.Series[0].Clicks != 4 {
+		t.Fatalf("series does not contain the clicks of today: %+v", response.Series)
+	}
+	if unique := response.Series[0].UniqueVisitors; unique == nil || *unique != 2 {
+		t.Errorf("unique visitors of today are %v, expected 2", unique)
+	}
+}
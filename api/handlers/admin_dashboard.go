@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+
+	"townsag/url_shortener/api/blocklist"
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/middleware"
+)
+
+const DEFAULT_ADMIN_LIST_LIMIT int = 10
+const MAX_ADMIN_LIST_LIMIT int = 100
+
+type mappingCounts struct {
+	Total       int64 `json:"total"`
+	Active      int64 `json:"active"`
+	Disabled    int64 `json:"disabled"`
+	Quarantined int64 `json:"quarantined"`
+}
+
+type cacheStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+// adminStatsResponseBody reports human visits in TotalVisits and visits from bots
+// in TotalBotVisits
+type adminStatsResponseBody struct {
+	Msg                string        `json:"message"`
+	Status             int           `json:"status"`
+	Mappings           mappingCounts `json:"mappings"`
+	TotalVisits        int64         `json:"totalVisits"`
+	TotalBotVisits     int64         `json:"totalBotVisits"`
+	CreatedLast24Hours int64         `json:"createdLast24Hours"`
+	BlocklistEntries   int           `json:"blocklistEntries"`
+	// Cache is omitted when redis could not be reached
+	Cache *cacheStats `json:"cache,omitempty"`
+}
+
+// linkSummary is the view of a mapping that is shown to admins, it never includes
+// the password hash
+type linkSummary struct {
+	ShortUrlId        string     `json:"shortUrlId"`
+	LongUrl           string     `json:"longUrl"`
+	Title             string     `json:"title"`
+	CreatedAt         time.Time  `json:"createdAt"`
+	Visits            int32      `json:"visits"`
+	BotVisits         int32      `json:"botVisits"`
+	RedirectStatus    int32      `json:"redirectStatus"`
+	PasswordProtected bool       `json:"passwordProtected"`
+	LinkStatus        string     `json:"linkStatus"`
+	StatusChangedAt   *time.Time `json:"statusChangedAt,omitempty"`
+}
+
+type adminLinksResponseBody struct {
+	Msg    string        `json:"message"`
+	Status int           `json:"status"`
+	Links  []linkSummary `json:"links"`
+}
+
+func linkSummaryFromRecord(record db.UrlMapping) linkSummary {
+	summary := linkSummary{
+		ShortUrlId:        record.ID,
+		LongUrl:           record.LongUrl,
+		Title:             record.Title,
+		CreatedAt:         record.CreatedAt.Time,
+		Visits:            record.Visits.Int32,
+		BotVisits:         record.BotVisits,
+		RedirectStatus:    record.RedirectStatus,
+		PasswordProtected: record.PasswordHash.Valid,
+		LinkStatus:        record.Status,
+	}
+	if record.StatusChangedAt.Valid {
+		summary.StatusChangedAt = &record.StatusChangedAt.Time
+	}
+	return summary
+}
+
+// readCacheStats reads the hit and miss counters of the mapping cache, see
+// lookupCachedMapping. They cover every instance of the service since the
+// counters were created
+func readCacheStats(ctx context.Context, rdb *redis.Client) (*cacheStats, error) {
+	values, err := rdb.MGet(ctx, CACHE_HITS_KEY, CACHE_MISSES_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	stats := &cacheStats{}
+	for i, target := range []*int64{&stats.Hits, &stats.Misses} {
+		// a counter that was never incremented does not exist
+		value, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		if *target, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("unable to parse the cache lookup counter: %w", err)
+		}
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats, nil
+}
+
+func adminStatsHandlerFactory(pool *pgxpool.Pool, rdb *redis.Client, b *blocklist.Blocklist) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the admin stats handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		queries := db.New(conn)
+
+		response := adminStatsResponseBody{
+			Msg:              "successfully collected stats",
+			Status:           http.StatusOK,
+			BlocklistEntries: len(b.Entries()),
+		}
+		rows, err := queries.CountMappingsByStatus(r.Context())
+		if err != nil {
+			logger.Error("database error encountered when counting mappings", "error", err)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		for _, row := range rows {
+			response.Mappings.Total += row.Mappings
+			response.TotalVisits += row.Visits
+			response.TotalBotVisits += row.BotVisits
+			switch row.Status {
+			case MAPPING_STATUS_ACTIVE:
+				response.Mappings.Active = row.Mappings
+			case MAPPING_STATUS_DISABLED:
+				response.Mappings.Disabled = row.Mappings
+			case MAPPING_STATUS_QUARANTINED:
+				response.Mappings.Quarantined = row.Mappings
+			}
+		}
+		// created_at is stored without a time zone using the clock of the database
+		// so the window is computed by the database as well
+		response.CreatedLast24Hours, err = queries.CountMappingsCreatedLastDay(r.Context())
+		if err != nil {
+			logger.Error("database error encountered when counting recent mappings", "error", err)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		response.Cache, err = readCacheStats(r.Context(), rdb)
+		if err != nil {
+			logger.Warn("unable to read cache stats from redis", "error", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&response)
+	}
+}
+
+// listMappingsFunc selects the mappings shown by one of the admin link lists
+type listMappingsFunc func(ctx context.Context, queries *db.Queries, limit int32) ([]db.UrlMapping, error)
+
+func listTopMappings(ctx context.Context, queries *db.Queries, limit int32) ([]db.UrlMapping, error) {
+	return queries.ListTopMappings(ctx, limit)
+}
+
+func listRecentMappings(ctx context.Context, queries *db.Queries, limit int32) ([]db.UrlMapping, error) {
+	return queries.ListRecentMappings(ctx, limit)
+}
+
+func listInactiveMappings(ctx context.Context, queries *db.Queries, limit int32) ([]db.UrlMapping, error) {
+	return queries.ListInactiveMappings(ctx, limit)
+}
+
+func parseListLimit(r *http.Request) (int32, error) {
+	raw := r.URL.Query().Get("limit")
+	if raw == "" {
+		return int32(DEFAULT_ADMIN_LIST_LIMIT), nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > MAX_ADMIN_LIST_LIMIT {
+		return 0, fmt.Errorf("limit must be an integer between 1 and %d", MAX_ADMIN_LIST_LIMIT)
+	}
+	return int32(limit), nil
+}
+
+func adminListMappingsHandlerFactory(pool *pgxpool.Pool, list listMappingsFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		limit, err := parseListLimit(r)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the admin list handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		records, err := list(r.Context(), db.New(conn), limit)
+		if err != nil {
+			logger.Error("database error encountered when listing mappings", "error", err)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		links := make([]linkSummary, 0, len(records))
+		for _, record := range records {
+			links = append(links, linkSummaryFromRecord(record))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&adminLinksResponseBody{
+			Msg:    "successfully listed links",
+			Status: http.StatusOK,
+			Links:  links,
+		})
+	}
+}
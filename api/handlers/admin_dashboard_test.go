@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminListLimitValidation(t *testing.T) {
+	// the limit is validated before the database is used so no containers are needed
+	handler := adminListMappingsHandlerFactory(nil, listRecentMappings)
+	for _, limit := range []string{"0", "abc", "101"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/links/recent?limit="+limit, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("limit %s returned incorrect status code: expected: %d, received: %d", limit, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestAdminStatsAndRecentLinks(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.HandleFunc("GET /api/admin/stats", adminStatsHandlerFactory(pool, rdb, testGuard.Blocklist))
+	testMux.HandleFunc("GET /api/admin/links/recent", adminListMappingsHandlerFactory(pool, listRecentMappings))
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://example.com/dashboard", "password": "hunter22"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	before, err := readCacheStats(context.Background(), rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first access misses the cache and the second one hits it
+	for range 2 {
+		testMux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/"+*created.ShortUrl, nil))
+	}
+
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/stats", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("admin stats returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	var stats adminStatsResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode admin stats response body with %v", err)
+	}
+	if stats.Mappings.Total < 1 || stats.CreatedLast24Hours < 1 {
+		t.Fatalf("admin stats did not count the new mapping: %+v", stats)
+	}
+	if stats.Cache == nil {
+		t.Fatal("admin stats did not include cache stats")
+	}
+	if stats.Cache.Hits != before.Hits+1 || stats.Cache.Misses != before.Misses+1 {
+		t.Fatalf("admin stats did not count the mapping lookups: before: %+v, after: %+v", before, stats.Cache)
+	}
+
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/links/recent?limit=1", nil))
+	var recent adminLinksResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&recent); err != nil {
+		t.Fatalf("failed to decode recent links response body with %v", err)
+	}
+	if len(recent.Links) != 1 || recent.Links[0].ShortUrlId != *created.ShortUrl {
+		t.Fatalf("recent links did not return the newest mapping: %+v", recent.Links)
+	}
+	if !recent.Links[0].PasswordProtected {
+		t.Fatal("recent links did not report the mapping as password protected")
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
+)
+
+type logLevelRequestBody struct {
+	Level string `json:"level"`
+}
+
+type logLevelResponseBody struct {
+	Msg    string `json:"message"`
+	Status int    `json:"status"`
+	Level  string `json:"level"`
+}
+
+func writeLogLevelResponse(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&logLevelResponseBody{
+		Msg:    msg,
+		Status: status,
+		Level:  middleware.LogLevel().Level().String(),
+	})
+}
+
+func getLogLevelHandlerFactory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeLogLevelResponse(w, http.StatusOK, "successfully read the log level")
+	}
+}
+
+// the level only changes on the instance that received the request and is reset
+// to LOG_LEVEL on restart
+func updateLogLevelHandlerFactory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		var body logLevelRequestBody
+		err := util.DecodeJSONBody(w, r, &body)
+		if err != nil {
+			var problem *util.Problem
+			if errors.As(err, &problem) {
+				util.WriteProblem(w, problem)
+			} else {
+				logger.Error("server error encountered when decoding request body", "error", err)
+				writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			}
+			return
+		}
+		var level slog.Level
+		if err = level.UnmarshalText([]byte(body.Level)); err != nil {
+			util.WriteProblem(w, util.NewProblem(
+				http.StatusBadRequest,
+				fmt.Sprintf("invalid level: %q, must be debug, info, warn or error", body.Level),
+			).WithField("level"))
+			return
+		}
+		previous := middleware.LogLevel().Level()
+		middleware.LogLevel().Set(level)
+		// logged at warn so that the change is visible at every level
+		logger.Warn("changed the log level", "previous", previous.String(), "level", level.String())
+		writeLogLevelResponse(w, http.StatusOK, fmt.Sprintf("changed the log level from %s to %s", previous, level))
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"townsag/url_shortener/api/middleware"
+)
+
+func TestUpdateLogLevel(t *testing.T) {
+	defer middleware.LogLevel().Set(middleware.LogLevel().Level())
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("PUT /api/admin/log-level", updateLogLevelHandlerFactory())
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/admin/log-level", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(`{"level": "debug"}`)
+	var response logLevelResponseBody
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode the response with %v", err)
+	}
+	if rr.Code != http.StatusOK || response.Level != "DEBUG" || middleware.LogLevel().Level() != slog.LevelDebug {
+		t.Errorf("changing the level to debug returned %d with level %s", rr.Code, response.Level)
+	}
+	if rr = send(`{"level": "verbose"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid level returned incorrect status code: expected: %d, received: %d", http.StatusBadRequest, rr.Code)
+	}
+	if middleware.LogLevel().Level() != slog.LevelDebug {
+		t.Errorf("an invalid level changed the log level to %s", middleware.LogLevel().Level())
+	}
+}
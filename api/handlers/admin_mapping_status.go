@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
+)
+
+const (
+	MAPPING_STATUS_ACTIVE      string = "active"
+	MAPPING_STATUS_DISABLED    string = "disabled"
+	MAPPING_STATUS_QUARANTINED string = "quarantined"
+)
+
+// inactiveMappingMessage is the message returned instead of a redirect for a
+// mapping that has been disabled or quarantined
+func inactiveMappingMessage(mapping *cachedMapping) string {
+	if mapping.StatusMessage != "" {
+		return mapping.StatusMessage
+	}
+	if mapping.Status == MAPPING_STATUS_QUARANTINED {
+		return "this short url is unavailable while it is under review"
+	}
+	return "this short url has been disabled"
+}
+
+type updateMappingStatusRequestBody struct {
+	Status     string `json:"status"`
+	StatusCode *int   `json:"statusCode,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+type mappingStatusResponseBody struct {
+	Msg           string `json:"message"`
+	Status        int    `json:"status"`
+	ShortUrlId    string `json:"shortUrlId"`
+	LinkStatus    string `json:"linkStatus"`
+	StatusCode    int    `json:"statusCode"`
+	StatusMessage string `json:"statusMessage"`
+}
+
+func validateUpdateMappingStatus(body *updateMappingStatusRequestBody) (int, error) {
+	switch body.Status {
+	case MAPPING_STATUS_ACTIVE, MAPPING_STATUS_DISABLED, MAPPING_STATUS_QUARANTINED:
+	default:
+		return 0, util.NewProblem(http.StatusBadRequest, fmt.Sprintf(
+			"invalid status: %q, must be one of %s, %s or %s",
+			body.Status, MAPPING_STATUS_ACTIVE, MAPPING_STATUS_DISABLED, MAPPING_STATUS_QUARANTINED,
+		)).WithField("status")
+	}
+	if body.StatusCode == nil {
+		return http.StatusGone, nil
+	}
+	if *body.StatusCode != http.StatusGone && *body.StatusCode != http.StatusUnavailableForLegalReasons {
+		return 0, util.NewProblem(http.StatusBadRequest, fmt.Sprintf(
+			"invalid statusCode: %d, must be %d or %d",
+			*body.StatusCode, http.StatusGone, http.StatusUnavailableForLegalReasons,
+		)).WithField("statusCode")
+	}
+	return *body.StatusCode, nil
+}
+
+// updateMappingStatusHandlerFactory lets admins take a link down without deleting it.
+// The cache entry is evicted after the update so the change applies to the next
+// redirect instead of whenever the entry would have been replaced
+func updateMappingStatusHandlerFactory(pool *pgxpool.Pool, rdb *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		parentSpan := trace.SpanFromContext(r.Context())
+		shortUrlId := r.PathValue("shortUrlId")
+		if !isValidShortUrlId(shortUrlId) {
+			writeInvalidShortUrlId(w, shortUrlId)
+			return
+		}
+		var body updateMappingStatusRequestBody
+		err := util.DecodeJSONBody(w, r, &body)
+		var statusCode int
+		if err == nil {
+			statusCode, err = validateUpdateMappingStatus(&body)
+		}
+		if err != nil {
+			var problem *util.Problem
+			if errors.As(err, &problem) {
+				logger.Warn("client error encountered when validating request body", "error", err)
+				util.WriteProblem(w, problem)
+			} else {
+				logger.Error("server error encountered when decoding request body", "error", err)
+				writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			}
+			return
+		}
+
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the update status handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		var record db.UrlMapping
+		err = withTx(r.Context(), conn, func(queries *db.Queries) error {
+			// lock the row so the before value in the audit log is the value that
+			// was actually replaced
+			before, err := queries.SelectMappingForUpdate(r.Context(), shortUrlId)
+			if err != nil {
+				return err
+			}
+			record, err = queries.UpdateMappingStatus(r.Context(), db.UpdateMappingStatusParams{
+				ID:            shortUrlId,
+				Status:        body.Status,
+				StatusCode:    int32(statusCode),
+				StatusMessage: body.Message,
+			})
+			if err != nil {
+				return err
+			}
+			return recordAuditEvent(r.Context(), queries, r, AUDIT_ACTION_UPDATE_STATUS, shortUrlId, &before, &record)
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeMappingNotFound(w, shortUrlId)
+			return
+		}
+		if err != nil {
+			logger.Error("database error encountered when updating mapping status", "error", err, "shortUrl", shortUrlId)
+			parentSpan.SetStatus(codes.Error, "updating the mapping status failed")
+			parentSpan.RecordError(err)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if err = evictCachedMapping(r.Context(), rdb, shortUrlId); err != nil {
+			// the database is the source of truth, report the failure so the admin
+			// can retry instead of assuming the link is already down
+			logger.Error("unable to evict mapping from the redis cache", "error", err, "shortUrl", shortUrlId)
+			writeProblem(
+				w,
+				http.StatusServiceUnavailable,
+				"the status was updated but the cached mapping could not be evicted, retry the request",
+			)
+			return
+		}
+		logger.Info("updated mapping status", "shortUrl", shortUrlId, "linkStatus", record.Status)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&mappingStatusResponseBody{
+			Msg:           "successfully updated mapping status",
+			Status:        http.StatusOK,
+			ShortUrlId:    record.ID,
+			LinkStatus:    record.Status,
+			StatusCode:    int(record.StatusCode),
+			StatusMessage: record.StatusMessage,
+		})
+	}
+}
+
+// deleteMappingHandlerFactory permanently removes a mapping. The audit log keeps
+// the last version of the mapping as the before value of the delete event
+func deleteMappingHandlerFactory(pool *pgxpool.Pool, rdb *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		parentSpan := trace.SpanFromContext(r.Context())
+		shortUrlId := r.PathValue("shortUrlId")
+		if !isValidShortUrlId(shortUrlId) {
+			writeInvalidShortUrlId(w, shortUrlId)
+			return
+		}
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the delete mapping handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		err = withTx(r.Context(), conn, func(queries *db.Queries) error {
+			record, err := queries.DeleteMapping(r.Context(), shortUrlId)
+			if err != nil {
+				return err
+			}
+			return recordAuditEvent(r.Context(), queries, r, AUDIT_ACTION_DELETE, shortUrlId, &record, nil)
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			// a previous request may have deleted the mapping and then failed to
+			// evict it, evicting again lets the retry of that request clear the cache
+			if err = evictCachedMapping(r.Context(), rdb, shortUrlId); err != nil {
+				logger.Error("unable to evict mapping from the redis cache", "error", err, "shortUrl", shortUrlId)
+				writeProblem(
+					w,
+					http.StatusServiceUnavailable,
+					"the cached mapping could not be evicted, retry the request",
+				)
+				return
+			}
+			writeMappingNotFound(w, shortUrlId)
+			return
+		}
+		if err != nil {
+			logger.Error("database error encountered when deleting mapping", "error", err, "shortUrl", shortUrlId)
+			parentSpan.SetStatus(codes.Error, "deleting the mapping failed")
+			parentSpan.RecordError(err)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if err = evictCachedMapping(r.Context(), rdb, shortUrlId); err != nil {
+			logger.Error("unable to evict mapping from the redis cache", "error", err, "shortUrl", shortUrlId)
+			writeProblem(
+				w,
+				http.StatusServiceUnavailable,
+				"the mapping was deleted but the cached mapping could not be evicted, retry the request",
+			)
+			return
+		}
+		logger.Info("deleted mapping", "shortUrl", shortUrlId)
+		writeMessageResponse(w, http.StatusOK, "successfully deleted mapping")
+	}
+}
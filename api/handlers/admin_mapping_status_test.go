@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+
+	"townsag/url_shortener/api/util"
+)
+
+func TestUpdateMappingStatusInvalidBody(t *testing.T) {
+	// validation happens before the database is used so no containers are needed
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("PUT /api/admin/mapping/{shortUrlId}/status", updateMappingStatusHandlerFactory(nil, nil))
+
+	for _, body := range []string{`{"status": "deleted"}`, `{"status": "disabled", "statusCode": 404}`} {
+		req := httptest.NewRequest("PUT", "/api/admin/mapping/abcd1234/status", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("update status with body %s returned incorrect status code: expected: %d, received: %d", body, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestDisableAndReactivateMapping(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.HandleFunc("PUT /api/admin/mapping/{shortUrlId}/status", updateMappingStatusHandlerFactory(pool, rdb))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	shortUrlId := *created.ShortUrl
+	access := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/"+shortUrlId, nil))
+		return rr
+	}
+	updateStatus := func(body string) {
+		req := httptest.NewRequest("PUT", "/api/admin/mapping/"+shortUrlId+"/status", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("update status returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+		}
+	}
+
+	// the first access writes the mapping to the cache
+	if rr := access(); rr.Code != http.StatusFound {
+		t.Fatalf("active mapping returned incorrect status code: expected: %d, received: %d", http.StatusFound, rr.Code)
+	}
+
+	updateStatus(`{"status": "disabled", "statusCode": 451, "message": "removed after a legal request"}`)
+	rr = access()
+	if rr.Code != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("disabled mapping returned incorrect status code: expected: %d, received: %d", http.StatusUnavailableForLegalReasons, rr.Code)
+	}
+	var responseBody util.Problem
+	if err = json.NewDecoder(rr.Body).Decode(&responseBody); err != nil {
+		t.Fatalf("failed to decode disabled mapping response body with %v", err)
+	}
+	if responseBody.Detail != "removed after a legal request" {
+		t.Fatalf("disabled mapping returned the wrong message: %s", responseBody.Detail)
+	}
+
+	updateStatus(`{"status": "active"}`)
+	if rr := access(); rr.Code != http.StatusFound {
+		t.Fatalf("reactivated mapping returned incorrect status code: expected: %d, received: %d", http.StatusFound, rr.Code)
+	}
+}
+
+func TestDeleteMissingMappingEvictsCachedMapping(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("DELETE /api/admin/mapping/{shortUrlId}", deleteMappingHandlerFactory(pool, rdb))
+
+	// a delete that committed but failed to evict leaves the mapping in the cache,
+	// the retry finds no row in the database and must still evict it
+	shortUrlId := "deleted-but-cached"
+	if err = writeCachedMapping(context.Background(), rdb, shortUrlId, &cachedMapping{LongUrl: "https://google.com"}); err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/admin/mapping/"+shortUrlId, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("delete missing mapping returned incorrect status code: expected: %d, received: %d", http.StatusNotFound, rr.Code)
+	}
+	if _, err = readCachedMapping(context.Background(), rdb, shortUrlId); err != redis.Nil {
+		t.Fatalf("retried delete did not evict the cached mapping: %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
+)
+
+const (
+	AUDIT_ACTION_CREATE        string = "create"
+	AUDIT_ACTION_UPDATE_STATUS string = "update_status"
+	AUDIT_ACTION_DELETE        string = "delete"
+	AUDIT_ACTOR_ADMIN          string = "admin"
+	AUDIT_ACTOR_ANONYMOUS      string = "anonymous"
+	AUDIT_ACTOR_CLI            string = "cli"
+)
+
+const DEFAULT_AUDIT_LIST_LIMIT int = 50
+const MAX_AUDIT_LIST_LIMIT int = 500
+
+// auditActor identifies who made a request. There are no user accounts so the
+// only distinction is whether the request carried the admin token
+func auditActor(r *http.Request) string {
+	if middleware.IsAdminRequest(r.Context()) {
+		return AUDIT_ACTOR_ADMIN
+	}
+	return AUDIT_ACTOR_ANONYMOUS
+}
+
+// auditValue encodes the admin view of a mapping, the password hash is never
+// written to the audit log
+func auditValue(record *db.UrlMapping) ([]byte, error) {
+	if record == nil {
+		return nil, nil
+	}
+	return json.Marshal(linkSummaryFromRecord(*record))
+}
+
+// auditOrigin describes where a change came from
+type auditOrigin struct {
+	requestId string
+	actor     string
+	clientIp  string
+}
+
+func auditOriginFromRequest(r *http.Request) auditOrigin {
+	return auditOrigin{
+		requestId: middleware.IdFromRequest(r),
+		actor:     auditActor(r),
+		clientIp:  util.ClientIP(r),
+	}
+}
+
+// recordAuditEvent must be called with queries that belong to the same transaction
+// as the change so that a change is never committed without its audit event
+func recordAuditEvent(
+	ctx context.Context,
+	queries *db.Queries,
+	r *http.Request,
+	action string,
+	shortUrlId string,
+	before *db.UrlMapping,
+	after *db.UrlMapping,
+) error {
+	return recordAuditEventFrom(ctx, queries, auditOriginFromRequest(r), action, shortUrlId, before, after)
+}
+
+// recordAuditEventFrom records changes that were not made by an http request, for
+// example by the import command
+func recordAuditEventFrom(
+	ctx context.Context,
+	queries *db.Queries,
+	origin auditOrigin,
+	action string,
+	shortUrlId string,
+	before *db.UrlMapping,
+	after *db.UrlMapping,
+) error {
+	beforeValue, err := auditValue(before)
+	if err != nil {
+		return fmt.Errorf("unable to encode audit before value: %w", err)
+	}
+	afterValue, err := auditValue(after)
+	if err != nil {
+		return fmt.Errorf("unable to encode audit after value: %w", err)
+	}
+	return queries.InsertAuditEvent(ctx, db.InsertAuditEventParams{
+		RequestID:   origin.requestId,
+		Actor:       origin.actor,
+		ClientIp:    origin.clientIp,
+		Action:      action,
+		MappingID:   shortUrlId,
+		BeforeValue: beforeValue,
+		AfterValue:  afterValue,
+	})
+}
+
+// withTx runs fn in a transaction on the connection. The transaction is committed
+// when fn returns nil and rolled back otherwise, the error from fn is returned
+// unchanged so callers can still check for pgx.ErrNoRows
+func withTx(ctx context.Context, conn *pgxpool.Conn, fn func(queries *db.Queries) error) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to begin transaction: %w", err)
+	}
+	// rollback is a no op after a successful commit
+	defer tx.Rollback(ctx)
+	if err = fn(db.New(conn).WithTx(tx)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+type auditEventSummary struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurredAt"`
+	RequestId  string          `json:"requestId"`
+	Actor      string          `json:"actor"`
+	ClientIp   string          `json:"clientIp"`
+	Action     string          `json:"action"`
+	ShortUrlId string          `json:"shortUrlId"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+type auditEventsResponseBody struct {
+	Msg    string              `json:"message"`
+	Status int                 `json:"status"`
+	Events []auditEventSummary `json:"events"`
+	// NextBefore is passed as the before parameter to fetch the next page, it is
+	// omitted on the last page
+	NextBefore *int64 `json:"nextBefore,omitempty"`
+}
+
+func parseAuditTime(query url.Values, name string) (pgtype.Timestamp, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return pgtype.Timestamp{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return pgtype.Timestamp{}, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp", name)).WithField(name)
+	}
+	// occurred_at is written by the database in UTC
+	return pgtype.Timestamp{Time: t.UTC(), Valid: true}, nil
+}
+
+func optionalText(query url.Values, name string) pgtype.Text {
+	value := query.Get(name)
+	return pgtype.Text{String: value, Valid: value != ""}
+}
+
+// parseAuditFilters reads the filters of the audit query endpoint, every filter is
+// optional and filters that are present are combined with AND
+func parseAuditFilters(query url.Values) (*db.ListAuditEventsParams, error) {
+	params := &db.ListAuditEventsParams{
+		MappingID: optionalText(query, "shortUrlId"),
+		Actor:     optionalText(query, "actor"),
+		Action:    optionalText(query, "action"),
+		RequestID: optionalText(query, "requestId"),
+		MaxEvents: int32(DEFAULT_AUDIT_LIST_LIMIT),
+	}
+	switch params.Action.String {
+	case "", AUDIT_ACTION_CREATE, AUDIT_ACTION_UPDATE_STATUS, AUDIT_ACTION_DELETE:
+	default:
+		return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf(
+			"invalid action: %q, must be one of %s, %s or %s",
+			params.Action.String, AUDIT_ACTION_CREATE, AUDIT_ACTION_UPDATE_STATUS, AUDIT_ACTION_DELETE,
+		)).WithField("action")
+	}
+	var err error
+	if params.Since, err = parseAuditTime(query, "since"); err != nil {
+		return nil, err
+	}
+	if params.Until, err = parseAuditTime(query, "until"); err != nil {
+		return nil, err
+	}
+	if raw := query.Get("before"); raw != "" {
+		before, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || before < 1 {
+			return nil, util.NewProblem(http.StatusBadRequest, "before must be a positive integer").WithField("before")
+		}
+		params.BeforeID = pgtype.Int8{Int64: before, Valid: true}
+	}
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_AUDIT_LIST_LIMIT {
+			return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("limit must be an integer between 1 and %d", MAX_AUDIT_LIST_LIMIT)).WithField("limit")
+		}
+		params.MaxEvents = int32(limit)
+	}
+	return params, nil
+}
+
+// listAuditEventsHandlerFactory returns audit events newest first, pages are
+// fetched with the nextBefore value of the previous page
+func listAuditEventsHandlerFactory(pool *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		params, err := parseAuditFilters(r.URL.Query())
+		if err != nil {
+			var problem *util.Problem
+			errors.As(err, &problem)
+			util.WriteProblem(w, problem)
+			return
+		}
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the audit handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		records, err := db.New(conn).ListAuditEvents(r.Context(), *params)
+		if err != nil {
+			logger.Error("database error encountered when listing audit events", "error", err)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		response := auditEventsResponseBody{
+			Msg:    "successfully listed audit events",
+			Status: http.StatusOK,
+			Events: make([]auditEventSummary, 0, len(records)),
+		}
+		for _, record := range records {
+			response.Events = append(response.Events, auditEventSummary{
+				ID:         record.ID,
+				OccurredAt: record.OccurredAt.Time,
+				RequestId:  record.RequestID,
+				Actor:      record.Actor,
+				ClientIp:   record.ClientIp,
+				Action:     record.Action,
+				ShortUrlId: record.MappingID,
+				Before:     record.BeforeValue,
+				After:      record.AfterValue,
+			})
+		}
+		if len(records) == int(params.MaxEvents) {
+			response.NextBefore = &records[len(records)-1].ID
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&response)
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"townsag/url_shortener/api/middleware"
+)
+
+func TestParseAuditFilters(t *testing.T) {
+	params, err := parseAuditFilters(url.Values{})
+	if err != nil {
+		t.Fatalf("parsing empty filters failed with %v", err)
+	}
+	if params.MappingID.Valid || params.Since.Valid || params.BeforeID.Valid || params.MaxEvents != int32(DEFAULT_AUDIT_LIST_LIMIT) {
+		t.Errorf("empty filters were not parsed as unset: %+v", params)
+	}
+
+	params, err = parseAuditFilters(url.Values{
+		"shortUrlId": {"abcd1234"},
+		"action":     {AUDIT_ACTION_DELETE},
+		"since":      {"2025-01-02T03:04:05-08:00"},
+		"before":     {"42"},
+		"limit":      {"5"},
+	})
+	if err != nil {
+		t.Fatalf("parsing filters failed with %v", err)
+	}
+	if params.MappingID.String != "abcd1234" || params.Action.String != AUDIT_ACTION_DELETE {
+		t.Errorf("text filters were not parsed: %+v", params)
+	}
+	if params.Since.Time.Hour() != 11 {
+		t.Errorf("since was not converted to UTC: %v", params.Since.Time)
+	}
+	if params.BeforeID.Int64 != 42 || params.MaxEvents != 5 {
+		t.Errorf("pagination filters were not parsed: %+v", params)
+	}
+
+	for _, query := range []url.Values{
+		{"action": {"rename"}},
+		{"since": {"yesterday"}},
+		{"before": {"0"}},
+		{"limit": {"1000"}},
+	} {
+		if _, err := parseAuditFilters(query); err == nil {
+			t.Errorf("invalid filters %v were accepted", query)
+		}
+	}
+}
+
+func TestAuditLogRecordsMappingChanges(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := func(next http.Handler) http.Handler {
+		return middleware.AdminAuthMiddleware("test-token", next)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.Handle("PUT /api/admin/mapping/{shortUrlId}/status", admin(updateMappingStatusHandlerFactory(pool, rdb)))
+	testMux.Handle("DELETE /api/admin/mapping/{shortUrlId}", admin(deleteMappingHandlerFactory(pool, rdb)))
+	testMux.Handle("GET /api/admin/audit", admin(listAuditEventsHandlerFactory(pool)))
+	send := func(method string, target string, body string, requestId string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set("X-Request-ID", requestId)
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the create endpoint is public so the token is ignored and the actor is anonymous
+	rr := send("POST", "/api/mapping", `{"longUrl": "https://google.com/audit"}`, "create-request")
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	shortUrlId := *created.ShortUrl
+	if rr := send("PUT", "/api/admin/mapping/"+shortUrlId+"/status", `{"status": "disabled"}`, "disable-request"); rr.Code != http.StatusOK {
+		t.Fatalf("update status returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	if rr := send("DELETE", "/api/admin/mapping/"+shortUrlId, "", "delete-request"); rr.Code != http.StatusOK {
+		t.Fatalf("delete returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	if rr := send("DELETE", "/api/admin/mapping/"+shortUrlId, "", "second-delete-request"); rr.Code != http.StatusNotFound {
+		t.Fatalf("second delete returned incorrect status code: expected: %d, received: %d", http.StatusNotFound, rr.Code)
+	}
+
+	rr = send("GET", "/api/admin/audit?shortUrlId="+shortUrlId, "", "audit-request")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("audit query returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	var response auditEventsResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode audit response body with %v", err)
+	}
+	expected := []struct {
+		action    string
+		actor     string
+		requestId string
+		hasBefore bool
+		hasAfter  bool
+	}{
+		{AUDIT_ACTION_DELETE, AUDIT_ACTOR_ADMIN, "delete-request", true, false},
+		{AUDIT_ACTION_UPDATE_STATUS, AUDIT_ACTOR_ADMIN, "disable-request", true, true},
+		{AUDIT_ACTION_CREATE, AUDIT_ACTOR_ANONYMOUS, "create-request", false, true},
+	}
+	if len(response.Events) != len(expected) {
+		t.Fatalf("audit query returned %d events, expected %d", len(response.Events), len(expected))
+	}
+	for i, event := range response.Events {
+		want := expected[i]
+		if event.Action != want.action || event.Actor != want.actor || event.RequestId != want.requestId {
+			t.Errorf("audit event %d is %s by %s in %s, expected %s by %s in %s",
+				i, event.Action, event.Actor, event.RequestId, want.action, want.actor, want.requestId)
+		}
+		if (event.Before != nil) != want.hasBefore || (event.After != nil) != want.hasAfter {
+			t.Errorf("audit event %d has the wrong before and after values: %s, %s", i, event.Before, event.After)
+		}
+	}
+	var before linkSummary
+	if err = json.Unmarshal(response.Events[1].Before, &before); err != nil || before.LinkStatus != MAPPING_STATUS_ACTIVE {
+		t.Errorf("status change before value does not hold the active mapping: %s", response.Events[1].Before)
+	}
+
+	// the audit log is append only
+	_, err = pool.Exec(t.Context(), "DELETE FROM audit_events WHERE mapping_id = $1", shortUrlId)
+	if err == nil {
+		t.Errorf("deleting audit events did not fail")
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"townsag/url_shortener/api/db"
+)
+
+// cachedMapping is the value that is stored in redis for each short url id.
+// It holds everything the redirect handler needs so that a cache hit never
+// has to fall back to the database. The password hash is not cached, it is only
+// read from the database when a password is submitted
+type cachedMapping struct {
+	LongUrl           string    `json:"longUrl"`
+	RedirectStatus    int       `json:"redirectStatus"`
+	ForwardQuery      bool      `json:"forwardQuery,omitempty"`
+	ForwardPath       bool      `json:"forwardPath,omitempty"`
+	UtmQuery          string    `json:"utmQuery,omitempty"`
+	PasswordProtected bool      `json:"passwordProtected,omitempty"`
+	Title             string    `json:"title,omitempty"`
+	CreatedAt         time.Time `json:"createdAt"`
+	Status            string    `json:"status,omitempty"`
+	StatusCode        int       `json:"statusCode,omitempty"`
+	StatusMessage     string    `json:"statusMessage,omitempty"`
+}
+
+func cachedMappingFromRecord(record db.UrlMapping) *cachedMapping {
+	return &cachedMapping{
+		LongUrl:           record.LongUrl,
+		RedirectStatus:    int(record.RedirectStatus),
+		ForwardQuery:      record.ForwardQuery,
+		ForwardPath:       record.ForwardPath,
+		UtmQuery:          record.UtmQuery,
+		PasswordProtected: record.PasswordHash.Valid,
+		Title:             record.Title,
+		CreatedAt:         record.CreatedAt.Time,
+		Status:            record.Status,
+		StatusCode:        int(record.StatusCode),
+		StatusMessage:     record.StatusMessage,
+	}
+}
+
+const (
+	// CACHED_MAPPING_TTL bounds how long an entry that missed an eviction can
+	// serve an outdated mapping
+	CACHED_MAPPING_TTL = 24 * time.Hour
+	// evicted entries are replaced with a tombstone instead of being deleted.
+	// Mappings are only written back to the cache when there is no entry, so a
+	// redirect that read the mapping from the database before an update cannot
+	// write the outdated mapping back after the update evicted it. The tombstone
+	// must outlive the slowest database lookup of the read path
+	EVICTED_MAPPING_TOMBSTONE = "evicted"
+	EVICTED_MAPPING_TTL       = time.Minute
+)
+
+// readCachedMapping returns redis.Nil when there is no entry for the id or the
+// entry was evicted. Entries that cannot be decoded (for example the plain long
+// url strings written by older versions of the service) are replaced with a
+// tombstone and reported as an error so the caller falls back to the database,
+// the next write back after the tombstone expires replaces them
+func readCachedMapping(ctx context.Context, rdb *redis.Client, shortUrlId string) (*cachedMapping, error) {
+	value, err := rdb.Get(ctx, shortUrlId).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if string(value) == EVICTED_MAPPING_TOMBSTONE {
+		return nil, redis.Nil
+	}
+	var mapping cachedMapping
+	if err := json.Unmarshal(value, &mapping); err != nil {
+		if evictErr := evictCachedMapping(ctx, rdb, shortUrlId); evictErr != nil {
+			err = errors.Join(err, evictErr)
+		}
+		return nil, fmt.Errorf("unable to decode cached mapping for %s: %w", shortUrlId, err)
+	}
+	return &mapping, nil
+}
+
+// evictCachedMapping replaces the entry for a mapping with a tombstone so that the
+// next read sees the latest version from the database
+func evictCachedMapping(ctx context.Context, rdb *redis.Client, shortUrlId string) error {
+	return rdb.Set(ctx, shortUrlId, EVICTED_MAPPING_TOMBSTONE, EVICTED_MAPPING_TTL).Err()
+}
+
+// writeCachedMapping only writes the mapping when there is no entry for the id,
+// it never replaces a tombstone or a mapping that was written in the meantime
+func writeCachedMapping(ctx context.Context, rdb *redis.Client, shortUrlId string, mapping *cachedMapping) error {
+	value, err := json.Marshal(mapping)
+	if err != nil {
+		return fmt.Errorf("unable to encode cached mapping for %s: %w", shortUrlId, err)
+	}
+	return rdb.SetNX(ctx, shortUrlId, value, CACHED_MAPPING_TTL).Err()
+}
+
+// the mapping cache counts its own hits and misses in redis so that the admin
+// dashboard reports the hit ratio of mapping lookups across every instance. The
+// keys contain a colon so they cannot collide with a short url id
+const (
+	CACHE_HITS_KEY   = "cache_stats:hits"
+	CACHE_MISSES_KEY = "cache_stats:misses"
+	// the counters are incremented after the redirect is served, this bounds how
+	// long an increment may run when redis is slow
+	CACHE_COUNTER_TIMEOUT = time.Millisecond * 500
+)
+
+var (
+	errMappingNotFound     = errors.New("could not find a mapping for the short url id")
+	errDatabaseUnavailable = errors.New("unable to get a connection from the database pool")
+)
+
+// lookupMapping implements the read path of the write around cache. The mapping
+// is read from redis, on a cache miss it is read from the database and written
+// back to redis so that the next read for the same id is a cache hit, unless the
+// mapping was evicted in the meantime. Both steps
+// get their own span so that a trace shows which of them served the redirect
+func lookupMapping(
+	ctx context.Context,
+	logger *slog.Logger,
+	pool *pgxpool.Pool,
+	rdb *redis.Client,
+	shortUrlId string,
+) (*cachedMapping, error) {
+	mapping, err := lookupCachedMapping(ctx, logger, rdb, shortUrlId)
+	if err == nil {
+		return mapping, nil
+	}
+	ctx, span := tracer.Start(ctx, "DatabaseLookup")
+	defer span.End()
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		span.SetStatus(codes.Error, "acquiring a connection from the pool failed")
+		span.RecordError(err)
+		return nil, fmt.Errorf("%w: %w", errDatabaseUnavailable, err)
+	}
+	defer conn.Release()
+	record, err := db.New(conn).SelectMapping(ctx, shortUrlId)
+	if err == pgx.ErrNoRows {
+		span.SetAttributes(attribute.Bool("mapping.found", false))
+		return nil, errMappingNotFound
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, "selecting the mapping failed")
+		span.RecordError(err)
+		return nil, fmt.Errorf("database error encountered when querying for long url: %w", err)
+	}
+	span.SetAttributes(attribute.Bool("mapping.found", true))
+	mapping = cachedMappingFromRecord(record)
+	if err = writeCachedMapping(ctx, rdb, shortUrlId, mapping); err != nil {
+		logger.Warn(fmt.Sprintf("error encountered when writing long url to redis cache: %v", err))
+	}
+	return mapping, nil
+}
+
+// lookupCachedMapping reads the mapping from redis and records whether the lookup
+// was a hit, a miss or failed. Any error means that the caller has to fall back
+// to the database
+func lookupCachedMapping(ctx context.Context, logger *slog.Logger, rdb *redis.Client, shortUrlId string) (*cachedMapping, error) {
+	ctx, span := tracer.Start(ctx, "CacheLookup")
+	defer span.End()
+	mapping, err := readCachedMapping(ctx, rdb, shortUrlId)
+	result := CACHE_RESULT_HIT
+	if err == redis.Nil {
+		result = CACHE_RESULT_MISS
+	} else if err != nil {
+		result = CACHE_RESULT_ERROR
+		span.SetStatus(codes.Error, "reading the mapping from redis failed")
+		span.RecordError(err)
+		logger.Warn("error encountered when reading from redis cache", slog.Any("error", err))
+	}
+	span.SetAttributes(attribute.String("cache.result", result))
+	recordCacheLookup(ctx, result)
+	if result != CACHE_RESULT_ERROR {
+		go countCachedLookup(context.WithoutCancel(ctx), logger, rdb, result)
+	}
+	return mapping, err
+}
+
+// countCachedLookup increments the hit or miss counter that the admin dashboard
+// reads. It runs in the background so that a redirect costs a single round trip
+// to redis, a failed increment only skews the reported hit ratio
+func countCachedLookup(ctx context.Context, logger *slog.Logger, rdb *redis.Client, result string) {
+	ctx, cancel := context.WithTimeout(ctx, CACHE_COUNTER_TIMEOUT)
+	defer cancel()
+	counterKey := CACHE_HITS_KEY
+	if result == CACHE_RESULT_MISS {
+		counterKey = CACHE_MISSES_KEY
+	}
+	if err := rdb.Incr(ctx, counterKey).Err(); err != nil {
+		logger.Warn("error encountered when counting the cache lookup", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestWriteBackDoesNotReplaceEvictedMapping(t *testing.T) {
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	shortUrlId := "evicted-during-lookup"
+
+	// a redirect reads the active mapping from the database, the mapping is
+	// disabled and evicted, then the redirect writes back what it read
+	if err = evictCachedMapping(ctx, rdb, shortUrlId); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeCachedMapping(ctx, rdb, shortUrlId, &cachedMapping{LongUrl: "https://google.com", Status: "active"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readCachedMapping(ctx, rdb, shortUrlId); err != redis.Nil {
+		t.Fatalf("write back replaced the evicted mapping, received: %v", err)
+	}
+
+	// once the tombstone expires the mapping is cached again with a bounded ttl
+	if err = rdb.Del(ctx, shortUrlId).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeCachedMapping(ctx, rdb, shortUrlId, &cachedMapping{LongUrl: "https://google.com", Status: "disabled"}); err != nil {
+		t.Fatal(err)
+	}
+	if mapping, err := readCachedMapping(ctx, rdb, shortUrlId); err != nil || mapping.Status != "disabled" {
+		t.Fatalf("mapping was not written back: %v, error: %v", mapping, err)
+	}
+	if ttl := rdb.TTL(ctx, shortUrlId).Val(); ttl <= 0 || ttl > CACHED_MAPPING_TTL {
+		t.Fatalf("cached mapping has an unbounded ttl: %v", ttl)
+	}
+}
+
+func TestUndecodableCachedMappingIsEvicted(t *testing.T) {
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	shortUrlId := "legacy-entry"
+	// older versions of the service cached the plain long url without a ttl
+	if err = rdb.Set(ctx, shortUrlId, "https://google.com", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readCachedMapping(ctx, rdb, shortUrlId); err == nil || err == redis.Nil {
+		t.Fatalf("expected a decoding error, received: %v", err)
+	}
+	if _, err = readCachedMapping(ctx, rdb, shortUrlId); err != redis.Nil {
+		t.Fatalf("undecodable entry was not evicted, received: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"townsag/url_shortener/api/analytics"
+	"townsag/url_shortener/api/db"
+)
+
+// newBrowserRequest returns a request with the headers of a browser so that it is
+// counted as a human visit
+func newBrowserRequest(method string, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
+	return req
+}
+
+func TestRedirectRecordsClickEvents(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clicks, err := analytics.NewPipeline(&analytics.PostgresStore{Pool: pool}, analytics.DefaultConfig(), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, clicks))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com/clicks"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	shortUrlId := *created.ShortUrl
+
+	for range 3 {
+		req := newBrowserRequest("GET", "/api/"+shortUrlId)
+		req.Header.Set("Referer", "https://news.example.com/article")
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusFound {
+			t.Fatalf("redirect returned incorrect status code: expected: %d, received: %d", http.StatusFound, rr.Code)
+		}
+	}
+	// link unfurlers are redirected as well but do not count as visits
+	req = httptest.NewRequest("GET", "/api/"+shortUrlId, nil)
+	req.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)")
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	// the preview page is not a click
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/"+shortUrlId+"+", nil))
+
+	// shutting down writes the events that are still queued
+	if err = clicks.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to flush click events with %v", err)
+	}
+	record, err := db.New(pool).SelectMapping(context.Background(), shortUrlId)
+	if err != nil {
+		t.Fatalf("failed to select mapping with %v", err)
+	}
+	if record.Visits.Int32 != 3 || record.BotVisits != 1 {
+		t.Errorf("mapping has %d visits and %d bot visits, expected 3 and 1", record.Visits.Int32, record.BotVisits)
+	}
+	var referrer string
+	var events int
+	err = pool.QueryRow(
+		context.Background(),
+		"SELECT MIN(referrer), COUNT(*) FROM click_events WHERE mapping_id = $1 AND NOT is_bot",
+		shortUrlId,
+	).Scan(&referrer, &events)
+	if err != nil {
+		t.Fatalf("failed to count click events with %v", err)
+	}
+	if events != 3 || referrer != "https://news.example.com/article" {
+		t.Errorf("found %d click events with referrer %q, expected 3 from the article", events, referrer)
+	}
+}
+
+func TestStreamConsumerReclaimsPendingEvents(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := analytics.DefaultStreamConfig()
+	config.Stream = "test_click_events:stream"
+	config.Block = 50 * time.Millisecond
+	config.MinIdle = time.Millisecond
+	config.ReclaimInterval = 10 * time.Millisecond
+	recorder, err := analytics.NewStreamRecorder(rdb, config, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, recorder))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com/stream"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	shortUrlId := *created.ShortUrl
+	for range 2 {
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, newBrowserRequest("GET", "/api/"+shortUrlId))
+	}
+
+	// a consumer reads one entry and crashes before acknowledging it
+	ctx := context.Background()
+	if err = rdb.XGroupCreateMkStream(ctx, config.Stream, config.Group, "0").Err(); err != nil {
+		t.Fatalf("failed to create the consumer group with %v", err)
+	}
+	err = rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    config.Group,
+		Consumer: "crashed",
+		Streams:  []string{config.Stream, ">"},
+		Count:    1,
+	}).Err()
+	if err != nil {
+		t.Fatalf("failed to read from the stream with %v", err)
+	}
+
+	config.Consumer = "healthy"
+	consumer, err := analytics.NewStreamConsumer(rdb, &analytics.PostgresStore{Pool: pool}, config, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Run(runCtx)
+	}()
+	var record db.UrlMapping
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		record, err = db.New(pool).SelectMapping(ctx, shortUrlId)
+		if err == nil && record.Visits.Int32 == 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	if err = <-done; err != nil {
+		t.Errorf("consumer stopped with %v", err)
+	}
+	if record.Visits.Int32 != 2 {
+		t.Errorf("mapping has %d visits, expected the read and the reclaimed event", record.Visits.Int32)
+	}
+	pending, err := rdb.XPending(ctx, config.Stream, config.Group).Result()
+	if err != nil {
+		t.Fatalf("failed to read pending entries with %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("%d entries are still pending", pending.Count)
+	}
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"townsag/url_shortener/api/util"
+)
+
+const MAX_UTM_PARAMS int = 10
+
+// validateUtmParams checks the fixed utm parameters from a create mapping request
+// and encodes them as a query string so they can be stored in a single column
+func validateUtmParams(params map[string]string) (string, error) {
+	if len(params) > MAX_UTM_PARAMS {
+		return "", util.NewProblem(http.StatusBadRequest, fmt.Sprintf("utmParams must not contain more than %d parameters", MAX_UTM_PARAMS)).WithField("utmParams")
+	}
+	values := url.Values{}
+	for key, value := range params {
+		if !strings.HasPrefix(key, "utm_") || len(key) == len("utm_") {
+			return "", util.NewProblem(http.StatusBadRequest, fmt.Sprintf("invalid utm parameter name: %q, names must start with utm_", key)).WithField("utmParams")
+		}
+		values.Set(key, value)
+	}
+	// Encode sorts by key so the stored value is deterministic
+	return values.Encode(), nil
+}
+
+// buildDestination computes the url that a request for a short url is redirected to.
+// The path suffix after the short url id is appended to the long url path when the
+// mapping forwards paths. The query string of the long url is kept, the query string
+// of the incoming request is added when the mapping forwards queries and the fixed
+// utm parameters are set last so they take precedence over client supplied values
+func buildDestination(mapping *cachedMapping, suffix string, incoming url.Values) (string, error) {
+	if suffix != "" && !mapping.ForwardPath {
+		return "", errMappingNotFound
+	}
+	if suffix == "" && (!mapping.ForwardQuery || len(incoming) == 0) && mapping.UtmQuery == "" {
+		// nothing to rewrite, return the long url exactly as it was stored
+		return mapping.LongUrl, nil
+	}
+	destination, err := url.Parse(mapping.LongUrl)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse stored long url: %w", err)
+	}
+	if suffix != "" {
+		// cleaning the suffix as an absolute path removes any ../ segments so the
+		// suffix cannot climb above the path of the long url
+		destination = destination.JoinPath(path.Clean("/" + suffix))
+	}
+	query := destination.Query()
+	if mapping.ForwardQuery {
+		for key, values := range incoming {
+			for _, value := range values {
+				query.Add(key, value)
+			}
+		}
+	}
+	if mapping.UtmQuery != "" {
+		utm, err := url.ParseQuery(mapping.UtmQuery)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse stored utm parameters: %w", err)
+		}
+		for key := range utm {
+			query.Set(key, utm.Get(key))
+		}
+	}
+	destination.RawQuery = query.Encode()
+	return destination.String(), nil
+}
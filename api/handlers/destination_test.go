@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestBuildDestination(t *testing.T) {
+	tests := []struct {
+		name     string
+		mapping  cachedMapping
+		suffix   string
+		query    string
+		expected string
+	}{
+		{
+			name:     "no options keeps the long url untouched",
+			mapping:  cachedMapping{LongUrl: "https://example.com/a?b=c"},
+			query:    "ref=newsletter",
+			expected: "https://example.com/a?b=c",
+		},
+		{
+			name:     "forward query merges with the long url query",
+			mapping:  cachedMapping{LongUrl: "https://example.com/a?b=c", ForwardQuery: true},
+			query:    "ref=newsletter",
+			expected: "https://example.com/a?b=c&ref=newsletter",
+		},
+		{
+			name:     "utm parameters take precedence over forwarded parameters",
+			mapping:  cachedMapping{LongUrl: "https://example.com", ForwardQuery: true, UtmQuery: "utm_source=twitter"},
+			query:    "utm_source=evil&ref=x",
+			expected: "https://example.com?ref=x&utm_source=twitter",
+		},
+		{
+			name:     "forward path appends the suffix",
+			mapping:  cachedMapping{LongUrl: "https://example.com/base/", ForwardPath: true},
+			suffix:   "docs/page",
+			expected: "https://example.com/base/docs/page",
+		},
+		{
+			name:     "forward path cannot climb above the long url path",
+			mapping:  cachedMapping{LongUrl: "https://example.com/base", ForwardPath: true},
+			suffix:   "../../secret",
+			expected: "https://example.com/base/secret",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			incoming, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			destination, err := buildDestination(&test.mapping, test.suffix, incoming)
+			if err != nil {
+				t.Fatalf("buildDestination returned an unexpected error: %v", err)
+			}
+			if destination != test.expected {
+				t.Fatalf("buildDestination returned the wrong url: expected: %s, received: %s", test.expected, destination)
+			}
+		})
+	}
+}
+
+func TestBuildDestinationSuffixWithoutForwardPath(t *testing.T) {
+	mapping := cachedMapping{LongUrl: "https://example.com"}
+	_, err := buildDestination(&mapping, "docs", url.Values{})
+	if err != errMappingNotFound {
+		t.Fatalf("expected errMappingNotFound for a suffix on a mapping without path forwarding, received: %v", err)
+	}
+}
+
+func TestValidateUtmParams(t *testing.T) {
+	encoded, err := validateUtmParams(map[string]string{"utm_source": "news letter", "utm_medium": "email"})
+	if err != nil {
+		t.Fatalf("validateUtmParams returned an unexpected error: %v", err)
+	}
+	if encoded != "utm_medium=email&utm_source=news+letter" {
+		t.Fatalf("validateUtmParams returned the wrong encoding: %s", encoded)
+	}
+	if _, err = validateUtmParams(map[string]string{"ref": "x"}); err == nil {
+		t.Fatal("expected an error for a parameter name without the utm_ prefix")
+	}
+}
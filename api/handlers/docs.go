@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"embed"
+	"net/http"
+)
+
+// the OpenAPI document and the page that renders it are embedded in the binary in
+// the same way as the templates. The document is written by hand, the contract
+// tests check that it matches the routes and the responses of the handlers
+//
+//go:embed docs
+var docsFiles embed.FS
+
+func serveDocsFile(w http.ResponseWriter, name string, contentType string) {
+	content, err := docsFiles.ReadFile(name)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	// the document changes with every release
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+func openApiDocumentHandlerFactory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveDocsFile(w, "docs/openapi.json", "application/json")
+	}
+}
+
+// docsPageHandlerFactory serves a page that renders the OpenAPI document, it does
+// not load any scripts from other origins
+func docsPageHandlerFactory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveDocsFile(w, "docs/index.html", "text/html; charset=utf-8")
+	}
+}
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/redis/go-redis/v9"
+
+	"townsag/url_shortener/api/middleware"
+)
+
+const testAdminToken string = "contract-test-token"
+
+func loadOpenApiDocument(t *testing.T) *openapi3.T {
+	t.Helper()
+	content, err := docsFiles.ReadFile("docs/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pages, images and csv exports are only checked by their content type
+	for _, contentType := range []string{"text/html", "text/csv", "image/png", "image/svg+xml"} {
+		openapi3filter.RegisterBodyDecoder(contentType, openapi3filter.FileBodyDecoder)
+	}
+	doc, err := openapi3.NewLoader().LoadFromData(content)
+	if err != nil {
+		t.Fatalf("failed to load the OpenAPI document: %v", err)
+	}
+	return doc
+}
+
+// validateResponse checks that the status, headers and body of a response are
+// documented for the operation that matches the request
+func validateResponse(t *testing.T, router routers.Router, req *http.Request, rr *httptest.ResponseRecorder) {
+	t.Helper()
+	route, pathParams, err := router.FindRoute(req)
+	if err != nil {
+		t.Fatalf("%s %s is not in the OpenAPI document: %v", req.Method, req.URL.Path, err)
+	}
+	err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: pathParams,
+			Route:      route,
+		},
+		Status:  rr.Code,
+		Header:  rr.Header(),
+		Body:    io.NopCloser(strings.NewReader(rr.Body.String())),
+		Options: &openapi3filter.Options{IncludeResponseStatus: true},
+	})
+	if err != nil {
+		t.Errorf("%s %s returned a response that does not match the OpenAPI document: %v", req.Method, req.URL, err)
+	}
+}
+
+// contractCase is a request to the routes of the api and the status it is expected
+// to respond with
+type contractCase struct {
+	name        string
+	mux         *http.ServeMux
+	method      string
+	target      string
+	contentType string
+	body        string
+	admin       bool
+	status      int
+}
+
+func runContractCase(t *testing.T, router routers.Router, test contractCase) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+	if test.contentType != "" {
+		req.Header.Set("Content-Type", test.contentType)
+	}
+	if test.admin {
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	rr := httptest.NewRecorder()
+	test.mux.ServeHTTP(rr, req)
+	if rr.Code != test.status {
+		t.Errorf("%s returned incorrect status code: expected: %d, received: %d", test.name, test.status, rr.Code)
+		return rr
+	}
+	validateResponse(t, router, req, rr)
+	return rr
+}
+
+func TestOpenApiDocumentIsValid(t *testing.T) {
+	doc := loadOpenApiDocument(t)
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("the OpenAPI document is invalid: %v", err)
+	}
+}
+
+// the routes are read from the source of AddRoutes so that a new route cannot be
+// added without documenting it
+func TestOpenApiDocumentCoversRoutes(t *testing.T) {
+	doc := loadOpenApiDocument(t)
+	source, err := os.ReadFile("routes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routePattern := regexp.MustCompile(`mux\.Handle\("([A-Z]+) ([^"]+)"`)
+	registered := map[string]bool{}
+	for _, match := range routePattern.FindAllStringSubmatch(string(source), -1) {
+		// the openapi path templates do not have wildcards that match several segments
+		path := strings.ReplaceAll(match[2], "...}", "}")
+		registered[match[1]+" "+path] = true
+		item := doc.Paths.Find(path)
+		if item == nil || item.GetOperation(match[1]) == nil {
+			t.Errorf("route %s %s is not in the OpenAPI document", match[1], match[2])
+		}
+	}
+	if len(registered) == 0 {
+		t.Fatal("did not find any routes in routes.go")
+	}
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !registered[method+" "+path] {
+				t.Errorf("the OpenAPI document describes %s %s which is not a route", method, path)
+			}
+		}
+	}
+}
+
+// TestHandlersMatchOpenApiDocument sends the requests that can be answered without
+// the database or the cache through the routes of the api, the responses are
+// checked against the document
+func TestHandlersMatchOpenApiDocument(t *testing.T) {
+	doc := loadOpenApiDocument(t)
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	AddRoutes(testMux, nil, nil, http.Dir("."), "http://localhost", testGuard, testAdminToken, testClicks)
+	disabledMux := http.NewServeMux()
+	AddRoutes(disabledMux, nil, nil, http.Dir("."), "http://localhost", testGuard, "", testClicks)
+
+	previousLevel := middleware.LogLevel().Level()
+	defer middleware.LogLevel().Set(previousLevel)
+
+	tests := []contractCase{
+		{name: "document", method: "GET", target: "/api/openapi.json", status: http.StatusOK},
+		{name: "docs page", method: "GET", target: "/api/docs", status: http.StatusOK},
+		{name: "redirect with an invalid id", method: "GET", target: "/api/not.valid", status: http.StatusBadRequest},
+		{name: "create with an invalid long url", method: "POST", target: "/api/mapping", contentType: "application/json", body: `{"longUrl": "javascript:alert(1)"}`, status: http.StatusBadRequest},
+		{name: "create with an unknown field", method: "POST", target: "/api/mapping", contentType: "application/json", body: `{"longUrl": "https://example.com", "owner": "me"}`, status: http.StatusBadRequest},
+		{name: "create without json", method: "POST", target: "/api/mapping", contentType: "text/plain", body: `https://example.com`, status: http.StatusUnsupportedMediaType},
+		{name: "create with a large body", method: "POST", target: "/api/mapping", contentType: "application/json", body: `{"title": "` + strings.Repeat("a", 2<<20) + `"}`, status: http.StatusRequestEntityTooLarge},
+		{name: "qr code with an invalid format", method: "GET", target: "/api/mapping/abcd1234/qr?format=gif", status: http.StatusBadRequest},
+		{name: "export without a token", method: "GET", target: "/api/mappings/export", status: http.StatusUnauthorized},
+		{name: "export with an invalid format", method: "GET", target: "/api/mappings/export?format=xml", admin: true, status: http.StatusBadRequest},
+		{name: "clicks export with an invalid time", method: "GET", target: "/api/mappings/abcd1234/clicks/export?since=yesterday", admin: true, status: http.StatusBadRequest},
+		{name: "list blocklist", method: "GET", target: "/api/admin/blocklist", admin: true, status: http.StatusOK},
+		{name: "add invalid blocklist entry", method: "POST", target: "/api/admin/blocklist", contentType: "application/json", body: `{"entry": "not a domain/"}`, admin: true, status: http.StatusBadRequest},
+		{name: "remove invalid blocklist entry", method: "DELETE", target: "/api/admin/blocklist?entry=*.", admin: true, status: http.StatusBadRequest},
+		{name: "update status with an invalid status", method: "PUT", target: "/api/admin/mapping/abcd1234/status", contentType: "application/json", body: `{"status": "deleted"}`, admin: true, status: http.StatusBadRequest},
+		{name: "delete with an invalid id", method: "DELETE", target: "/api/admin/mapping/not.valid", admin: true, status: http.StatusBadRequest},
+		{name: "clicks with an invalid granularity", method: "GET", target: "/api/admin/mapping/abcd1234/clicks?granularity=week", admin: true, status: http.StatusBadRequest},
+		{name: "import with an invalid format", method: "POST", target: "/api/admin/import?format=xml", contentType: "text/csv", admin: true, status: http.StatusBadRequest},
+		{name: "get log level", method: "GET", target: "/api/admin/log-level", admin: true, status: http.StatusOK},
+		{name: "update log level", method: "PUT", target: "/api/admin/log-level", contentType: "application/json", body: `{"level": "debug"}`, admin: true, status: http.StatusOK},
+		{name: "update log level with an invalid level", method: "PUT", target: "/api/admin/log-level", contentType: "application/json", body: `{"level": "verbose"}`, admin: true, status: http.StatusBadRequest},
+		{name: "audit with an invalid action", method: "GET", target: "/api/admin/audit?action=read", admin: true, status: http.StatusBadRequest},
+		{name: "stats without a token", method: "GET", target: "/api/admin/stats", status: http.StatusUnauthorized},
+		{name: "stats with the admin api disabled", mux: disabledMux, method: "GET", target: "/api/admin/stats", admin: true, status: http.StatusNotFound},
+		{name: "top links with an invalid limit", method: "GET", target: "/api/admin/links/top?limit=0", admin: true, status: http.StatusBadRequest},
+		{name: "recent links with an invalid limit", method: "GET", target: "/api/admin/links/recent?limit=101", admin: true, status: http.StatusBadRequest},
+		{name: "inactive links with an invalid limit", method: "GET", target: "/api/admin/links/inactive?limit=none", admin: true, status: http.StatusBadRequest},
+	}
+	// the cases depend on each other so they run in order in one test
+	for _, test := range tests {
+		if test.mux == nil {
+			test.mux = testMux
+		}
+		runContractCase(t, router, test)
+	}
+	if middleware.LogLevel().Level() != slog.LevelDebug {
+		t.Errorf("update log level did not change the log level")
+	}
+}
+
+type stubPinger struct {
+	err error
+}
+
+func (p stubPinger) Ping(ctx context.Context) error {
+	return p.err
+}
+
+type stubRedisPinger struct {
+	err error
+}
+
+func (p stubRedisPinger) Ping(ctx context.Context) *redis.StatusCmd {
+	return redis.NewStatusResult("PONG", p.err)
+}
+
+func TestHealthyMatchesOpenApiDocument(t *testing.T) {
+	router, err := gorillamux.NewRouter(loadOpenApiDocument(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailable := errors.New("connection refused")
+	for _, test := range []struct {
+		conn   pinger
+		rdb    redisClient
+		status int
+	}{
+		{conn: stubPinger{}, rdb: stubRedisPinger{}, status: http.StatusOK},
+		{conn: stubPinger{err: unavailable}, rdb: stubRedisPinger{}, status: http.StatusServiceUnavailable},
+		{conn: stubPinger{}, rdb: stubRedisPinger{err: unavailable}, status: http.StatusServiceUnavailable},
+	} {
+		req := httptest.NewRequest("GET", "/api/healthy", nil)
+		rr := httptest.NewRecorder()
+		healthyHandlerFactory(test.conn, test.rdb).ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("healthy returned incorrect status code: expected: %d, received: %d", test.status, rr.Code)
+			continue
+		}
+		validateResponse(t, router, req, rr)
+	}
+}
+
+// TestDatabaseHandlersMatchOpenApiDocument covers the successful responses of the
+// routes that use the database and the cache
+func TestDatabaseHandlersMatchOpenApiDocument(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := gorillamux.NewRouter(loadOpenApiDocument(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	AddRoutes(testMux, pool, rdb, http.Dir("."), "http://localhost", testGuard, testAdminToken, testClicks)
+
+	rr := runContractCase(t, router, contractCase{
+		name:        "create",
+		mux:         testMux,
+		method:      "POST",
+		target:      "/api/mapping",
+		contentType: "application/json",
+		body:        `{"longUrl": "https://example.com/contract", "title": "contract", "utmParams": {"utm_source": "docs"}}`,
+		status:      http.StatusOK,
+	})
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	shortUrlId := *created.ShortUrl
+
+	tests := []contractCase{
+		{name: "healthy", method: "GET", target: "/api/healthy", status: http.StatusOK},
+		{name: "redirect", method: "GET", target: "/api/" + shortUrlId, status: http.StatusFound},
+		{name: "preview", method: "GET", target: "/api/" + shortUrlId + "+", status: http.StatusOK},
+		{name: "redirect with a suffix", method: "GET", target: "/api/" + shortUrlId + "/more", status: http.StatusNotFound},
+		{name: "redirect a missing mapping", method: "GET", target: "/api/missing1234", status: http.StatusNotFound},
+		{name: "qr code", method: "GET", target: "/api/mapping/" + shortUrlId + "/qr", status: http.StatusOK},
+		{name: "svg qr code", method: "GET", target: "/api/mapping/" + shortUrlId + "/qr?format=svg", status: http.StatusOK},
+		{name: "export mappings", method: "GET", target: "/api/mappings/export", admin: true, status: http.StatusOK},
+		{name: "export clicks", method: "GET", target: "/api/mappings/" + shortUrlId + "/clicks/export", admin: true, status: http.StatusOK},
+		{name: "clicks", method: "GET", target: "/api/admin/mapping/" + shortUrlId + "/clicks", admin: true, status: http.StatusOK},
+		{name: "audit", method: "GET", target: "/api/admin/audit?shortUrlId=" + shortUrlId, admin: true, status: http.StatusOK},
+		{name: "stats", method: "GET", target: "/api/admin/stats", admin: true, status: http.StatusOK},
+		{name: "top links", method: "GET", target: "/api/admin/links/top", admin: true, status: http.StatusOK},
+		{name: "recent links", method: "GET", target: "/api/admin/links/recent", admin: true, status: http.StatusOK},
+		{name: "import", method: "POST", target: "/api/admin/import?dryRun=true", contentType: "text/csv", body: "shortUrlId,longUrl\ncontract1,https://example.com/imported\n", admin: true, status: http.StatusOK},
+		{name: "disable", method: "PUT", target: "/api/admin/mapping/" + shortUrlId + "/status", contentType: "application/json", body: `{"status": "disabled", "statusCode": 451}`, admin: true, status: http.StatusOK},
+		{name: "redirect a disabled mapping", method: "GET", target: "/api/" + shortUrlId, status: http.StatusUnavailableForLegalReasons},
+		{name: "inactive links", method: "GET", target: "/api/admin/links/inactive", admin: true, status: http.StatusOK},
+		{name: "add blocklist entry", method: "POST", target: "/api/admin/blocklist", contentType: "application/json", body: `{"entry": "contract-test.example"}`, admin: true, status: http.StatusCreated},
+		{name: "remove blocklist entry", method: "DELETE", target: "/api/admin/blocklist?entry=contract-test.example", admin: true, status: http.StatusOK},
+		{name: "remove missing blocklist entry", method: "DELETE", target: "/api/admin/blocklist?entry=contract-test.example", admin: true, status: http.StatusNotFound},
+		{name: "delete", method: "DELETE", target: "/api/admin/mapping/" + shortUrlId, admin: true, status: http.StatusOK},
+		{name: "delete a missing mapping", method: "DELETE", target: "/api/admin/mapping/" + shortUrlId, admin: true, status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		test.mux = testMux
+		runContractCase(t, router, test)
+	}
+}
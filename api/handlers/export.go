@@ -0,0 +1,344 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
+)
+
+const (
+	FORMAT_CSV   string = "csv"
+	FORMAT_JSONL string = "jsonl"
+)
+
+// EXPORT_FETCH_SIZE is the number of rows fetched from the cursor at a time, it
+// bounds the memory used by an export no matter how many rows it contains
+const EXPORT_FETCH_SIZE int = 500
+
+// sqlc cannot generate queries for cursors, so the export queries select the same
+// columns as the generated models and are scanned by position into them
+const (
+	exportMappingsQuery string = `SELECT * FROM url_mapping
+WHERE ($1::TEXT IS NULL OR created_by = $1)
+    AND ($2::TEXT IS NULL OR status = $2)
+ORDER BY created_at, id`
+	exportClicksQuery string = `SELECT * FROM click_events
+WHERE mapping_id = $1
+    AND ($2::TIMESTAMP IS NULL OR occurred_at >= $2)
+    AND ($3::TIMESTAMP IS NULL OR occurred_at < $3)
+ORDER BY occurred_at, id`
+)
+
+// streamCursor declares a cursor for the query in a read only transaction and
+// passes the rows to fn one batch at a time. The transaction is repeatable read
+// so that every batch comes from the same snapshot
+func streamCursor[T any](ctx context.Context, conn *pgxpool.Conn, query string, args []any, fn func([]T) error) error {
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err = tx.Exec(ctx, "DECLARE export_cursor NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		return err
+	}
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM export_cursor", EXPORT_FETCH_SIZE)
+	for {
+		rows, err := tx.Query(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		batch, err := pgx.CollectRows(rows, pgx.RowToStructByPos[T])
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err = fn(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// csvCell keeps spreadsheets from evaluating cells that start like a formula
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// exportEncoder writes rows as csv or as one json object per line. Rows are
+// flushed to the client after every batch
+type exportEncoder struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	json    *json.Encoder
+	written bool
+}
+
+func parseExportFormat(query url.Values) (string, error) {
+	format := query.Get("format")
+	if format == "" {
+		return FORMAT_CSV, nil
+	}
+	if format != FORMAT_CSV && format != FORMAT_JSONL {
+		return "", util.NewProblem(http.StatusBadRequest, fmt.Sprintf("invalid format: %q, must be %s or %s", format, FORMAT_CSV, FORMAT_JSONL)).WithField("format")
+	}
+	return format, nil
+}
+
+// newExportEncoder sets the headers of the response, the status is only written
+// with the first batch so that errors before it can still be reported as a problem
+func newExportEncoder(w http.ResponseWriter, format string, filename string, header []string) *exportEncoder {
+	e := &exportEncoder{w: w}
+	if format == FORMAT_CSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		e.csv = csv.NewWriter(w)
+		// the header is buffered by the csv writer until the first flush
+		e.csv.Write(header)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		e.json = json.NewEncoder(w)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+"."+format))
+	return e
+}
+
+func (e *exportEncoder) start() {
+	if !e.written {
+		e.w.WriteHeader(http.StatusOK)
+		e.written = true
+	}
+}
+
+func (e *exportEncoder) encode(record []string, value any) error {
+	e.start()
+	if e.csv != nil {
+		return e.csv.Write(record)
+	}
+	return e.json.Encode(value)
+}
+
+// finish writes the csv header of an empty export
+func (e *exportEncoder) finish() error {
+	e.start()
+	return e.flush()
+}
+
+func (e *exportEncoder) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(e.w).Flush()
+}
+
+// failExport reports an error as a problem when nothing was streamed yet. Once rows
+// have been sent the status cannot change, the response is cut short instead so
+// that the client sees an incomplete transfer
+func failExport(w http.ResponseWriter, e *exportEncoder, logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	if !e.written {
+		w.Header().Del("Content-Disposition")
+		writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+var mappingExportHeader = []string{
+	"shortUrlId", "longUrl", "title", "createdAt", "createdBy", "visits", "botVisits",
+	"redirectStatus", "passwordProtected", "linkStatus", "statusChangedAt",
+}
+
+// mappingExportRow is the admin view of a mapping together with its owner
+type mappingExportRow struct {
+	linkSummary
+	CreatedBy string `json:"createdBy"`
+}
+
+func (row mappingExportRow) csvRecord() []string {
+	statusChangedAt := ""
+	if row.StatusChangedAt != nil {
+		statusChangedAt = row.StatusChangedAt.Format(time.RFC3339)
+	}
+	return []string{
+		row.ShortUrlId,
+		csvCell(row.LongUrl),
+		csvCell(row.Title),
+		row.CreatedAt.Format(time.RFC3339),
+		csvCell(row.CreatedBy),
+		strconv.Itoa(int(row.Visits)),
+		strconv.Itoa(int(row.BotVisits)),
+		strconv.Itoa(int(row.RedirectStatus)),
+		strconv.FormatBool(row.PasswordProtected),
+		row.LinkStatus,
+		statusChangedAt,
+	}
+}
+
+// exportMappingsHandlerFactory streams every mapping, optionally only the
+// mappings of one owner or with one status. Owners are the audit actors that
+// created the mappings
+func exportMappingsHandlerFactory(pool *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		query := r.URL.Query()
+		format, err := parseExportFormat(query)
+		if err != nil {
+			var problem *util.Problem
+			errors.As(err, &problem)
+			util.WriteProblem(w, problem)
+			return
+		}
+		owner := pgtype.Text{String: query.Get("owner"), Valid: query.Get("owner") != ""}
+		status := pgtype.Text{String: query.Get("status"), Valid: query.Get("status") != ""}
+		switch status.String {
+		case "", MAPPING_STATUS_ACTIVE, MAPPING_STATUS_DISABLED, MAPPING_STATUS_QUARANTINED:
+		default:
+			writeProblem(w, http.StatusBadRequest, fmt.Sprintf(
+				"invalid status: %q, must be one of %s, %s or %s",
+				status.String, MAPPING_STATUS_ACTIVE, MAPPING_STATUS_DISABLED, MAPPING_STATUS_QUARANTINED,
+			))
+			return
+		}
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the export handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+
+		encoder := newExportEncoder(w, format, "mappings", mappingExportHeader)
+		err = streamCursor(r.Context(), conn, exportMappingsQuery, []any{owner, status}, func(batch []db.UrlMapping) error {
+			for _, record := range batch {
+				row := mappingExportRow{linkSummary: linkSummaryFromRecord(record), CreatedBy: record.CreatedBy}
+				if err := encoder.encode(row.csvRecord(), &row); err != nil {
+					return err
+				}
+			}
+			return encoder.flush()
+		})
+		if err == nil {
+			err = encoder.finish()
+		}
+		if err != nil {
+			failExport(w, encoder, logger, "unable to export mappings", err)
+		}
+	}
+}
+
+var clickExportHeader = []string{"shortUrlId", "occurredAt", "referrer", "userAgent", "bot", "botReason"}
+
+type clickExportRow struct {
+	ShortUrlId string    `json:"shortUrlId"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Referrer   string    `json:"referrer"`
+	UserAgent  string    `json:"userAgent"`
+	Bot        bool      `json:"bot"`
+	BotReason  string    `json:"botReason"`
+}
+
+func (row clickExportRow) csvRecord() []string {
+	return []string{
+		row.ShortUrlId,
+		row.OccurredAt.Format(time.RFC3339Nano),
+		csvCell(row.Referrer),
+		csvCell(row.UserAgent),
+		strconv.FormatBool(row.Bot),
+		row.BotReason,
+	}
+}
+
+// exportClicksHandlerFactory streams the raw click events of a mapping. Raw events
+// are only kept for the retention window, older clicks are only in the rollups
+func exportClicksHandlerFactory(pool *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		shortUrlId := r.PathValue("shortUrlId")
+		if !isValidShortUrlId(shortUrlId) {
+			writeInvalidShortUrlId(w, shortUrlId)
+			return
+		}
+		query := r.URL.Query()
+		format, err := parseExportFormat(query)
+		if err != nil {
+			var problem *util.Problem
+			errors.As(err, &problem)
+			util.WriteProblem(w, problem)
+			return
+		}
+		var since, until pgtype.Timestamp
+		for name, target := range map[string]*pgtype.Timestamp{"since": &since, "until": &until} {
+			raw := query.Get(name)
+			if raw == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeProblem(w, http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp", name))
+				return
+			}
+			*target = pgtype.Timestamp{Time: t.UTC(), Valid: true}
+		}
+		conn, err := pool.Acquire(r.Context())
+		if err != nil {
+			logger.Error("unable to get a connection from the pool in the export handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		defer conn.Release()
+		if _, err = db.New(conn).SelectMapping(r.Context(), shortUrlId); errors.Is(err, pgx.ErrNoRows) {
+			writeMappingNotFound(w, shortUrlId)
+			return
+		} else if err != nil {
+			logger.Error("database error encountered when selecting mapping", "error", err, "shortUrl", shortUrlId)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+
+		encoder := newExportEncoder(w, format, shortUrlId+"-clicks", clickExportHeader)
+		err = streamCursor(r.Context(), conn, exportClicksQuery, []any{shortUrlId, since, until}, func(batch []db.ClickEvent) error {
+			for _, event := range batch {
+				row := clickExportRow{
+					ShortUrlId: event.MappingID,
+					OccurredAt: event.OccurredAt.Time,
+					Referrer:   event.Referrer,
+					UserAgent:  event.UserAgent,
+					Bot:        event.IsBot,
+					BotReason:  event.BotReason,
+				}
+				if err := encoder.encode(row.csvRecord(), &row); err != nil {
+					return err
+				}
+			}
+			return encoder.flush()
+		})
+		if err == nil {
+			err = encoder.finish()
+		}
+		if err != nil {
+			failExport(w, encoder, logger, "unable to export click events", err)
+		}
+	}
+}
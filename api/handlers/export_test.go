@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"townsag/url_shortener/api/analytics"
+)
+
+func TestCsvCellEscapesFormulas(t *testing.T) {
+	for value, expected := range map[string]string{
+		"https://google.com": "https://google.com",
+		"=HYPERLINK(\"x\")":  "'=HYPERLINK(\"x\")",
+		"+1":                 "'+1",
+		"@SUM(A1)":           "'@SUM(A1)",
+		"":                   "",
+	} {
+		if escaped := csvCell(value); escaped != expected {
+			t.Errorf("csvCell(%q) = %q, expected %q", value, escaped, expected)
+		}
+	}
+}
+
+func TestExportMappingsAndClicks(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.HandleFunc("GET /api/mappings/export", exportMappingsHandlerFactory(pool))
+	testMux.HandleFunc("GET /api/mappings/{shortUrlId}/clicks/export", exportClicksHandlerFactory(pool))
+
+	// more mappings than fit into one fetch from the cursor
+	var shortUrlId string
+	for i := range EXPORT_FETCH_SIZE + 5 {
+		req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com/export", "title": "=cmd"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		var created createMappingResponseBody
+		if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+			t.Fatalf("failed to create short url %d: %v", i, err)
+		}
+		shortUrlId = *created.ShortUrl
+	}
+
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/mappings/export?format=csv&owner=anonymous", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("csv export returned status %d with content type %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse the csv export with %v", err)
+	}
+	if len(records) < EXPORT_FETCH_SIZE+6 || records[0][0] != "shortUrlId" {
+		t.Fatalf("csv export has %d records, expected a header and every mapping", len(records))
+	}
+	for _, record := range records[1:] {
+		if record[1] == "https://google.com/export" && record[2] != "'=cmd" {
+			t.Fatalf("title %q was not escaped", record[2])
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/mappings/export?format=jsonl&owner=admin", nil))
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("export for an owner without mappings returned status %d and %q", rr.Code, rr.Body.String())
+	}
+
+	store := &analytics.PostgresStore{Pool: pool}
+	err = store.WriteClicks(context.Background(), []analytics.ClickEvent{
+		{ShortUrlId: shortUrlId, OccurredAt: time.Now().UTC(), Referrer: "https://news.example.com"},
+		{ShortUrlId: shortUrlId, OccurredAt: time.Now().UTC(), Bot: true, BotReason: analytics.BotReasonHead},
+	})
+	if err != nil {
+		t.Fatalf("failed to write click events with %v", err)
+	}
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/mappings/"+shortUrlId+"/clicks/export?format=jsonl", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("click export returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	var rows []clickExportRow
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var row clickExportRow
+		if err = json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("failed to decode click export line %q with %v", scanner.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 2 || rows[0].Referrer != "https://news.example.com" || !rows[1].Bot || rows[1].BotReason != analytics.BotReasonHead {
+		t.Errorf("click export does not contain the written events: %+v", rows)
+	}
+
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/mappings/export?format=xlsx", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("export with an unknown format returned %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -22,19 +22,20 @@ func healthyHandlerFactory(conn pinger, dbr redisClient) http.HandlerFunc {
 		ctx, cancel := context.WithTimeout(r.Context(), time.Millisecond*500)
 		defer cancel()
 		if err := conn.Ping(ctx); err != nil {
-			http.Error(
-				w, 
-				fmt.Sprintf("unable to connect to database: %s", err), 
+			writeProblem(
+				w,
 				http.StatusServiceUnavailable,
+				fmt.Sprintf("unable to connect to database: %s", err),
 			)
 			return
 		} else if err := dbr.Ping(ctx).Err(); err != nil {
-			http.Error(
+			writeProblem(
 				w,
-				fmt.Sprintf("unable to connect to redis cache: %s", err),
 				http.StatusServiceUnavailable,
+				fmt.Sprintf("unable to connect to redis cache: %s", err),
 			)
 		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprint(w, "healthy")
 		}
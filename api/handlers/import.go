@@ -0,0 +1,556 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"townsag/url_shortener/api/blocklist"
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
+)
+
+const (
+	IMPORT_PROBLEM_CONFLICT string = "conflict"
+	IMPORT_PROBLEM_INVALID  string = "invalid"
+)
+
+// every batch is written in its own transaction, a failed import can be resumed by
+// running it again because rows that were already imported are left unchanged
+const IMPORT_BATCH_SIZE int = 500
+const MAX_IMPORT_PROBLEMS int = 1000
+const MAX_IMPORT_BYTES int64 = 64 << 20
+const MAX_IMPORT_LINE_BYTES int = 1 << 20
+
+// reservedShortUrlIds are routed to other handlers so a mapping with one of these
+// ids could never be reached
+var reservedShortUrlIds = map[string]bool{
+	"admin":    true,
+	"docs":     true,
+	"healthy":  true,
+	"mapping":  true,
+	"mappings": true,
+}
+
+func isReservedShortUrlId(id string) bool {
+	return reservedShortUrlIds[strings.ToLower(id)]
+}
+
+// importColumns maps the column names used by other shorteners to the fields of an
+// import row. Names are compared after normalizeColumn
+var importColumns = map[string]string{
+	"code":           "code",
+	"shorturlid":     "code",
+	"shortcode":      "code",
+	"shorturl":       "code",
+	"shortlink":      "code",
+	"keyword":        "code",
+	"slug":           "code",
+	"alias":          "code",
+	"backhalf":       "code",
+	"longurl":        "longUrl",
+	"url":            "longUrl",
+	"destination":    "longUrl",
+	"target":         "longUrl",
+	"originalurl":    "longUrl",
+	"longlink":       "longUrl",
+	"title":          "title",
+	"createdat":      "createdAt",
+	"created":        "createdAt",
+	"timestamp":      "createdAt",
+	"date":           "createdAt",
+	"visits":         "visits",
+	"clicks":         "visits",
+	"hits":           "visits",
+	"redirectstatus": "redirectStatus",
+}
+
+// normalizeColumn lowercases the name and drops everything but letters and digits
+// so that long_url, Long URL and longUrl are the same column
+func normalizeColumn(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// importRecord holds the known fields of one row of the source. err is set when
+// the row could not be parsed, it is reported without stopping the import
+type importRecord struct {
+	line   int
+	fields map[string]string
+	err    error
+}
+
+// importReader returns io.EOF after the last record, any other error stops the import
+type importReader interface {
+	next() (importRecord, error)
+}
+
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns []string
+}
+
+func newCsvImportReader(source io.Reader) (*csvImportReader, error) {
+	reader := csv.NewReader(source)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("unable to read the csv header: %s", err))
+	}
+	columns := make([]string, len(header))
+	found := map[string]bool{}
+	for i, name := range header {
+		// spreadsheets often start the file with a byte order mark
+		columns[i] = importColumns[normalizeColumn(strings.TrimPrefix(name, "\ufeff"))]
+		found[columns[i]] = true
+	}
+	if !found["code"] || !found["longUrl"] {
+		return nil, util.NewProblem(http.StatusBadRequest, "the csv header must name a code column and a longUrl column")
+	}
+	return &csvImportReader{reader: reader, columns: columns}, nil
+}
+
+func (c *csvImportReader) next() (importRecord, error) {
+	values, err := c.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return importRecord{}, util.NewProblem(http.StatusBadRequest, err.Error())
+		}
+		return importRecord{}, err
+	}
+	line, _ := c.reader.FieldPos(0)
+	record := importRecord{line: line, fields: map[string]string{}}
+	for i, value := range values {
+		if i < len(c.columns) && c.columns[i] != "" {
+			record.fields[c.columns[i]] = value
+		}
+	}
+	return record, nil
+}
+
+type jsonlImportReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newJsonlImportReader(source io.Reader) *jsonlImportReader {
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_IMPORT_LINE_BYTES)
+	return &jsonlImportReader{scanner: scanner}
+}
+
+func (j *jsonlImportReader) next() (importRecord, error) {
+	for j.scanner.Scan() {
+		j.line++
+		line := strings.TrimSpace(j.scanner.Text())
+		if line == "" {
+			continue
+		}
+		record := importRecord{line: j.line, fields: map[string]string{}}
+		var object map[string]any
+		if err := json.Unmarshal([]byte(line), &object); err != nil {
+			record.err = fmt.Errorf("invalid json: %w", err)
+			return record, nil
+		}
+		for key, value := range object {
+			field := importColumns[normalizeColumn(key)]
+			if field == "" {
+				continue
+			}
+			switch v := value.(type) {
+			case string:
+				record.fields[field] = v
+			case float64:
+				record.fields[field] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+		return record, nil
+	}
+	if err := j.scanner.Err(); err != nil {
+		return importRecord{}, err
+	}
+	return importRecord{}, io.EOF
+}
+
+func newImportReader(source io.Reader, format string) (importReader, error) {
+	if format == FORMAT_JSONL {
+		return newJsonlImportReader(source), nil
+	}
+	return newCsvImportReader(source)
+}
+
+// importCode accepts bare codes and the short links that some shorteners export
+// in place of the code, for example https://bit.ly/abc or bit.ly/abc
+func importCode(value string) string {
+	value = strings.TrimRight(strings.TrimSpace(value), "/")
+	if i := strings.LastIndex(value, "/"); i >= 0 {
+		return value[i+1:]
+	}
+	return value
+}
+
+// parseImportTime accepts RFC 3339, the datetime format of mysql based shorteners,
+// plain dates and unix timestamps in seconds
+func parseImportTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid createdAt: %q", value)
+}
+
+func parseImportRecord(record importRecord, guard *blocklist.Guard, owner string) (db.ImportMappingParams, error) {
+	params := db.ImportMappingParams{
+		ID:        importCode(record.fields["code"]),
+		LongUrl:   strings.TrimSpace(record.fields["longUrl"]),
+		Title:     strings.TrimSpace(record.fields["title"]),
+		CreatedBy: owner,
+		Visits:    pgtype.Int4{Int32: 0, Valid: true},
+	}
+	if !isValidShortUrlId(params.ID) {
+		return params, fmt.Errorf("invalid code: %q, must be 1 to %d characters long and include only [a-zA-Z0-9_-]", params.ID, MAX_ID_LENGTH)
+	}
+	if isReservedShortUrlId(params.ID) {
+		return params, fmt.Errorf("code %q is reserved", params.ID)
+	}
+	if err := validateLongUrl(params.LongUrl); err != nil {
+		return params, err
+	}
+	if verdict := guard.CheckBlocklist(params.LongUrl); verdict.Blocked {
+		return params, fmt.Errorf("the destination is blocked: %s", verdict.Reason)
+	}
+	if len(params.Title) > MAX_TITLE_LENGTH {
+		return params, fmt.Errorf("title must not be longer than %d bytes", MAX_TITLE_LENGTH)
+	}
+	var redirectStatus *int
+	if raw := record.fields["redirectStatus"]; raw != "" {
+		status, err := strconv.Atoi(raw)
+		if err != nil {
+			return params, fmt.Errorf("invalid redirectStatus: %q", raw)
+		}
+		redirectStatus = &status
+	}
+	status, err := validateRedirectStatus(redirectStatus)
+	if err != nil {
+		return params, err
+	}
+	params.RedirectStatus = int32(status)
+	if raw := record.fields["createdAt"]; raw != "" {
+		createdAt, err := parseImportTime(raw)
+		if err != nil {
+			return params, err
+		}
+		params.CreatedAt = pgtype.Timestamp{Time: createdAt, Valid: true}
+	}
+	if raw := record.fields["visits"]; raw != "" {
+		visits, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil || visits < 0 {
+			return params, fmt.Errorf("invalid visits: %q", raw)
+		}
+		params.Visits.Int32 = int32(visits)
+	}
+	return params, nil
+}
+
+// ImportOptions configures an import. Owner is stored as the creator of the
+// imported mappings so that they can be filtered in exports
+type ImportOptions struct {
+	Format string
+	Owner  string
+	DryRun bool
+}
+
+// ImportProblem is a row that was not imported. Line is the line of the row in
+// the source
+type ImportProblem struct {
+	Line            int    `json:"line"`
+	ShortUrlId      string `json:"shortUrlId,omitempty"`
+	Kind            string `json:"kind"`
+	Error           string `json:"error"`
+	ExistingLongUrl string `json:"existingLongUrl,omitempty"`
+}
+
+// ImportReport counts the outcome of every row. Rows whose code already exists with
+// the same long url are unchanged, rows whose code exists with a different long url
+// are conflicts. Only the first MAX_IMPORT_PROBLEMS problems are listed
+type ImportReport struct {
+	Rows      int             `json:"rows"`
+	Created   int             `json:"created"`
+	Unchanged int             `json:"unchanged"`
+	Conflicts int             `json:"conflicts"`
+	Invalid   int             `json:"invalid"`
+	DryRun    bool            `json:"dryRun"`
+	Problems  []ImportProblem `json:"problems"`
+}
+
+func (report *ImportReport) addProblem(problem ImportProblem) {
+	if problem.Kind == IMPORT_PROBLEM_CONFLICT {
+		report.Conflicts++
+	} else {
+		report.Invalid++
+	}
+	if len(report.Problems) < MAX_IMPORT_PROBLEMS {
+		report.Problems = append(report.Problems, problem)
+	}
+}
+
+type importRow struct {
+	line   int
+	params db.ImportMappingParams
+}
+
+// errImportDryRun rolls back the transaction of a batch in a dry run
+var errImportDryRun = errors.New("dry run")
+
+// writeImportBatch only adds the outcome of the batch to the report once its
+// transaction has been committed
+func writeImportBatch(
+	ctx context.Context,
+	pool *pgxpool.Pool,
+	batch []importRow,
+	options ImportOptions,
+	origin auditOrigin,
+	report *ImportReport,
+) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get a connection from the pool: %w", err)
+	}
+	defer conn.Release()
+	var outcome ImportReport
+	err = withTx(ctx, conn, func(queries *db.Queries) error {
+		outcome = ImportReport{}
+		for _, row := range batch {
+			record, err := queries.ImportMapping(ctx, row.params)
+			if errors.Is(err, pgx.ErrNoRows) {
+				existing, err := queries.SelectMapping(ctx, row.params.ID)
+				if err != nil {
+					return err
+				}
+				if existing.LongUrl == row.params.LongUrl {
+					outcome.Unchanged++
+					continue
+				}
+				outcome.addProblem(ImportProblem{
+					Line:            row.line,
+					ShortUrlId:      row.params.ID,
+					Kind:            IMPORT_PROBLEM_CONFLICT,
+					Error:           "the code is already mapped to a different long url",
+					ExistingLongUrl: existing.LongUrl,
+				})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			outcome.Created++
+			if err = recordAuditEventFrom(ctx, queries, origin, AUDIT_ACTION_CREATE, record.ID, nil, &record); err != nil {
+				return err
+			}
+		}
+		if options.DryRun {
+			return errImportDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errImportDryRun) {
+		return err
+	}
+	report.Created += outcome.Created
+	report.Unchanged += outcome.Unchanged
+	for _, problem := range outcome.Problems {
+		report.addProblem(problem)
+	}
+	return nil
+}
+
+// importMappings reads the source one batch at a time so that large files are
+// never held in memory. The report covers every row up to the first error
+func importMappings(
+	ctx context.Context,
+	pool *pgxpool.Pool,
+	guard *blocklist.Guard,
+	source io.Reader,
+	options ImportOptions,
+	origin auditOrigin,
+) (*ImportReport, error) {
+	report := &ImportReport{DryRun: options.DryRun, Problems: []ImportProblem{}}
+	if options.Owner == "" {
+		options.Owner = origin.actor
+	}
+	reader, err := newImportReader(source, options.Format)
+	if err != nil {
+		return report, err
+	}
+	batch := make([]importRow, 0, IMPORT_BATCH_SIZE)
+	for {
+		record, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Rows++
+		params, err := parseImportRecord(record, guard, options.Owner)
+		if record.err != nil {
+			err = record.err
+		}
+		if err != nil {
+			report.addProblem(ImportProblem{Line: record.line, ShortUrlId: params.ID, Kind: IMPORT_PROBLEM_INVALID, Error: importErrorMessage(err)})
+			continue
+		}
+		batch = append(batch, importRow{line: record.line, params: params})
+		if len(batch) == IMPORT_BATCH_SIZE {
+			if err = writeImportBatch(ctx, pool, batch, options, origin, report); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err = writeImportBatch(ctx, pool, batch, options, origin, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func importErrorMessage(err error) string {
+	var problem *util.Problem
+	if errors.As(err, &problem) {
+		return problem.Detail
+	}
+	return err.Error()
+}
+
+// ImportMappings is used by the import command, the created mappings are audited
+// as changes of the cli actor
+func ImportMappings(
+	ctx context.Context,
+	pool *pgxpool.Pool,
+	guard *blocklist.Guard,
+	source io.Reader,
+	options ImportOptions,
+) (*ImportReport, error) {
+	origin := auditOrigin{requestId: uuid.NewString(), actor: AUDIT_ACTOR_CLI}
+	return importMappings(ctx, pool, guard, source, options, origin)
+}
+
+type importMappingsResponseBody struct {
+	Msg    string `json:"message"`
+	Status int    `json:"status"`
+	*ImportReport
+}
+
+// importFormat uses the format query parameter and falls back to the content type
+// of the request body
+func importFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/x-ndjson", "application/jsonl":
+			format = FORMAT_JSONL
+		default:
+			format = FORMAT_CSV
+		}
+	}
+	if format != FORMAT_CSV && format != FORMAT_JSONL {
+		return "", util.NewProblem(http.StatusBadRequest, fmt.Sprintf("invalid format: %q, must be %s or %s", format, FORMAT_CSV, FORMAT_JSONL)).WithField("format")
+	}
+	return format, nil
+}
+
+// importMappingsHandlerFactory imports the mappings in the request body. The report
+// is returned for failed imports as well so that the client knows how far the
+// import got before it is run again
+func importMappingsHandlerFactory(pool *pgxpool.Pool, guard *blocklist.Guard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		format, err := importFormat(r)
+		if err != nil {
+			var problem *util.Problem
+			errors.As(err, &problem)
+			util.WriteProblem(w, problem)
+			return
+		}
+		options := ImportOptions{
+			Format: format,
+			Owner:  r.URL.Query().Get("owner"),
+			DryRun: r.URL.Query().Get("dryRun") == "true",
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_IMPORT_BYTES)
+		report, err := importMappings(r.Context(), pool, guard, r.Body, options, auditOriginFromRequest(r))
+
+		var problem *util.Problem
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case err == nil:
+		case errors.As(err, &problem):
+		case errors.As(err, &maxBytesErr):
+			problem = util.NewProblem(
+				http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("the import must not be larger than %d bytes", MAX_IMPORT_BYTES),
+			)
+		default:
+			logger.Error("import failed", "error", err, "rows", report.Rows)
+			problem = util.NewProblem(
+				http.StatusInternalServerError,
+				"the import failed, it can be run again to import the remaining rows",
+			)
+		}
+		logger.Info(
+			"imported mappings",
+			"rows", report.Rows,
+			"created", report.Created,
+			"unchanged", report.Unchanged,
+			"conflicts", report.Conflicts,
+			"invalid", report.Invalid,
+			"dryRun", report.DryRun,
+		)
+		// the report of a failed import is added to the problem
+		if problem != nil {
+			util.WriteProblemWith(w, problem, report)
+			return
+		}
+		response := importMappingsResponseBody{
+			Msg:          "successfully imported mappings",
+			Status:       http.StatusOK,
+			ImportReport: report,
+		}
+		if options.DryRun {
+			response.Msg = "successfully validated mappings"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.Status)
+		json.NewEncoder(w).Encode(&response)
+	}
+}
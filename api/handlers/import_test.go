@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImportRecords(t *testing.T) {
+	source := "\ufeffKeyword,URL,Title,Timestamp,Clicks\n" +
+		"legacy-link,https://google.com/a,First,2019-04-01 10:00:00,12\n" +
+		"https://old.example/x_1,https://google.com/b,,,\n" +
+		"admin,https://google.com/c,,,\n" +
+		"bad code,https://google.com/d,,,\n" +
+		"valid,javascript:alert(1),,,\n"
+	reader, err := newImportReader(strings.NewReader(source), FORMAT_CSV)
+	if err != nil {
+		t.Fatalf("reading the csv header failed with %v", err)
+	}
+	var ids []string
+	var failures []int
+	for {
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading a csv record failed with %v", err)
+		}
+		params, err := parseImportRecord(record, testGuard, "migration")
+		if err != nil {
+			failures = append(failures, record.line)
+			continue
+		}
+		ids = append(ids, params.ID)
+		if params.ID == "legacy-link" {
+			if params.Title != "First" || params.Visits.Int32 != 12 || params.CreatedBy != "migration" {
+				t.Errorf("fields of the first row were not imported: %+v", params)
+			}
+			if !params.CreatedAt.Time.Equal(time.Date(2019, 4, 1, 10, 0, 0, 0, time.UTC)) {
+				t.Errorf("createdAt of the first row is %v", params.CreatedAt.Time)
+			}
+		}
+	}
+	if strings.Join(ids, ",") != "legacy-link,x_1" {
+		t.Errorf("imported codes are %v, expected legacy-link and x_1", ids)
+	}
+	if len(failures) != 3 || failures[0] != 4 {
+		t.Errorf("invalid rows are on lines %v, expected 4, 5 and 6", failures)
+	}
+
+	if _, err = newImportReader(strings.NewReader("a,b\n1,2\n"), FORMAT_CSV); err == nil {
+		t.Errorf("a csv header without code and url columns was accepted")
+	}
+}
+
+func TestImportIsIdempotentAndReportsConflicts(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/admin/import", importMappingsHandlerFactory(pool, testGuard))
+
+	source := `{"code": "imported-1", "longUrl": "https://google.com/one"}
+{"code": "imported-2", "longUrl": "https://google.com/two", "clicks": 40}
+not json
+`
+	send := func(body string, query string) importMappingsResponseBody {
+		req := httptest.NewRequest("POST", "/api/admin/import"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		rr := httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+		var response importMappingsResponseBody
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("failed to decode import response with %v", err)
+		}
+		if rr.Code != http.StatusOK {
+			t.Fatalf("import returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+		}
+		return response
+	}
+
+	response := send(source, "?dryRun=true")
+	if response.Created != 2 || response.Invalid != 1 {
+		t.Errorf("dry run report is %+v", response.ImportReport)
+	}
+	response = send(source, "")
+	if response.Created != 2 || response.Invalid != 1 || len(response.Problems) != 1 || response.Problems[0].Line != 3 {
+		t.Errorf("first import report is %+v", response.ImportReport)
+	}
+	// importing the same rows again does not change anything, a changed url is a conflict
+	response = send(source+`{"code": "imported-1", "longUrl": "https://google.com/changed"}`+"\n", "")
+	if response.Created != 0 || response.Unchanged != 2 || response.Conflicts != 1 {
+		t.Errorf("second import report is %+v", response.ImportReport)
+	}
+	for _, problem := range response.Problems {
+		if problem.Kind == IMPORT_PROBLEM_CONFLICT && problem.ExistingLongUrl != "https://google.com/one" {
+			t.Errorf("conflict does not name the existing long url: %+v", problem)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	CACHE_RESULT_HIT   string = "hit"
+	CACHE_RESULT_MISS  string = "miss"
+	CACHE_RESULT_ERROR string = "error"
+)
+
+// instruments are created from the global meter provider before it is set up in
+// main, the global provider forwards them once the real provider is registered
+var meter metric.Meter = otel.Meter("handlers")
+
+// operationDurationBuckets are the bucket boundaries in seconds of the redis and
+// postgres duration histograms. The default boundaries of the sdk start at 5 and
+// are meant for milliseconds, every operation would land in the first bucket
+var operationDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+var (
+	cacheLookups           metric.Int64Counter
+	cacheOperationDuration metric.Float64Histogram
+	dbOperationDuration    metric.Float64Histogram
+	redirectOutcomes       metric.Int64Counter
+)
+
+func init() {
+	var err, instrumentErr error
+	cacheLookups, instrumentErr = meter.Int64Counter(
+		"cache.lookups",
+		metric.WithDescription("mapping lookups in the redis cache by result"),
+		metric.WithUnit("{lookup}"),
+	)
+	err = errors.Join(err, instrumentErr)
+	cacheOperationDuration, instrumentErr = meter.Float64Histogram(
+		"cache.operation.duration",
+		metric.WithDescription("duration of redis commands"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(operationDurationBuckets...),
+	)
+	err = errors.Join(err, instrumentErr)
+	dbOperationDuration, instrumentErr = meter.Float64Histogram(
+		"db.operation.duration",
+		metric.WithDescription("duration of postgres queries"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(operationDurationBuckets...),
+	)
+	err = errors.Join(err, instrumentErr)
+	redirectOutcomes, instrumentErr = meter.Int64Counter(
+		"redirects",
+		metric.WithDescription("responses of the redirect handler by status code"),
+		metric.WithUnit("{response}"),
+	)
+	err = errors.Join(err, instrumentErr)
+	// the instruments are still usable after an error, they just do not record
+	if err != nil {
+		otel.Handle(err)
+	}
+}
+
+func recordCacheLookup(ctx context.Context, result string) {
+	cacheLookups.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+// queryOperation names a query after its sqlc query name, for example
+// "-- name: SelectMapping :one", and otherwise after its first keyword
+func queryOperation(sql string) string {
+	sql = strings.TrimSpace(sql)
+	if rest, ok := strings.CutPrefix(sql, "-- name: "); ok {
+		if name, _, ok := strings.Cut(rest, " "); ok {
+			return name
+		}
+	}
+	keyword, _, _ := strings.Cut(sql, " ")
+	return strings.ToUpper(keyword)
+}
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	at        time.Time
+	operation string
+}
+
+// queryMetricsTracer records the duration of every query that goes through the pool
+type queryMetricsTracer struct{}
+
+func (queryMetricsTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, queryStart{at: time.Now(), operation: queryOperation(data.SQL)})
+}
+
+func (queryMetricsTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(queryStart)
+	if !ok {
+		return
+	}
+	// a query that finds no rows is not a failed operation
+	failed := data.Err != nil && !errors.Is(data.Err, pgx.ErrNoRows)
+	dbOperationDuration.Record(ctx, time.Since(start.at).Seconds(), metric.WithAttributes(
+		attribute.String("db.operation.name", start.operation),
+		attribute.Bool("error", failed),
+	))
+}
+
+// redisMetricsHook records the duration of every redis command
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		recordCacheOperation(ctx, cmd.Name(), start, err)
+		return err
+	}
+}
+
+func (redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		recordCacheOperation(ctx, "pipeline", start, err)
+		return err
+	}
+}
+
+func recordCacheOperation(ctx context.Context, operation string, start time.Time, err error) {
+	// redis.Nil only means that the key does not exist
+	failed := err != nil && !errors.Is(err, redis.Nil)
+	cacheOperationDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("db.operation.name", operation),
+		attribute.Bool("error", failed),
+	))
+}
+
+// RegisterPoolMetrics reports the statistics of the pool every time metrics are
+// collected. The wait duration is the total time spent waiting for a connection
+// because the pool had none available
+func RegisterPoolMetrics(pool *pgxpool.Pool) error {
+	connections, err := meter.Int64ObservableGauge(
+		"db.pool.connections",
+		metric.WithDescription("connections in the pool by state"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	maxConnections, err := meter.Int64ObservableGauge(
+		"db.pool.connections.max",
+		metric.WithDescription("maximum size of the pool"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	waitDuration, err := meter.Float64ObservableCounter(
+		"db.pool.acquire.wait_duration",
+		metric.WithDescription("time spent waiting for a connection because the pool was exhausted"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return err
+	}
+	waits, err := meter.Int64ObservableCounter(
+		"db.pool.acquire.waits",
+		metric.WithDescription("acquires that had to wait for a connection"),
+		metric.WithUnit("{acquire}"),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		stat := pool.Stat()
+		observer.ObserveInt64(connections, int64(stat.AcquiredConns()), metric.WithAttributes(attribute.String("state", "acquired")))
+		observer.ObserveInt64(connections, int64(stat.IdleConns()), metric.WithAttributes(attribute.String("state", "idle")))
+		observer.ObserveInt64(connections, int64(stat.ConstructingConns()), metric.WithAttributes(attribute.String("state", "constructing")))
+		observer.ObserveInt64(maxConnections, int64(stat.MaxConns()))
+		observer.ObserveFloat64(waitDuration, stat.EmptyAcquireWaitTime().Seconds())
+		observer.ObserveInt64(waits, stat.EmptyAcquireCount())
+		return nil
+	}, connections, maxConnections, waitDuration, waits)
+	return err
+}
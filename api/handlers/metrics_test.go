@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestQueryOperation(t *testing.T) {
+	for sql, expected := range map[string]string{
+		"-- name: SelectMapping :one\nSELECT * FROM url_mapping": "SelectMapping",
+		"begin":                                "BEGIN",
+		"FETCH FORWARD 500 FROM export_cursor": "FETCH",
+	} {
+		if operation := queryOperation(sql); operation != expected {
+			t.Errorf("queryOperation(%q) = %q, expected %q", sql, operation, expected)
+		}
+	}
+}
+
+// sumByAttribute adds up the data points of an int64 counter that have the attribute
+func sumByAttribute(rm metricdata.ResourceMetrics, name string, attr attribute.KeyValue) int64 {
+	var total int64
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if m.Name != name || !ok {
+				continue
+			}
+			for _, point := range sum.DataPoints {
+				if value, found := point.Attributes.Value(attr.Key); found && value == attr.Value {
+					total += point.Value
+				}
+			}
+		}
+	}
+	return total
+}
+
+func TestRedirectRecordsCacheAndOutcomeMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com/metrics"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	// the first redirect misses the cache and fills it, the second one hits it
+	for range 2 {
+		testMux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/"+*created.ShortUrl, nil))
+	}
+	testMux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/unknown-code", nil))
+
+	var rm metricdata.ResourceMetrics
+	if err = reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("failed to collect metrics with %v", err)
+	}
+	if hits := sumByAttribute(rm, "cache.lookups", attribute.String("result", CACHE_RESULT_HIT)); hits < 1 {
+		t.Errorf("recorded %d cache hits, expected at least 1", hits)
+	}
+	if misses := sumByAttribute(rm, "cache.lookups", attribute.String("result", CACHE_RESULT_MISS)); misses < 2 {
+		t.Errorf("recorded %d cache misses, expected at least 2", misses)
+	}
+	if found := sumByAttribute(rm, "redirects", attribute.Int("http.response.status_code", http.StatusFound)); found < 2 {
+		t.Errorf("recorded %d redirects, expected at least 2", found)
+	}
+	if notFound := sumByAttribute(rm, "redirects", attribute.Int("http.response.status_code", http.StatusNotFound)); notFound < 1 {
+		t.Errorf("recorded %d not found responses, expected at least 1", notFound)
+	}
+}
@@ -1,8 +1,35 @@
 package handlers
 
 import (
+	"github.com/exaring/otelpgx"
+	"github.com/jackc/pgx/v5/multitracer"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
 	"go.opentelemetry.io/otel"
-    "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var tracer trace.Tracer = otel.GetTracerProvider().Tracer("handlers")
\ No newline at end of file
+var tracer trace.Tracer = otel.GetTracerProvider().Tracer("handlers")
+
+// InstrumentPostgres must be called on the pool config after the tracer provider
+// was set up and before the pool is created. Every query and every acquire from
+// the pool gets a span named after the sqlc query, the query parameters are never
+// recorded
+func InstrumentPostgres(config *pgxpool.Config) {
+	config.ConnConfig.Tracer = multitracer.New(
+		otelpgx.NewTracer(
+			otelpgx.WithTrimSQLInSpanName(),
+			otelpgx.WithSpanNameFunc(queryOperation),
+		),
+		queryMetricsTracer{},
+	)
+}
+
+// InstrumentRedis adds a span for every redis command. The statements are not
+// recorded so that the cached destination urls stay out of the traces
+func InstrumentRedis(rdb *redis.Client) error {
+	rdb.AddHook(redisMetricsHook{})
+	return redisotel.InstrumentTracing(rdb, redisotel.WithDBStatement(false))
+}
+
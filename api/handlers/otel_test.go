@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRedirectHasCacheAndDatabaseLookupSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com/traces"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var created createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil || created.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+	// the first redirect falls back to the database, the second one is served by redis
+	for range 2 {
+		testMux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/"+*created.ShortUrl, nil))
+	}
+
+	var results []string
+	databaseLookups := 0
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "CacheLookup":
+			for _, attr := range span.Attributes() {
+				if attr.Key == attribute.Key("cache.result") {
+					results = append(results, attr.Value.AsString())
+				}
+			}
+		case "DatabaseLookup":
+			databaseLookups++
+		}
+	}
+	if strings.Join(results, ",") != CACHE_RESULT_MISS+","+CACHE_RESULT_HIT {
+		t.Errorf("cache lookup spans have the results %v, expected a miss and then a hit", results)
+	}
+	if databaseLookups != 1 {
+		t.Errorf("recorded %d database lookup spans, expected 1", databaseLookups)
+	}
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+
+	"townsag/url_shortener/api/db"
+	"townsag/url_shortener/api/util"
+)
+
+const MIN_PASSWORD_LENGTH int = 4
+
+// bcrypt only uses the first 72 bytes of a password, reject longer passwords
+// instead of silently ignoring the rest
+const MAX_PASSWORD_LENGTH int = 72
+
+// MAX_PASSWORD_ATTEMPTS is the number of wrong passwords a client can submit for
+// a mapping within PASSWORD_ATTEMPT_WINDOW before it is locked out
+const MAX_PASSWORD_ATTEMPTS int64 = 5
+const PASSWORD_ATTEMPT_WINDOW time.Duration = 15 * time.Minute
+
+// hashPassword validates the optional password from a create mapping request and
+// returns the value for the password_hash column
+func hashPassword(password *string) (pgtype.Text, error) {
+	if password == nil {
+		return pgtype.Text{}, nil
+	}
+	if len(*password) < MIN_PASSWORD_LENGTH || len(*password) > MAX_PASSWORD_LENGTH {
+		return pgtype.Text{}, util.NewProblem(http.StatusBadRequest, fmt.Sprintf(
+			"password must be between %d and %d bytes long",
+			MIN_PASSWORD_LENGTH, MAX_PASSWORD_LENGTH,
+		)).WithField("password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	if err != nil {
+		return pgtype.Text{}, fmt.Errorf("unable to hash password: %w", err)
+	}
+	return pgtype.Text{String: string(hash), Valid: true}, nil
+}
+
+type passwordPageData struct {
+	ShortUrlId string
+	Action     string
+	Error      string
+}
+
+func renderPasswordForm(w http.ResponseWriter, r *http.Request, logger *slog.Logger, status int, shortUrlId string, msg string) {
+	err := renderTemplate(w, status, "password.html", &passwordPageData{
+		ShortUrlId: shortUrlId,
+		// post the form back to the exact url that was requested so that the path
+		// suffix and query string are still available after the password is checked
+		Action: r.URL.RequestURI(),
+		Error:  msg,
+	})
+	if err != nil {
+		logger.Error("unable to render the password form", "error", err)
+	}
+}
+
+func passwordAttemptsKey(shortUrlId string, clientIP string) string {
+	return fmt.Sprintf("password_attempts:%s:%s", shortUrlId, clientIP)
+}
+
+// countPasswordAttempt records a password attempt and returns the number of
+// attempts the client has made within the attempt window. The counter is reset
+// when the client submits the correct password
+func countPasswordAttempt(ctx context.Context, rdb *redis.Client, key string) (int64, error) {
+	pipe := rdb.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	// NX only sets the expiry on the first attempt so the window is not extended
+	// by every wrong guess
+	pipe.ExpireNX(ctx, key, PASSWORD_ATTEMPT_WINDOW)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// selectPasswordHash reads the hash from the database, it is not part of the
+// cached mapping so that the cache never holds password hashes
+func selectPasswordHash(ctx context.Context, pool *pgxpool.Pool, shortUrlId string) (string, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errDatabaseUnavailable, err)
+	}
+	defer conn.Release()
+	hash, err := db.New(conn).SelectPasswordHash(ctx, shortUrlId)
+	if err != nil {
+		return "", err
+	}
+	return hash.String, nil
+}
+
+// unlockMapping handles a request for a password protected mapping. GET requests
+// are shown the password form. POST requests have their password checked and
+// unlockMapping returns true when the caller may redirect the client
+func unlockMapping(
+	w http.ResponseWriter,
+	r *http.Request,
+	logger *slog.Logger,
+	pool *pgxpool.Pool,
+	rdb *redis.Client,
+	shortUrlId string,
+) bool {
+	if r.Method != http.MethodPost {
+		renderPasswordForm(w, r, logger, http.StatusOK, shortUrlId, "")
+		return false
+	}
+	// the attempt is counted before the password is checked so that concurrent
+	// guesses cannot all pass the limit before any of them is recorded
+	key := passwordAttemptsKey(shortUrlId, util.ClientIP(r))
+	attempts, err := countPasswordAttempt(r.Context(), rdb, key)
+	if err != nil {
+		// fail closed, without the attempt counter we cannot limit guessing
+		logger.Error("unable to record password attempt in redis", "error", err)
+		writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+		return false
+	}
+	if attempts > MAX_PASSWORD_ATTEMPTS {
+		ttl, _ := rdb.TTL(r.Context(), key).Result()
+		w.Header().Set("Retry-After", strconv.Itoa(int(ttl.Seconds())))
+		renderPasswordForm(w, r, logger, http.StatusTooManyRequests, shortUrlId, "too many attempts, try again later")
+		return false
+	}
+	passwordHash, err := selectPasswordHash(r.Context(), pool, shortUrlId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeMappingNotFound(w, shortUrlId)
+		return false
+	}
+	if err != nil {
+		logger.Error("unable to read the password hash", "error", err, "shortUrl", shortUrlId)
+		writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	password := r.PostFormValue("password")
+	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	if err != nil {
+		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			logger.Error("unable to compare password hash", "error", err, "shortUrl", shortUrlId)
+		}
+		renderPasswordForm(w, r, logger, http.StatusUnauthorized, shortUrlId, "incorrect password")
+		return false
+	}
+	if err := rdb.Del(r.Context(), key).Err(); err != nil {
+		logger.Warn("unable to reset password attempts", "error", err)
+	}
+	return true
+}
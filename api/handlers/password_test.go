@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// createProtectedMapping creates a password protected mapping and returns its id
+func createProtectedMapping(t *testing.T, testMux *http.ServeMux, password string) string {
+	body := []byte(fmt.Sprintf(`{"longUrl": "https://example.com/preview", "password": %q}`, password))
+	req, err := http.NewRequest("POST", "/api/mapping", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("create mapping returned incorrect response code: expected: %d, received: %d", http.StatusOK, status)
+	}
+	var responseBody createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&responseBody); err != nil {
+		t.Fatalf("failed to decode create mapping response body with %v", err)
+	}
+	if responseBody.ShortUrl == nil {
+		t.Fatal("failed to create a short url")
+	}
+	return *responseBody.ShortUrl
+}
+
+func submitPassword(testMux *http.ServeMux, shortUrlId string, password string) *httptest.ResponseRecorder {
+	form := url.Values{"password": {password}}
+	req := httptest.NewRequest("POST", fmt.Sprintf("/api/%s", shortUrlId), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	return rr
+}
+
+func newPasswordTestMux(t *testing.T) *http.ServeMux {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("POST /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	return testMux
+}
+
+func TestAccessPasswordProtectedMapping(t *testing.T) {
+	testMux := newPasswordTestMux(t)
+	shortUrlId := createProtectedMapping(t, testMux, "hunter22")
+
+	// a GET request renders the password form instead of redirecting
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/%s", shortUrlId), nil)
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("password form returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Fatalf("password form returned incorrect content type: %s", contentType)
+	}
+	if location := rr.Header().Get("Location"); location != "" {
+		t.Fatalf("password protected mapping was redirected without a password to: %s", location)
+	}
+
+	rr = submitPassword(testMux, shortUrlId, "wrong password")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password returned incorrect status code: expected: %d, received: %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	rr = submitPassword(testMux, shortUrlId, "hunter22")
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("correct password returned incorrect status code: expected: %d, received: %d", http.StatusSeeOther, rr.Code)
+	}
+	if location := rr.Header().Get("Location"); location != "https://example.com/preview" {
+		t.Fatalf("received unexpected redirect location: expected: https://example.com/preview, received: %s", location)
+	}
+}
+
+func TestPasswordAttemptsAreLimited(t *testing.T) {
+	testMux := newPasswordTestMux(t)
+	shortUrlId := createProtectedMapping(t, testMux, "hunter22")
+
+	for range MAX_PASSWORD_ATTEMPTS {
+		submitPassword(testMux, shortUrlId, "wrong password")
+	}
+	// once the client is locked out even the correct password is rejected
+	rr := submitPassword(testMux, shortUrlId, "hunter22")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked out client received incorrect status code: expected: %d, received: %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatal("locked out client did not receive a Retry-After header")
+	}
+}
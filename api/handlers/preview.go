@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type previewPageData struct {
+	ShortUrlId        string
+	Title             string
+	LongUrl           string
+	Host              string
+	Secure            bool
+	PasswordProtected bool
+	ForwardsQuery     bool
+	CreatedAt         time.Time
+}
+
+// renderPreview shows where a short url leads instead of redirecting so that the
+// recipient of a link can inspect the destination before following it. The
+// destination of password protected mappings is not revealed. The title was
+// chosen by the creator of the link, the page labels it as such and leads with
+// the destination host so that a misleading title cannot hide where the link goes.
+// Mappings cached before the creation time was cached have a zero CreatedAt
+// which the page leaves out
+func renderPreview(w http.ResponseWriter, r *http.Request, logger *slog.Logger, shortUrlId string, mapping *cachedMapping) {
+	data := &previewPageData{
+		ShortUrlId:        shortUrlId,
+		Title:             mapping.Title,
+		PasswordProtected: mapping.PasswordProtected,
+		ForwardsQuery:     mapping.ForwardQuery,
+		CreatedAt:         mapping.CreatedAt.UTC(),
+	}
+	if !data.PasswordProtected {
+		data.LongUrl = mapping.LongUrl
+		if destination, err := url.Parse(mapping.LongUrl); err == nil {
+			data.Host = destination.Hostname()
+			data.Secure = destination.Scheme == "https"
+		}
+	}
+	if err := renderTemplate(w, http.StatusOK, "preview.html", data); err != nil {
+		logger.Error("unable to render the preview page", "error", err, "shortUrl", shortUrlId)
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderPreviewHidesProtectedDestination(t *testing.T) {
+	mapping := &cachedMapping{
+		LongUrl:           "https://example.com/internal-preview",
+		PasswordProtected: true,
+		CreatedAt:         time.Now(),
+	}
+	rr := httptest.NewRecorder()
+	renderPreview(rr, httptest.NewRequest("GET", "/api/abcd1234+", nil), slog.Default(), "abcd1234", mapping)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("preview returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), mapping.LongUrl) {
+		t.Fatal("preview of a password protected mapping revealed the destination")
+	}
+}
+
+func TestRenderPreviewLeadsWithTheHost(t *testing.T) {
+	// entries cached by older versions do not have a creation time
+	mapping := &cachedMapping{
+		LongUrl: "https://example.com/landing",
+		Title:   "Your bank account",
+	}
+	rr := httptest.NewRecorder()
+	renderPreview(rr, httptest.NewRequest("GET", "/api/abcd1234+", nil), slog.Default(), "abcd1234", mapping)
+
+	page := rr.Body.String()
+	if !strings.Contains(page, "This link goes to <strong>example.com</strong>") {
+		t.Error("preview does not show the destination host")
+	}
+	if !strings.Contains(page, "Description by the link creator") {
+		t.Error("preview does not label the title as the description of the creator")
+	}
+	if strings.Contains(page, "0001") {
+		t.Error("preview shows the zero creation time")
+	}
+}
+
+func TestAccessMappingPreview(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+
+	req := httptest.NewRequest(
+		"POST",
+		"/api/mapping",
+		strings.NewReader(`{"longUrl": "http://example.com/landing", "title": "Spring launch"}`),
+	)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var responseBody createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&responseBody); err != nil || responseBody.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/api/%s+", *responseBody.ShortUrl), nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("preview returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	if location := rr.Header().Get("Location"); location != "" {
+		t.Fatalf("preview redirected to: %s", location)
+	}
+	page := rr.Body.String()
+	for _, expected := range []string{"http://example.com/landing", "Spring launch", "does not use https"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("preview page does not contain %q", expected)
+		}
+	}
+}
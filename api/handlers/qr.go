@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/skip2/go-qrcode"
+
+	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
+)
+
+const (
+	DEFAULT_QR_SIZE   int = 256
+	MIN_QR_SIZE       int = 64
+	MAX_QR_SIZE       int = 2048
+	DEFAULT_QR_MARGIN int = 4
+	MAX_QR_MARGIN     int = 16
+)
+
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// qrOptions are parsed from the query parameters of a qr code request
+type qrOptions struct {
+	format     string
+	size       int
+	level      string
+	margin     int
+	foreground color.RGBA
+	background color.RGBA
+}
+
+func parseHexColor(value string) (color.RGBA, error) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) != 6 {
+		return color.RGBA{}, fmt.Errorf("color must be 6 hex digits")
+	}
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("color must be 6 hex digits")
+	}
+	return color.RGBA{R: decoded[0], G: decoded[1], B: decoded[2], A: 0xff}, nil
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func parseQrInt(query url.Values, name string, defaultValue int, min int, max int) (int, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min || value > max {
+		return 0, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("%s must be an integer between %d and %d", name, min, max)).WithField(name)
+	}
+	return value, nil
+}
+
+func parseQrOptions(query url.Values) (*qrOptions, error) {
+	options := &qrOptions{
+		format:     strings.ToLower(query.Get("format")),
+		level:      strings.ToUpper(query.Get("level")),
+		foreground: color.RGBA{A: 0xff},
+		background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+	if options.format == "" {
+		options.format = "png"
+	}
+	if options.format != "png" && options.format != "svg" {
+		return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("invalid format: %s, must be png or svg", options.format)).WithField("format")
+	}
+	if options.level == "" {
+		options.level = "M"
+	}
+	if _, ok := qrRecoveryLevels[options.level]; !ok {
+		return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("invalid level: %s, must be one of L, M, Q or H", options.level)).WithField("level")
+	}
+	var err error
+	options.size, err = parseQrInt(query, "size", DEFAULT_QR_SIZE, MIN_QR_SIZE, MAX_QR_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	options.margin, err = parseQrInt(query, "margin", DEFAULT_QR_MARGIN, 0, MAX_QR_MARGIN)
+	if err != nil {
+		return nil, err
+	}
+	for name, target := range map[string]*color.RGBA{"fg": &options.foreground, "bg": &options.background} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		*target, err = parseHexColor(raw)
+		if err != nil {
+			return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", name, err)).WithField(name)
+		}
+	}
+	return options, nil
+}
+
+// etag identifies a rendered qr code. The image is fully determined by the encoded
+// content and the options so the etag can be computed without rendering the image
+func (o *qrOptions) etag(content string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf(
+		"%s|%s|%d|%s|%d|%s|%s",
+		content, o.format, o.size, o.level, o.margin, hexColor(o.foreground), hexColor(o.background),
+	)))
+	return fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:16]))
+}
+
+// qrModules returns the modules of the qr code without the quiet zone, the quiet
+// zone is added while rendering so that its width can be configured
+func qrModules(content string, level string) ([][]bool, error) {
+	code, err := qrcode.New(content, qrRecoveryLevels[level])
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	return code.Bitmap(), nil
+}
+
+func renderQrPNG(modules [][]bool, o *qrOptions) ([]byte, error) {
+	width := len(modules) + 2*o.margin
+	scale := max(o.size/width, 1)
+	imageSize := max(o.size, width*scale)
+	// center the code when the image size is not a multiple of the module count
+	offset := (imageSize-width*scale)/2 + o.margin*scale
+
+	img := image.NewPaletted(
+		image.Rect(0, 0, imageSize, imageSize),
+		color.Palette{o.background, o.foreground},
+	)
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := range scale {
+				for dx := range scale {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func renderQrSVG(modules [][]bool, o *qrOptions) []byte {
+	width := len(modules) + 2*o.margin
+	var buf bytes.Buffer
+	fmt.Fprintf(
+		&buf,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		o.size, o.size, width, width,
+	)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="%s"/>`, width, width, hexColor(o.background))
+	fmt.Fprintf(&buf, `<path fill="%s" d="`, hexColor(o.foreground))
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+o.margin, y+o.margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// etagMatches reports whether an If-None-Match header matches the etag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func qrCodeHandlerFactory(pool *pgxpool.Pool, rdb *redis.Client, publicBaseUrl string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
+		shortUrlId := r.PathValue("shortUrlId")
+		if !isValidShortUrlId(shortUrlId) {
+			writeInvalidShortUrlId(w, shortUrlId)
+			return
+		}
+		options, err := parseQrOptions(r.URL.Query())
+		if err != nil {
+			var problem *util.Problem
+			errors.As(err, &problem)
+			util.WriteProblem(w, problem)
+			return
+		}
+		// only render qr codes for mappings that exist
+		_, err = lookupMapping(r.Context(), logger, pool, rdb, shortUrlId)
+		if errors.Is(err, errMappingNotFound) {
+			writeMappingNotFound(w, shortUrlId)
+			return
+		}
+		if errors.Is(err, errDatabaseUnavailable) {
+			logger.Error("unable to get a connection from the pool in the qr code handler", "error", err)
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		if err != nil {
+			logger.Error("database error encountered when querying for mapping", "error", err, "shortUrl", shortUrlId)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+
+		shortUrl, err := url.JoinPath(publicBaseUrl, "api", shortUrlId)
+		if err != nil {
+			logger.Error("unable to build the public short url", "error", err, "publicBaseUrl", publicBaseUrl)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		etag := options.etag(shortUrl)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		modules, err := qrModules(shortUrl, options.level)
+		if err != nil {
+			logger.Error("unable to encode qr code", "error", err, "shortUrl", shortUrlId)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		var body []byte
+		contentType := "image/png"
+		if options.format == "svg" {
+			contentType = "image/svg+xml"
+			body = renderQrSVG(modules, options)
+		} else {
+			body, err = renderQrPNG(modules, options)
+			if err != nil {
+				logger.Error("unable to render qr code png", "error", err, "shortUrl", shortUrlId)
+				writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseQrOptionsDefaults(t *testing.T) {
+	options, err := parseQrOptions(url.Values{})
+	if err != nil {
+		t.Fatalf("parseQrOptions returned an unexpected error: %v", err)
+	}
+	if options.format != "png" || options.size != DEFAULT_QR_SIZE || options.level != "M" || options.margin != DEFAULT_QR_MARGIN {
+		t.Fatalf("parseQrOptions returned unexpected defaults: %+v", options)
+	}
+}
+
+func TestParseQrOptionsInvalid(t *testing.T) {
+	for _, query := range []string{"format=gif", "size=10", "size=abc", "level=X", "margin=100", "fg=red", "bg=12345"} {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = parseQrOptions(values); err == nil {
+			t.Errorf("parseQrOptions(%s) expected an error, received nil", query)
+		}
+	}
+}
+
+func TestRenderQrPNGSize(t *testing.T) {
+	options, err := parseQrOptions(url.Values{"size": {"300"}, "margin": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := qrModules("http://localhost:8000/api/abcd1234", options.level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := renderQrPNG(modules, options)
+	if err != nil {
+		t.Fatalf("renderQrPNG returned an unexpected error: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("renderQrPNG returned an invalid png: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 300 || bounds.Dy() != 300 {
+		t.Fatalf("renderQrPNG returned the wrong image size: expected: 300x300, received: %dx%d", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestQrCodeEndpoint(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+	testMux.HandleFunc("GET /api/mapping/{shortUrlId}/qr", qrCodeHandlerFactory(pool, rdb, "https://jumbo.example"))
+
+	req := httptest.NewRequest("POST", "/api/mapping", strings.NewReader(`{"longUrl": "https://google.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	var responseBody createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&responseBody); err != nil || responseBody.ShortUrl == nil {
+		t.Fatalf("failed to create a short url: %v", err)
+	}
+
+	qrPath := fmt.Sprintf("/api/mapping/%s/qr?format=svg&fg=f06a2e", *responseBody.ShortUrl)
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", qrPath, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("qr code route returned incorrect status code: expected: %d, received: %d", http.StatusOK, rr.Code)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "image/svg+xml" {
+		t.Fatalf("qr code route returned incorrect content type: %s", contentType)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("qr code route did not return an ETag")
+	}
+
+	// a conditional request with the same etag is answered without a body
+	req = httptest.NewRequest("GET", qrPath, nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("conditional qr code request returned incorrect status code: expected: %d, received: %d", http.StatusNotModified, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/mapping/00000000/qr", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("qr code for an unbound short url returned incorrect status code: expected: %d, received: %d", http.StatusNotFound, rr.Code)
+	}
+}
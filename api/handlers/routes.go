@@ -6,6 +6,10 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"townsag/url_shortener/api/analytics"
+	"townsag/url_shortener/api/blocklist"
+	"townsag/url_shortener/api/middleware"
 )
 
 func AddRoutes(
@@ -13,12 +17,47 @@ func AddRoutes(
 	pool *pgxpool.Pool, 
 	rdb *redis.Client, 
 	filesystem http.FileSystem,
+	publicBaseUrl string,
+	guard *blocklist.Guard,
+	adminToken string,
+	clicks analytics.Recorder,
 ) {
+	// every admin route requires the admin bearer token
+	admin := func(next http.Handler) http.Handler {
+		return middleware.AdminAuthMiddleware(adminToken, next)
+	}
+
 	// The HandlerFunc type is just a function with an ServeHttp method defined on it that calls
 	// the function
 
 	mux.Handle("GET /api/healthy", otelhttp.WithRouteTag("GET /api/healthy", healthyHandlerFactory(pool, rdb)))
-	mux.Handle("GET /api/{shortUrlId}", otelhttp.WithRouteTag("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb)))
-	mux.Handle("POST /api/mapping", otelhttp.WithRouteTag("POST /api/mapping", createMappingHandlerFactory(pool)))
+	// the docs routes are more specific than the redirect pattern, docs is a reserved short url id
+	mux.Handle("GET /api/openapi.json", otelhttp.WithRouteTag("GET /api/openapi.json", openApiDocumentHandlerFactory()))
+	mux.Handle("GET /api/docs", otelhttp.WithRouteTag("GET /api/docs", docsPageHandlerFactory()))
+	mux.Handle("GET /api/{shortUrlId}", otelhttp.WithRouteTag("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, guard, clicks)))
+	mux.Handle("GET /api/{shortUrlId}/{suffix...}", otelhttp.WithRouteTag("GET /api/{shortUrlId}/{suffix...}", redirectToLongUrlHandlerFactory(pool, rdb, guard, clicks)))
+	// POST requests are redirected as well so that 307 and 308 mappings can preserve the
+	// request method. For password protected mappings POST is used to submit the password
+	mux.Handle("POST /api/{shortUrlId}", otelhttp.WithRouteTag("POST /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, guard, clicks)))
+	mux.Handle("POST /api/{shortUrlId}/{suffix...}", otelhttp.WithRouteTag("POST /api/{shortUrlId}/{suffix...}", redirectToLongUrlHandlerFactory(pool, rdb, guard, clicks)))
+	mux.Handle("POST /api/mapping", otelhttp.WithRouteTag("POST /api/mapping", createMappingHandlerFactory(pool, guard)))
+	mux.Handle("GET /api/mapping/{shortUrlId}/qr", otelhttp.WithRouteTag("GET /api/mapping/{shortUrlId}/qr", qrCodeHandlerFactory(pool, rdb, publicBaseUrl)))
+	// exports are more specific than the redirect patterns, so they take precedence for these paths
+	mux.Handle("GET /api/mappings/export", otelhttp.WithRouteTag("GET /api/mappings/export", admin(exportMappingsHandlerFactory(pool))))
+	mux.Handle("GET /api/mappings/{shortUrlId}/clicks/export", otelhttp.WithRouteTag("GET /api/mappings/{shortUrlId}/clicks/export", admin(exportClicksHandlerFactory(pool))))
+	mux.Handle("GET /api/admin/blocklist", otelhttp.WithRouteTag("GET /api/admin/blocklist", admin(listBlocklistHandlerFactory(guard.Blocklist))))
+	mux.Handle("POST /api/admin/blocklist", otelhttp.WithRouteTag("POST /api/admin/blocklist", admin(addBlocklistEntryHandlerFactory(pool, guard.Blocklist))))
+	mux.Handle("DELETE /api/admin/blocklist", otelhttp.WithRouteTag("DELETE /api/admin/blocklist", admin(removeBlocklistEntryHandlerFactory(pool, guard.Blocklist))))
+	mux.Handle("PUT /api/admin/mapping/{shortUrlId}/status", otelhttp.WithRouteTag("PUT /api/admin/mapping/{shortUrlId}/status", admin(updateMappingStatusHandlerFactory(pool, rdb))))
+	mux.Handle("DELETE /api/admin/mapping/{shortUrlId}", otelhttp.WithRouteTag("DELETE /api/admin/mapping/{shortUrlId}", admin(deleteMappingHandlerFactory(pool, rdb))))
+	mux.Handle("GET /api/admin/mapping/{shortUrlId}/clicks", otelhttp.WithRouteTag("GET /api/admin/mapping/{shortUrlId}/clicks", admin(mappingClicksHandlerFactory(pool, rdb))))
+	mux.Handle("POST /api/admin/import", otelhttp.WithRouteTag("POST /api/admin/import", admin(importMappingsHandlerFactory(pool, guard))))
+	mux.Handle("GET /api/admin/log-level", otelhttp.WithRouteTag("GET /api/admin/log-level", admin(getLogLevelHandlerFactory())))
+	mux.Handle("PUT /api/admin/log-level", otelhttp.WithRouteTag("PUT /api/admin/log-level", admin(updateLogLevelHandlerFactory())))
+	mux.Handle("GET /api/admin/audit", otelhttp.WithRouteTag("GET /api/admin/audit", admin(listAuditEventsHandlerFactory(pool))))
+	mux.Handle("GET /api/admin/stats", otelhttp.WithRouteTag("GET /api/admin/stats", admin(adminStatsHandlerFactory(pool, rdb, guard.Blocklist))))
+	mux.Handle("GET /api/admin/links/top", otelhttp.WithRouteTag("GET /api/admin/links/top", admin(adminListMappingsHandlerFactory(pool, listTopMappings))))
+	mux.Handle("GET /api/admin/links/recent", otelhttp.WithRouteTag("GET /api/admin/links/recent", admin(adminListMappingsHandlerFactory(pool, listRecentMappings))))
+	mux.Handle("GET /api/admin/links/inactive", otelhttp.WithRouteTag("GET /api/admin/links/inactive", admin(adminListMappingsHandlerFactory(pool, listInactiveMappings))))
 	mux.Handle("/", otelhttp.WithRouteTag("/", uiHandlersFactory(filesystem)))
 }
\ No newline at end of file
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+)
+
+// the html pages that are rendered by the api handlers are embedded in the binary
+// in the same way that the static ui files are embedded in main.go
+//
+//go:embed templates
+var templateFiles embed.FS
+
+var templates = template.Must(template.ParseFS(templateFiles, "templates/*.html"))
+
+func renderTemplate(w http.ResponseWriter, status int, name string, data any) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// these pages are rendered per mapping and should never be stored by shared caches
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	return templates.ExecuteTemplate(w, name, data)
+}
@@ -11,9 +11,16 @@ import (
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	tcredis "github.com/testcontainers/testcontainers-go/modules/redis"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"townsag/url_shortener/api/analytics"
+	"townsag/url_shortener/api/blocklist"
 )
 
 var (
+	// the blocklist of the test guard is shared by every test in the package, tests
+	// that add entries should only block domains that no other test uses
+	testGuard = blocklist.NewGuard(blocklist.New(), &blocklist.StubScanner{})
+	testClicks analytics.Recorder = analytics.NoopRecorder{}
 	testPool *pgxpool.Pool
 	pgContainer *postgres.PostgresContainer
 	setupOncePG sync.Once
@@ -6,16 +6,23 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 
 	// ^http://github.com/open-telemetry/opentelemetry-demo/blob/main/src/product-catalog/main.go#L37
 
+	"townsag/url_shortener/api/analytics"
+	"townsag/url_shortener/api/blocklist"
 	"townsag/url_shortener/api/db"
 	"townsag/url_shortener/api/middleware"
 
@@ -23,10 +30,92 @@ import (
 	"townsag/url_shortener/api/util"
 )
 
+// ID_LENGTH is the length of generated ids. Imported ids keep the code they had in
+// the previous shortener, they may be up to MAX_ID_LENGTH characters long
 const ID_LENGTH int = 8
+const MAX_ID_LENGTH int = 64
+
+var shortUrlIdPattern = regexp.MustCompile(fmt.Sprintf("^[a-zA-Z0-9_-]{1,%d}$", MAX_ID_LENGTH))
+
+const MAX_TITLE_LENGTH int = 200
+
+// DEFAULT_REDIRECT_STATUS is used when the client does not ask for a specific
+// redirect status code when creating a mapping
+const DEFAULT_REDIRECT_STATUS int = http.StatusFound
 
 type createMappingRequestBody struct {
-	LongUrl string `json:"longUrl"`
+	LongUrl        string            `json:"longUrl"`
+	RedirectStatus *int              `json:"redirectStatus,omitempty"`
+	ForwardQuery   bool              `json:"forwardQuery,omitempty"`
+	ForwardPath    bool              `json:"forwardPath,omitempty"`
+	UtmParams      map[string]string `json:"utmParams,omitempty"`
+	Password       *string           `json:"password,omitempty"`
+	Title          string            `json:"title,omitempty"`
+}
+
+// validateRedirectStatus only allows the redirect codes that make sense for a short
+// url. 301 and 308 are permanent and may be cached by browsers and crawlers, 302 and
+// 307 are temporary. 307 and 308 preserve the request method and body
+func validateRedirectStatus(status *int) (int, error) {
+	if status == nil {
+		return DEFAULT_REDIRECT_STATUS, nil
+	}
+	switch *status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return *status, nil
+	default:
+		return 0, util.NewProblem(http.StatusBadRequest, fmt.Sprintf(
+			"invalid redirectStatus: %d, must be one of %d, %d, %d or %d",
+			*status,
+			http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect,
+		)).WithField("redirectStatus")
+	}
+}
+
+// validateLongUrl only accepts absolute http and https urls. Other schemes such as
+// javascript: could not be matched against the domains in the blocklist
+func validateLongUrl(longUrl string) error {
+	parsed, err := url.Parse(longUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return util.NewProblem(http.StatusBadRequest, fmt.Sprintf("invalid longUrl: %q, must be an absolute http or https url", longUrl)).WithField("longUrl")
+	}
+	return nil
+}
+
+// mappingOptions holds the validated options of a create mapping request in the
+// form that they are stored in the database
+type mappingOptions struct {
+	redirectStatus int32
+	utmQuery       string
+	passwordHash   pgtype.Text
+}
+
+// validateMappingOptions returns a *util.Problem when the client sent
+// invalid options, any other error is a server error
+func validateMappingOptions(body *createMappingRequestBody) (*mappingOptions, error) {
+	if err := validateLongUrl(body.LongUrl); err != nil {
+		return nil, err
+	}
+	redirectStatus, err := validateRedirectStatus(body.RedirectStatus)
+	if err != nil {
+		return nil, err
+	}
+	utmQuery, err := validateUtmParams(body.UtmParams)
+	if err != nil {
+		return nil, err
+	}
+	if len(body.Title) > MAX_TITLE_LENGTH {
+		return nil, util.NewProblem(http.StatusBadRequest, fmt.Sprintf("title must not be longer than %d bytes", MAX_TITLE_LENGTH)).WithField("title")
+	}
+	passwordHash, err := hashPassword(body.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &mappingOptions{
+		redirectStatus: int32(redirectStatus),
+		utmQuery:       utmQuery,
+		passwordHash:   passwordHash,
+	}, nil
 }
 
 type createMappingResponseBody struct {
@@ -35,7 +124,7 @@ type createMappingResponseBody struct {
 	ShortUrl *string `json:"shortUrl,omitempty"`
 }
 
-func createMappingHandlerFactory(pool *pgxpool.Pool) http.HandlerFunc {
+func createMappingHandlerFactory(pool *pgxpool.Pool, guard *blocklist.Guard) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
 		parentSpan := trace.SpanFromContext(r.Context())
@@ -45,26 +134,48 @@ func createMappingHandlerFactory(pool *pgxpool.Pool) http.HandlerFunc {
 		if err != nil {
 			parentSpan.SetStatus(codes.Error, "decoding of the request body failed")
 			parentSpan.RecordError(err)
-			var mr *util.MalformedRequest
-			if errors.As(err, &mr) {
+			var problem *util.Problem
+			if errors.As(err, &problem) {
 				logger.Warn("client error encountered when validating request body", "error", err)
 				// errors.As expects that the second argument is a pointer to an interface
-				// this is why we have to us the address of mr. This is super odd right?
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(mr.Status)
-				json.NewEncoder(w).Encode(mr)
+				// this is why we have to us the address of problem. This is super odd right?
+				util.WriteProblem(w, problem)
 				return
 			} else {
 				logger.Error("server error encountered when decoding request body", "error", err)
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(&createMappingResponseBody{
-					Msg:    http.StatusText(http.StatusInternalServerError),
-					Status: http.StatusInternalServerError,
-				})
+				writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 				return
 			}
 		}
+		options, err := validateMappingOptions(&body)
+		var problem *util.Problem
+		if err != nil && !errors.As(err, &problem) {
+			logger.Error("server error encountered when validating mapping options", "error", err)
+			parentSpan.SetStatus(codes.Error, "validation of the request body failed")
+			parentSpan.RecordError(err)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if err != nil {
+			logger.Warn("client error encountered when validating mapping options", "error", err)
+			parentSpan.SetStatus(codes.Error, "validation of the request body failed")
+			parentSpan.RecordError(err)
+			util.WriteProblem(w, problem)
+			return
+		}
+		verdict, err := guard.Check(r.Context(), body.LongUrl)
+		if err != nil {
+			// fail open so that an outage of the reputation service does not stop
+			// all mappings from being created, the blocklist is still checked on
+			// every redirect
+			logger.Warn("unable to scan long url, creating the mapping anyway", "error", err)
+		}
+		if verdict.Blocked {
+			logger.Warn("refused to create a mapping for a blocked destination", "longUrl", body.LongUrl, "reason", verdict.Reason)
+			parentSpan.SetStatus(codes.Error, "the long url is blocked")
+			writeProblem(w, http.StatusForbidden, fmt.Sprintf("unable to shorten this url: %s", verdict.Reason))
+			return
+		}
 		// write the long url to the database with retry
 		ctx, writeLongUrlSpan := tracer.Start(r.Context(), "InsertMapping")
 		var conn *pgxpool.Conn 
@@ -74,16 +185,10 @@ func createMappingHandlerFactory(pool *pgxpool.Pool) http.HandlerFunc {
 				"unable to get a connection from the pool in the create mapping handler",
 				"error", err,
 			)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			json.NewEncoder(w).Encode(&redirectToLongUrlResponseBody{
-				Msg:    http.StatusText(http.StatusServiceUnavailable),
-				Status: http.StatusServiceUnavailable,
-			})
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
 			return
 		}
 		defer conn.Release()
-		queries := db.New(conn)
 		var resultId string
 		for i := range 3 {
 			ctx, attemptSpan := tracer.Start(ctx, fmt.Sprintf("attempt-%d", i))
@@ -96,10 +201,29 @@ func createMappingHandlerFactory(pool *pgxpool.Pool) http.HandlerFunc {
 				continue
 			}
 			params := db.InsertMappingParams{
-				ID:      tempResultId,
-				LongUrl: body.LongUrl,
+				ID:             tempResultId,
+				LongUrl:        body.LongUrl,
+				RedirectStatus: options.redirectStatus,
+				ForwardQuery:   body.ForwardQuery,
+				ForwardPath:    body.ForwardPath,
+				UtmQuery:       options.utmQuery,
+				PasswordHash:   options.passwordHash,
+				Title:          body.Title,
+				CreatedBy:      auditActor(r),
+			}
+			// the mapping and its audit event are written in one transaction
+			err = withTx(ctx, conn, func(queries *db.Queries) error {
+				record, err := queries.InsertMapping(ctx, params)
+				if err != nil {
+					return err
+				}
+				return recordAuditEvent(ctx, queries, r, AUDIT_ACTION_CREATE, record.ID, nil, &record)
+			})
+			if errors.Is(err, pgx.ErrNoRows) {
+				logger.Warn("tried to insert duplicate short url", "attempt", i)
+				attemptSpan.End()
+				continue
 			}
-			resultId, err = queries.InsertMapping(ctx, params)
 			if err != nil {
 				logger.Error("database error encountered when writing new long url", "error", err)
 				attemptSpan.SetStatus(codes.Error, "inserting the mapping into the database failed")
@@ -107,100 +231,101 @@ func createMappingHandlerFactory(pool *pgxpool.Pool) http.HandlerFunc {
 				attemptSpan.End()
 				continue
 			}
-			if resultId == "" {
-				logger.Warn("tried to insert duplicate short url", "attempt", i)
-				attemptSpan.End()
-				continue
-			}
+			resultId = tempResultId
 			attemptSpan.End()
 			break
 		}
 		writeLongUrlSpan.End()
-		// TODO: this should return a 500 error instead of a 200 error
-		var response createMappingResponseBody
 		if resultId == "" {
-			w.WriteHeader(http.StatusInternalServerError)
-			response = createMappingResponseBody{
-				Msg:    "failed to create short url because of internal server error",
-				Status: http.StatusInternalServerError,
-			}
-		} else {
-			w.WriteHeader(http.StatusOK)
-			response = createMappingResponseBody{
-				Msg:      "successfully created short url",
-				Status:   http.StatusOK,
-				ShortUrl: &resultId,
-			}
+			writeProblem(w, http.StatusInternalServerError, "failed to create short url because of internal server error")
+			return
+		}
+		response := createMappingResponseBody{
+			Msg:      "successfully created short url",
+			Status:   http.StatusOK,
+			ShortUrl: &resultId,
 		}
-		// return the generated short url
+		// return the generated short url, headers set after WriteHeader are ignored
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(response)
 		// TODO: log the error from Encode
 	}
 }
 
-type redirectToLongUrlResponseBody struct {
+
+func isValidShortUrlId(id string) bool {
+	return shortUrlIdPattern.MatchString(id)
+}
+
+// messageResponseBody is the json body with a message and a status code that
+// writeMessageResponse writes
+type messageResponseBody struct {
 	Msg    string `json:"message"`
 	Status int    `json:"status"`
 }
 
-func isValidShortUrlId(id string) bool {
-	r := regexp.MustCompile(fmt.Sprintf("^[a-zA-Z0-9]{%d}$", ID_LENGTH))
-	return r.MatchString(id)
+// writeMessageResponse is used for successful requests that only need to confirm
+// the change, errors are written with writeProblem
+func writeMessageResponse(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&messageResponseBody{
+		Msg:    msg,
+		Status: status,
+	})
 }
 
-func redirectToLongUrlHandlerFactory(pool *pgxpool.Pool, rdb *redis.Client) http.HandlerFunc {
+// writeProblem writes an error response without field errors
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	util.WriteProblem(w, util.NewProblem(status, detail))
+}
+
+func writeInvalidShortUrlId(w http.ResponseWriter, shortUrlId string) {
+	writeProblem(
+		w,
+		http.StatusBadRequest,
+		fmt.Sprintf("received invalid url mapping id: %s, must be 1 to %d characters long and include only [a-zA-Z0-9_-]", shortUrlId, MAX_ID_LENGTH),
+	)
+}
+
+func writeMappingNotFound(w http.ResponseWriter, shortUrlId string) {
+	writeProblem(w, http.StatusNotFound, fmt.Sprintf("could not find a mapping for shortUrlId: %s", shortUrlId))
+}
+
+func redirectToLongUrlHandlerFactory(
+	pool *pgxpool.Pool,
+	rdb *redis.Client,
+	guard *blocklist.Guard,
+	clicks analytics.Recorder,
+) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var logger *slog.Logger = middleware.GetLoggerFromContext(r.Context())
-		// parse the short url from the path
-		shortUrlId := r.PathValue("shortUrlId")
+		// count every response of the handler by its status code
+		recorder := middleware.NewResponseRecorder(w)
+		w = recorder
+		defer func() {
+			redirectOutcomes.Add(r.Context(), 1, metric.WithAttributes(attribute.Int("http.response.status_code", recorder.Status())))
+		}()
+		// parse the short url from the path, a trailing + asks for the preview page
+		// instead of the redirect
+		shortUrlId, preview := strings.CutSuffix(r.PathValue("shortUrlId"), "+")
 		// error handling for if the shortUrlId is not valid
 		if !isValidShortUrlId(shortUrlId) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(&redirectToLongUrlResponseBody{
-				Msg:    fmt.Sprintf("received invalid url mapping id: %s, must be %d characters long and include only [a-zA-Z0-9]", shortUrlId, ID_LENGTH),
-				Status: http.StatusBadRequest,
-			})
+			writeInvalidShortUrlId(w, shortUrlId)
 			return
 		}
-		// read the path mapping from the cache
-		longUrl, err := rdb.Get(r.Context(), shortUrlId).Result()
-		if err != nil {
-			if err != redis.Nil {
-				logger.Warn("error encountered when reading from redis cache", slog.Any("error", err))
-			}
-		} else {
-			http.Redirect(w, r, longUrl, http.StatusFound)
-		}
-		// on a cache miss, read the value from the database and write the value to the cache (write around caching)
-		// read the relevant record from the database
-		var conn *pgxpool.Conn 
-		conn, err = pool.Acquire(r.Context())
-		if err != nil {
+		mapping, err := lookupMapping(r.Context(), logger, pool, rdb, shortUrlId)
+		if errors.Is(err, errDatabaseUnavailable) {
 			logger.Error(
 				"unable to get a connection from the pool in the redirect handler",
 				"error", err,
 			)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			json.NewEncoder(w).Encode(&redirectToLongUrlResponseBody{
-				Msg:    http.StatusText(http.StatusServiceUnavailable),
-				Status: http.StatusServiceUnavailable,
-			})
+			writeProblem(w, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
 			return
 		}
-		defer conn.Release()
-		queries := db.New(conn)
-		var record db.UrlMapping
-		record, err = queries.SelectMapping(r.Context(), shortUrlId)
-		if err == pgx.ErrNoRows {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(&redirectToLongUrlResponseBody{
-				Msg:    fmt.Sprintf("could not find a mapping for shortUrlId: %s", shortUrlId),
-				Status: http.StatusNotFound,
-			})
+		if errors.Is(err, errMappingNotFound) {
+			writeMappingNotFound(w, shortUrlId)
 			return
 		}
 		if err != nil {
@@ -209,22 +334,52 @@ func redirectToLongUrlHandlerFactory(pool *pgxpool.Pool, rdb *redis.Client) http
 				"error", err,
 				"shortUrl", shortUrlId,
 			)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(&redirectToLongUrlResponseBody{
-				Msg:    http.StatusText(http.StatusInternalServerError),
-				Status: http.StatusInternalServerError,
-			})
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if mapping.Status != "" && mapping.Status != MAPPING_STATUS_ACTIVE {
+			writeProblem(w, mapping.StatusCode, inactiveMappingMessage(mapping))
+			return
+		}
+		// the blocklist is checked again on every redirect so that destinations that
+		// were blocked after the mapping was created stop working immediately
+		if verdict := guard.CheckBlocklist(mapping.LongUrl); verdict.Blocked {
+			logger.Warn("refused to redirect to a blocked destination", "shortUrl", shortUrlId, "reason", verdict.Reason)
+			writeProblem(w, http.StatusForbidden, "the destination of this short url has been blocked")
+			return
+		}
+		if preview {
+			renderPreview(w, r, logger, shortUrlId, mapping)
+			return
+		}
+		redirectStatus := mapping.RedirectStatus
+		if mapping.PasswordProtected {
+			if !unlockMapping(w, r, logger, pool, rdb, shortUrlId) {
+				return
+			}
+			// the client reached the destination by submitting the password form,
+			// see other makes the browser follow the redirect with a GET request
+			redirectStatus = http.StatusSeeOther
+		}
+		// the suffix path value is only set when the request matched the path
+		// passthrough route
+		destination, err := buildDestination(mapping, r.PathValue("suffix"), r.URL.Query())
+		if errors.Is(err, errMappingNotFound) {
+			writeMappingNotFound(w, shortUrlId)
 			return
 		}
-		// write the retrieved long url to the cache
-		// we use write aside caching so the url is only written to the cache on the
-		// read path
-		_, err = rdb.Set(r.Context(), shortUrlId, record.LongUrl, 0).Result()
 		if err != nil {
-			logger.Warn(fmt.Sprintf("error encountered when writing long url to redis cache: %v", err))
+			logger.Error("unable to build the redirect destination", "error", err, "shortUrl", shortUrlId)
+			writeProblem(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
 		}
-		// return a redirect to the long url associated with that short url
-		http.Redirect(w, r, record.LongUrl, http.StatusFound)
+		// the click is queued and written in the background so that recording it
+		// does not add a database write to every redirect
+		event := analytics.NewClickEvent(r, shortUrlId)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.Bool("click.bot", event.Bot))
+		clicks.Record(event)
+		// return a redirect to the long url associated with that short url using the
+		// redirect status code that was chosen when the mapping was created
+		http.Redirect(w, r, destination, redirectStatus)
 	}
 }
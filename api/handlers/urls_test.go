@@ -34,7 +34,7 @@ func TestCreateMappingHappyPath(t *testing.T) {
 	// 	t.Fatalf("failed to restore the postgres database to the empty checkpoint %s", err)
 	// }
 	// create a create mapping handler
-	handler := createMappingHandlerFactory(pool)
+	handler := createMappingHandlerFactory(pool, testGuard)
 	// create a request for the create mapping route
 	body := []byte(`{
 		"longUrl": "https://google.com"
@@ -83,8 +83,8 @@ func TestCreateAndAccessMapping(t *testing.T) {
 	}
 	
 	testMux := http.NewServeMux()
-	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb))
-	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool))
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
 
 	// for this test, assume that the create mapping call succeeds because failures of the
 	// create mapping path will be caught by the other test
@@ -136,7 +136,7 @@ func TestCreateAndAccessMapping(t *testing.T) {
 	// verify that the long url is now in the cache
 	// we use look aside caching so the long url is only written to the cache
 	// on the read path
-	longUrl, err := rdb.Get(context.Background(), *responseBody.ShortUrl).Result()
+	cached, err := readCachedMapping(context.Background(), rdb, *responseBody.ShortUrl)
 	if err != nil {
 		if err == redis.Nil {
 			t.Fatalf(
@@ -148,13 +148,98 @@ func TestCreateAndAccessMapping(t *testing.T) {
 		}
 		t.Fatalf("error encountered when accessing redis cache: %v", err)
 	}
-	if longUrl != "https://google.com" {
+	if cached.LongUrl != "https://google.com" {
 		t.Fatalf(
 			"retrieved a wrong value from the redis cache for a stored long url; expected: %s,  received: %s",
 			"https://google.com",
-			longUrl,
+			cached.LongUrl,
 		)
 	}
+	if cached.RedirectStatus != http.StatusFound {
+		t.Fatalf(
+			"retrieved a wrong redirect status from the redis cache; expected: %d, received: %d",
+			http.StatusFound,
+			cached.RedirectStatus,
+		)
+	}
+}
+
+func TestCreateAndAccessPermanentMapping(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+
+	body := []byte(`{"longUrl": "https://google.com", "redirectStatus": 308}`)
+	req, err := http.NewRequest("POST", "/api/mapping", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("create mapping returned incorrect response code: expected: %d, received: %d", http.StatusOK, status)
+	}
+	var responseBody createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&responseBody); err != nil {
+		t.Fatalf("failed to decode create mapping response body with %v", err)
+	}
+	if responseBody.ShortUrl == nil {
+		t.Fatal("failed to create a short url")
+	}
+
+	// access the mapping twice, the first request is served from the database and
+	// the second request is served from the cache
+	for _, source := range []string{"database", "cache"} {
+		req, err = http.NewRequest("GET", fmt.Sprintf("/api/%s", *responseBody.ShortUrl), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		testMux.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusPermanentRedirect {
+			t.Fatalf(
+				"redirect served from the %s returned incorrect status code: expected: %d, received: %d",
+				source,
+				http.StatusPermanentRedirect,
+				status,
+			)
+		}
+	}
+}
+
+func TestCreateMappingInvalidRedirectStatus(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := createMappingHandlerFactory(pool, testGuard)
+
+	body := []byte(`{"longUrl": "https://google.com", "redirectStatus": 200}`)
+	req, err := http.NewRequest("POST", "/api/mapping", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("handler returned incorrect status code: expected: %d, got: %d", http.StatusBadRequest, status)
+	}
 }
 
 func TestAccessUnboundShortUrl(t *testing.T) {
@@ -169,7 +254,7 @@ func TestAccessUnboundShortUrl(t *testing.T) {
 	}
 
 	testMux := http.NewServeMux()
-	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb))
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
 
 	req, err := http.NewRequest("GET", "/api/12345678", nil)
 	if err != nil {
@@ -185,8 +270,32 @@ func TestAccessUnboundShortUrl(t *testing.T) {
 }
 
 func TestCreateInvalidMapping(t *testing.T) {
-	// what makes a mapping invalid...?
-	// should I be checking that the LongUrl is correctly formed or still up?
+	// a mapping is invalid when the long url is not an absolute http or https url,
+	// we do not check whether the long url is still up
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := createMappingHandlerFactory(pool, testGuard)
+
+	for _, longUrl := range []string{"", "google.com", "javascript:alert(1)", "ftp://example.com/file"} {
+		body, err := json.Marshal(&createMappingRequestBody{LongUrl: longUrl})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/api/mapping", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned incorrect status code for long url %q: expected: %d, got: %d", longUrl, http.StatusBadRequest, status)
+		}
+	}
 }
 
 func TestAccessInvalidShortUrl(t *testing.T) {
@@ -200,7 +309,7 @@ func TestAccessInvalidShortUrl(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	handler := redirectToLongUrlHandlerFactory(pool, rdb)
+	handler := redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks)
 
 	req, err := http.NewRequest("GET", "/api/asdf", nil)
 	if err != nil {
@@ -213,4 +322,60 @@ func TestAccessInvalidShortUrl(t *testing.T) {
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Fatalf("handler returned incorrect status code: expected: %d, got: %d", http.StatusBadRequest, status)
 	}
-}
\ No newline at end of file
+}
+func TestAccessMappingWithPassthrough(t *testing.T) {
+	pool, err := setupPostgresContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rdb, err := setupRedisContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testMux := http.NewServeMux()
+	testMux.HandleFunc("GET /api/{shortUrlId}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("GET /api/{shortUrlId}/{suffix...}", redirectToLongUrlHandlerFactory(pool, rdb, testGuard, testClicks))
+	testMux.HandleFunc("POST /api/mapping", createMappingHandlerFactory(pool, testGuard))
+
+	body := []byte(`{
+		"longUrl": "https://example.com/base",
+		"forwardQuery": true,
+		"forwardPath": true,
+		"utmParams": {"utm_source": "newsletter"}
+	}`)
+	req, err := http.NewRequest("POST", "/api/mapping", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("create mapping returned incorrect response code: expected: %d, received: %d", http.StatusOK, status)
+	}
+	var responseBody createMappingResponseBody
+	if err = json.NewDecoder(rr.Body).Decode(&responseBody); err != nil {
+		t.Fatalf("failed to decode create mapping response body with %v", err)
+	}
+	if responseBody.ShortUrl == nil {
+		t.Fatal("failed to create a short url")
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("/api/%s/docs/page?ref=x", *responseBody.ShortUrl), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	testMux.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusFound {
+		t.Fatalf("redirect returned incorrect status code: expected: %d, received: %d", http.StatusFound, status)
+	}
+	expected := "https://example.com/base/docs/page?ref=x&utm_source=newsletter"
+	if location := rr.Result().Header.Get("Location"); location != expected {
+		t.Fatalf("received unexpected redirect location: expected: %s, received: %s", expected, location)
+	}
+}
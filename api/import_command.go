@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"townsag/url_shortener/api/handlers"
+)
+
+// runImport imports the mappings in a csv or jsonl file, - reads from stdin. The
+// report is written to stdout as json. Running the same import again only imports
+// the rows that are missing, so an interrupted import can simply be restarted
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "csv or jsonl, defaults to the extension of the file")
+	owner := flags.String("owner", "", "creator stored for the imported mappings, defaults to cli")
+	dryRun := flags.Bool("dry-run", false, "validate the file and report conflicts without importing")
+	flags.Usage = func() {
+		log.Printf("usage: %s import [flags] <file>", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = "csv"
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".jsonl" || ext == ".ndjson" {
+			*format = "jsonl"
+		}
+	}
+	if *format != "csv" && *format != "jsonl" {
+		log.Fatalf("invalid format: %q, must be csv or jsonl", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var source io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("unable to open %s: %s", path, err)
+		}
+		defer file.Close()
+		source = file
+	}
+	postgresConfig, err := getConfiguration()
+	if err != nil {
+		log.Fatalf("error parsing the database config: %s", err)
+	}
+	pool, err := createDBConnectionPool(ctx, postgresConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+	guard, err := createGuard(ctx, pool)
+	if err != nil {
+		log.Fatalf("failed to load the blocklist: %s", err)
+	}
+
+	report, err := handlers.ImportMappings(ctx, pool, guard, source, handlers.ImportOptions{
+		Format: *format,
+		Owner:  *owner,
+		DryRun: *dryRun,
+	})
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if err != nil {
+		log.Fatalf("import stopped after %d rows, run it again to import the remaining rows: %s", report.Rows, err)
+	}
+	log.Printf(
+		"imported %d rows: %d created, %d unchanged, %d conflicts, %d invalid",
+		report.Rows, report.Created, report.Unchanged, report.Conflicts, report.Invalid,
+	)
+}
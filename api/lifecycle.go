@@ -3,11 +3,19 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 
+	"townsag/url_shortener/api/analytics"
+	"townsag/url_shortener/api/blocklist"
+	"townsag/url_shortener/api/handlers"
+	"townsag/url_shortener/api/middleware"
 	"townsag/url_shortener/api/util"
 )
 
@@ -71,3 +79,332 @@ func createRedisConnection(ctx context.Context, config *redisConfig) (*redis.Cli
 	}
 	return rdb, nil
 }
+
+// connectToStores creates the postgres connection pool and the redis client that
+// are shared by the server and the worker, both are instrumented with metrics and traces
+func connectToStores(ctx context.Context) (*pgxpool.Pool, *redis.Client, error) {
+	postgresConfig, err := getConfiguration()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing the database config: %w", err)
+	}
+	handlers.InstrumentPostgres(postgresConfig)
+	pool, err := createDBConnectionPool(ctx, postgresConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = handlers.RegisterPoolMetrics(pool); err != nil {
+		pool.Close()
+		return nil, nil, fmt.Errorf("unable to register connection pool metrics: %w", err)
+	}
+	rdb, err := createRedisConnection(ctx, getRedisConfiguration())
+	if err != nil {
+		pool.Close()
+		return nil, nil, err
+	}
+	if err = handlers.InstrumentRedis(rdb); err != nil {
+		pool.Close()
+		rdb.Close()
+		return nil, nil, fmt.Errorf("unable to instrument the redis client: %w", err)
+	}
+	return pool, rdb, nil
+}
+
+// getPublicBaseUrl returns the scheme and host that clients use to reach the
+// service. It is used to build absolute short urls, for example in qr codes
+func getPublicBaseUrl() string {
+	return util.GetEnvWithDefault("PUBLIC_BASE_URL", "http://localhost:8000")
+}
+
+// getAdminToken returns the bearer token for the admin api, the admin api is
+// disabled when no token is configured
+func getAdminToken() string {
+	return util.GetEnvWithDefault("ADMIN_API_TOKEN", "")
+}
+
+// getClientIPConfiguration reads the header that the reverse proxy in front of the
+// service sets to the address of the client. The header is ignored unless the
+// request comes from one of TRUSTED_PROXIES
+func getClientIPConfiguration() (util.ClientIPConfig, error) {
+	config := util.ClientIPConfig{Header: util.GetEnvWithDefault("CLIENT_IP_HEADER", "")}
+	proxies, err := util.ParseTrustedProxies(util.GetEnvWithDefault("TRUSTED_PROXIES", ""))
+	if err != nil {
+		return config, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	config.TrustedProxies = proxies
+	if config.Header != "" && len(proxies) == 0 {
+		return config, fmt.Errorf("CLIENT_IP_HEADER is set but TRUSTED_PROXIES is empty")
+	}
+	return config, nil
+}
+
+// createGuard loads the blocklist from BLOCKLIST_FILE when it is set and adds the
+// entries that were stored through the admin api. There is no external
+// reputation service yet so urls are not scanned
+func createGuard(ctx context.Context, pool *pgxpool.Pool) (*blocklist.Guard, error) {
+	b := blocklist.New()
+	if path := util.GetEnvWithDefault("BLOCKLIST_FILE", ""); path != "" {
+		var err error
+		b, err = blocklist.LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("loaded %d blocklist entries from %s", len(b.Entries()), path)
+	}
+	syncer := blocklist.NewSyncer(pool, b, 0, middleware.BuildLogger())
+	if err := syncer.RunOnce(ctx); err != nil {
+		return nil, fmt.Errorf("unable to load the stored blocklist entries: %w", err)
+	}
+	return blocklist.NewGuard(b, blocklist.NoopScanner{}), nil
+}
+
+// startBlocklistSync reloads the stored blocklist entries every
+// BLOCKLIST_SYNC_INTERVAL in the background until the context is done so that
+// edits made on other instances are applied
+func startBlocklistSync(ctx context.Context, pool *pgxpool.Pool, b *blocklist.Blocklist) error {
+	rawInterval := util.GetEnvWithDefault("BLOCKLIST_SYNC_INTERVAL", "30s")
+	interval, err := time.ParseDuration(rawInterval)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("invalid BLOCKLIST_SYNC_INTERVAL: %q, must be a positive duration", rawInterval)
+	}
+	go blocklist.NewSyncer(pool, b, interval, middleware.BuildLogger()).Run(ctx)
+	return nil
+}
+
+// getClickPipelineConfiguration reads the click pipeline settings, settings that
+// are not set keep the defaults from analytics.DefaultConfig
+func getClickPipelineConfiguration() (analytics.Config, error) {
+	config := analytics.DefaultConfig()
+	var err error
+	for name, target := range map[string]*int{
+		"CLICK_QUEUE_SIZE": &config.QueueSize,
+		"CLICK_WORKERS":    &config.Workers,
+		"CLICK_BATCH_SIZE": &config.BatchSize,
+	} {
+		if raw := util.GetEnvWithDefault(name, ""); raw != "" {
+			if *target, err = strconv.Atoi(raw); err != nil {
+				return config, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	for name, target := range map[string]*time.Duration{
+		"CLICK_FLUSH_INTERVAL":  &config.FlushInterval,
+		"CLICK_WRITE_TIMEOUT":   &config.WriteTimeout,
+		"CLICK_ENQUEUE_TIMEOUT": &config.EnqueueTimeout,
+	} {
+		if raw := util.GetEnvWithDefault(name, ""); raw != "" {
+			if *target, err = time.ParseDuration(raw); err != nil {
+				return config, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	if raw := util.GetEnvWithDefault("CLICK_OVERFLOW_POLICY", ""); raw != "" {
+		config.Overflow = analytics.OverflowPolicy(raw)
+	}
+	return config, nil
+}
+
+// getLoggingConfiguration reads the log level, the comma separated outputs of
+// the logs, the outputs are stdout and otlp, and the sample rates of the access
+// log by route pattern
+func getLoggingConfiguration() (middleware.LogConfig, error) {
+	var config middleware.LogConfig
+	if err := config.Level.UnmarshalText([]byte(util.GetEnvWithDefault("LOG_LEVEL", "info"))); err != nil {
+		return config, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+	for _, output := range strings.Split(util.GetEnvWithDefault("LOG_OUTPUTS", middleware.LOG_OUTPUT_STDOUT), ",") {
+		switch strings.TrimSpace(output) {
+		case middleware.LOG_OUTPUT_STDOUT:
+			config.Stdout = true
+		case middleware.LOG_OUTPUT_OTLP:
+			config.Otlp = true
+		case "":
+		default:
+			return config, fmt.Errorf(
+				"invalid LOG_OUTPUTS entry: %q, must be %s or %s",
+				output, middleware.LOG_OUTPUT_STDOUT, middleware.LOG_OUTPUT_OTLP,
+			)
+		}
+	}
+	// the patterns contain spaces and braces but no commas or equal signs, for
+	// example "GET /api/{shortUrlId}=0.01,GET /api/{shortUrlId}/{suffix...}=0.01"
+	for _, entry := range strings.Split(util.GetEnvWithDefault("LOG_SAMPLE_RATES", ""), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		pattern, raw, ok := strings.Cut(entry, "=")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if !ok || err != nil || rate < 0 || rate > 1 {
+			return config, fmt.Errorf("invalid LOG_SAMPLE_RATES entry: %q, must be <route pattern>=<rate between 0 and 1>", entry)
+		}
+		if config.SampleRates == nil {
+			config.SampleRates = make(map[string]float64)
+		}
+		config.SampleRates[strings.TrimSpace(pattern)] = rate
+	}
+	return config, nil
+}
+
+const (
+	CLICK_BUFFER_MEMORY string = "memory"
+	CLICK_BUFFER_STREAM string = "stream"
+)
+
+// getClickBuffer returns where click events are buffered before they are written,
+// either in memory or in a redis stream
+func getClickBuffer() (string, error) {
+	buffer := util.GetEnvWithDefault("CLICK_BUFFER", CLICK_BUFFER_MEMORY)
+	if buffer != CLICK_BUFFER_MEMORY && buffer != CLICK_BUFFER_STREAM {
+		return "", fmt.Errorf("invalid CLICK_BUFFER: %q, must be %s or %s", buffer, CLICK_BUFFER_MEMORY, CLICK_BUFFER_STREAM)
+	}
+	return buffer, nil
+}
+
+// getClickStreamConfiguration reads the redis stream settings. The consumer name
+// defaults to the hostname so that every container joins the group as its own
+// consumer. Stream names must contain a colon, short url ids cannot, so that
+// evicting a cached mapping can never overwrite a stream
+func getClickStreamConfiguration() (analytics.StreamConfig, error) {
+	config := analytics.DefaultStreamConfig()
+	defaultStream := config.Stream
+	config.Stream = util.GetEnvWithDefault("CLICK_STREAM", config.Stream)
+	config.Group = util.GetEnvWithDefault("CLICK_STREAM_GROUP", config.Group)
+	if hostname, err := os.Hostname(); err == nil {
+		config.Consumer = hostname
+	}
+	config.Consumer = util.GetEnvWithDefault("CLICK_STREAM_CONSUMER", config.Consumer)
+	if raw := util.GetEnvWithDefault("CLICK_STREAM_MAX_LEN", ""); raw != "" {
+		maxLen, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid CLICK_STREAM_MAX_LEN: %w", err)
+		}
+		config.MaxLen = maxLen
+	}
+	if raw := util.GetEnvWithDefault("CLICK_STREAM_MIN_IDLE", ""); raw != "" {
+		minIdle, err := time.ParseDuration(raw)
+		if err != nil {
+			return config, fmt.Errorf("invalid CLICK_STREAM_MIN_IDLE: %w", err)
+		}
+		config.MinIdle = minIdle
+	}
+	if raw := util.GetEnvWithDefault("CLICK_STREAM_MAX_DELIVERIES", ""); raw != "" {
+		maxDeliveries, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || maxDeliveries < 1 {
+			return config, fmt.Errorf("invalid CLICK_STREAM_MAX_DELIVERIES: %q, must be a positive integer", raw)
+		}
+		config.MaxDeliveries = maxDeliveries
+	}
+	// the dead letter stream follows the name of the stream unless it is set
+	if config.Stream != defaultStream {
+		config.DeadLetterStream = config.Stream + ":dead_letter"
+	}
+	config.DeadLetterStream = util.GetEnvWithDefault("CLICK_STREAM_DEAD_LETTER", config.DeadLetterStream)
+	for name, stream := range map[string]string{
+		"CLICK_STREAM":             config.Stream,
+		"CLICK_STREAM_DEAD_LETTER": config.DeadLetterStream,
+	} {
+		if !strings.Contains(stream, ":") {
+			return config, fmt.Errorf("invalid %s: %q, must contain a colon so that it cannot collide with a short url id", name, stream)
+		}
+	}
+	return config, nil
+}
+
+// startRetentionJob deletes raw click events older than CLICK_RETENTION in the
+// background until the context is done. A retention of 0 keeps raw events forever
+func startRetentionJob(ctx context.Context, pool *pgxpool.Pool) error {
+	window, err := time.ParseDuration(util.GetEnvWithDefault("CLICK_RETENTION", "720h"))
+	if err != nil {
+		return fmt.Errorf("invalid CLICK_RETENTION: %w", err)
+	}
+	rawInterval := util.GetEnvWithDefault("CLICK_RETENTION_INTERVAL", "1h")
+	interval, err := time.ParseDuration(rawInterval)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("invalid CLICK_RETENTION_INTERVAL: %q, must be a positive duration", rawInterval)
+	}
+	if window <= 0 {
+		return nil
+	}
+	job, err := analytics.NewRetentionJob(pool, window, interval, middleware.BuildLogger())
+	if err != nil {
+		return err
+	}
+	go job.Run(ctx)
+	return nil
+}
+
+// newClickStore returns the store that click events are written to, the unique
+// visitor estimates are kept in redis next to the stream
+func newClickStore(pool *pgxpool.Pool, rdb *redis.Client) *analytics.PostgresStore {
+	return &analytics.PostgresStore{Pool: pool, Visitors: &analytics.UniqueVisitors{Client: rdb}}
+}
+
+// createClickRecorder starts recording click events with the buffer selected by
+// CLICK_BUFFER. The retention job runs wherever click events are written. The
+// returned function stops recording and waits until the events that are already
+// buffered in this process have been written
+func createClickRecorder(pool *pgxpool.Pool, rdb *redis.Client) (analytics.Recorder, func(context.Context) error, error) {
+	buffer, err := getClickBuffer()
+	if err != nil {
+		return nil, nil, err
+	}
+	store := newClickStore(pool, rdb)
+	// client addresses are replaced with visitor ids before events are buffered
+	hasher := analytics.NewVisitorHasher(rdb)
+	if buffer == CLICK_BUFFER_MEMORY {
+		config, err := getClickPipelineConfiguration()
+		if err != nil {
+			return nil, nil, err
+		}
+		pipeline, err := analytics.NewPipeline(store, config, middleware.BuildLogger())
+		if err != nil {
+			return nil, nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if err = startRetentionJob(ctx, pool); err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		stop := func(shutdownCtx context.Context) error {
+			cancel()
+			return pipeline.Shutdown(shutdownCtx)
+		}
+		return analytics.NewVisitorRecorder(pipeline, hasher, middleware.BuildLogger()), stop, nil
+	}
+
+	config, err := getClickStreamConfiguration()
+	if err != nil {
+		return nil, nil, err
+	}
+	streamRecorder, err := analytics.NewStreamRecorder(rdb, config, middleware.BuildLogger())
+	if err != nil {
+		return nil, nil, err
+	}
+	recorder := analytics.NewVisitorRecorder(streamRecorder, hasher, middleware.BuildLogger())
+	// the stream is consumed in process unless it is consumed by separate workers
+	if util.GetEnvWithDefault("CLICK_STREAM_IN_PROCESS_CONSUMER", "true") != "true" {
+		return recorder, func(context.Context) error { return nil }, nil
+	}
+	consumer, err := analytics.NewStreamConsumer(rdb, store, config, middleware.BuildLogger())
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = startRetentionJob(ctx, pool); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Run(ctx)
+	}()
+	stop := func(shutdownCtx context.Context) error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
+	}
+	return recorder, stop, nil
+}
@@ -3,30 +3,50 @@ package main
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
+	"townsag/url_shortener/api/analytics"
+	"townsag/url_shortener/api/blocklist"
 	"townsag/url_shortener/api/handlers"
 	"townsag/url_shortener/api/middleware"
+	"townsag/url_shortener/api/util"
 )
 
 //go:embed all:build
 var files embed.FS
 
-func newServer(pool *pgxpool.Pool, rdb *redis.Client, filesystem http.FileSystem) http.Handler {
+func newServer(
+	pool *pgxpool.Pool,
+	rdb *redis.Client,
+	filesystem http.FileSystem,
+	publicBaseUrl string,
+	guard *blocklist.Guard,
+	adminToken string,
+	clicks analytics.Recorder,
+) http.Handler {
 	mux := http.NewServeMux()
 	handlers.AddRoutes(
 		mux,
 		pool,
 		rdb,
 		filesystem,
+		publicBaseUrl,
+		guard,
+		adminToken,
+		clicks,
 	)
 
 	root_logger := middleware.BuildLogger()
@@ -47,35 +67,61 @@ func newServer(pool *pgxpool.Pool, rdb *redis.Client, filesystem http.FileSystem
 }
 
 func main() {
+	// the worker subcommand only consumes the click event stream, it is used to
+	// scale stream consumers independently of the http servers
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker()
+		return
+	}
+	// the import subcommand loads mappings exported from another shortener
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+	runServer()
+}
+
+func runServer() {
 	ctx := context.Background()
 
+	// the level and outputs of the loggers are set before any logger is built
+	logConfig, err := getLoggingConfiguration()
+	if err != nil {
+		log.Fatalf("error parsing the logging config: %s", err)
+	}
+	middleware.ConfigureLogging(logConfig)
+
 	// bootstrap the OTEL SDK
-	otelShutdown, err := setupOTelSDK(ctx)
+	otelShutdown, err := setupOTelSDK(ctx, logConfig.Otlp)
 	if err != nil {
 		log.Fatalf("failed to bootstrap OTEL SDK: %s", err)
 	}
 	defer otelShutdown(context.Background())
 	// TODO: do something with that error^
 
-	// create a connection to the postgres database server
-	var postgresConfig *pgxpool.Config 
-	postgresConfig, err = getConfiguration()
+	// client addresses are used for audit events, clicks and password attempts
+	clientIPConfig, err := getClientIPConfiguration()
 	if err != nil {
-		log.Fatalf("error parsing the database config: %s", err)
+		log.Fatalf("error parsing the client ip config: %s", err)
 	}
-	pool, err := createDBConnectionPool(ctx, postgresConfig)
+	util.ConfigureClientIP(clientIPConfig)
+
+	// create connections to the postgres and redis servers
+	pool, rdb, err := connectToStores(ctx)
 	if err != nil {
-		log.Fatalf("failed to create a database connection pool: %s", err)
+		log.Fatal(err)
 	}
 	defer pool.Close()
+	defer rdb.Close()
 
-	// create a connection to the redis server
-	var redisConfig *redisConfig = getRedisConfiguration()
-	rdb, err := createRedisConnection(ctx, redisConfig)
+	// load the blocklist of destinations that may not be shortened
+	guard, err := createGuard(ctx, pool)
 	if err != nil {
-		log.Fatalf("failed to create a redis connection: %s", err)
+		log.Fatalf("failed to load the blocklist: %s", err)
+	}
+	if err = startBlocklistSync(ctx, pool, guard.Blocklist); err != nil {
+		log.Fatalf("failed to start syncing the blocklist: %s", err)
 	}
-	defer rdb.Close()
 
 	// create a filesystem object
 	fsys, err := fs.Sub(files, "build")
@@ -84,13 +130,45 @@ func main() {
 	}
 	filesystem := http.FS(fsys)
 
+	// start recording click events in the background
+	clicks, stopClicks, err := createClickRecorder(pool, rdb)
+	if err != nil {
+		log.Fatalf("failed to start recording click events: %s", err)
+	}
+
 	// build the server with its routes
-	srv := newServer(pool, rdb, filesystem)
+	srv := newServer(pool, rdb, filesystem, getPublicBaseUrl(), guard, getAdminToken(), clicks)
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort("0.0.0.0", "8000"),
 		Handler: srv,
 	}
 
-	log.Println("listening on port 8000")
-	httpServer.ListenAndServe()
+	// stop gracefully on SIGINT and SIGTERM so that queued click events are written
+	// before the database pool is closed
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("listening on port 8000")
+		serverErr <- httpServer.ListenAndServe()
+	}()
+	select {
+	case err = <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("server stopped unexpectedly: %s", err)
+		}
+	case <-ctx.Done():
+		log.Println("shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	// stop accepting requests first so that no click is recorded after the
+	// pipeline is closed
+	if err = httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shut down the http server: %s", err)
+	}
+	if err = stopClicks(shutdownCtx); err != nil {
+		log.Printf("failed to flush queued click events: %s", err)
+	}
 }
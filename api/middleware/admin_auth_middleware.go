@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"townsag/url_shortener/api/util"
+)
+
+const adminKey contextKey = contextKey("admin")
+
+func writeAdminAuthError(w http.ResponseWriter, status int, msg string) {
+	util.WriteProblem(w, util.NewProblem(status, msg))
+}
+
+// AdminAuthMiddleware only lets requests through that carry the admin token as a
+// bearer token. When no token is configured the admin api is disabled entirely
+func AdminAuthMiddleware(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeAdminAuthError(w, http.StatusNotFound, "the admin api is disabled")
+			return
+		}
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		// compare in constant time so the token cannot be guessed byte by byte
+		// from response timings
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeAdminAuthError(w, http.StatusUnauthorized, "a valid admin bearer token is required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminKey, true)))
+	})
+}
+
+// IsAdminRequest reports whether the request was authenticated by AdminAuthMiddleware
+func IsAdminRequest(ctx context.Context) bool {
+	isAdmin, _ := ctx.Value(adminKey).(bool)
+	return isAdmin
+}
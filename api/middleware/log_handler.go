@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	LOG_OUTPUT_STDOUT string = "stdout"
+	LOG_OUTPUT_OTLP   string = "otlp"
+)
+
+// LogConfig selects where log records are written and the minimum level of
+// the records. The otlp output sends records to the global otel logger provider.
+// SampleRates maps route patterns to the fraction of their successful requests
+// that get an access log line
+type LogConfig struct {
+	Level       slog.Level
+	Stdout      bool
+	Otlp        bool
+	SampleRates map[string]float64
+}
+
+// logLevel is shared by every logger so that changing it affects loggers that
+// were already built
+var logLevel = new(slog.LevelVar)
+
+var logConfig = LogConfig{Level: slog.LevelInfo, Stdout: true}
+
+// ConfigureLogging must be called before the first logger is built, the level
+// can be changed later through LogLevel
+func ConfigureLogging(config LogConfig) {
+	logConfig = config
+	logLevel.Set(config.Level)
+}
+
+// LogLevel returns the level that is used by every logger built by BuildLogger
+func LogLevel() *slog.LevelVar {
+	return logLevel
+}
+
+// traceHandler adds the ids of the span in the context of a record to the record
+// so that the log lines of a request can be found from its trace and the other
+// way around. The otlp output does not need it, the bridge reads the span itself
+type traceHandler struct {
+	next slog.Handler
+}
+
+func (h traceHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if spanContext.IsValid() {
+		record = record.Clone()
+		record.AddAttrs(
+			slog.String("trace_id", spanContext.TraceID().String()),
+			slog.String("span_id", spanContext.SpanID().String()),
+		)
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{next: h.next.WithGroup(name)}
+}
+
+// fanoutHandler passes every record that is at least at the configured level
+// to each of its outputs
+type fanoutHandler struct {
+	level   slog.Leveler
+	outputs []slog.Handler
+}
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level < h.level.Level() {
+		return false
+	}
+	for _, output := range h.outputs {
+		if output.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, record slog.Record) error {
+	var err error
+	for _, output := range h.outputs {
+		if output.Enabled(ctx, record.Level) {
+			err = errors.Join(err, output.Handle(ctx, record.Clone()))
+		}
+	}
+	return err
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	outputs := make([]slog.Handler, len(h.outputs))
+	for i, output := range h.outputs {
+		outputs[i] = output.WithAttrs(attrs)
+	}
+	return fanoutHandler{level: h.level, outputs: outputs}
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	outputs := make([]slog.Handler, len(h.outputs))
+	for i, output := range h.outputs {
+		outputs[i] = output.WithGroup(name)
+	}
+	return fanoutHandler{level: h.level, outputs: outputs}
+}
+
+// requestHandler falls back to the span of the request for records that are
+// logged without a context, handlers mostly call logger.Info instead of
+// logger.InfoContext
+type requestHandler struct {
+	next slog.Handler
+	ctx  context.Context
+}
+
+func (h requestHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h requestHandler) Handle(ctx context.Context, record slog.Record) error {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, trace.SpanContextFromContext(h.ctx))
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h requestHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestHandler{next: h.next.WithAttrs(attrs), ctx: h.ctx}
+}
+
+func (h requestHandler) WithGroup(name string) slog.Handler {
+	return requestHandler{next: h.next.WithGroup(name), ctx: h.ctx}
+}
+
+// newLogHandler writes json lines to stdout and records to the otel logger
+// provider depending on the log config
+func newLogHandler(config LogConfig) slog.Handler {
+	var outputs []slog.Handler
+	if config.Stdout {
+		outputs = append(outputs, traceHandler{next: slog.NewJSONHandler(
+			os.Stdout,
+			&slog.HandlerOptions{Level: logLevel},
+		)})
+	}
+	if config.Otlp {
+		outputs = append(outputs, otelslog.NewHandler("url-shortener"))
+	}
+	return fanoutHandler{level: logLevel, outputs: outputs}
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestLogRecordsHaveTraceIdsAndFollowTheLevel(t *testing.T) {
+	var buffer bytes.Buffer
+	level := new(slog.LevelVar)
+	logger := slog.New(fanoutHandler{
+		level:   level,
+		outputs: []slog.Handler{traceHandler{next: slog.NewJSONHandler(&buffer, nil)}},
+	})
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1, 2, 3},
+		SpanID:  trace.SpanID{4, 5, 6},
+	})
+	// records logged without a context fall back to the span of the request
+	logger = slog.New(requestHandler{
+		next: logger.Handler(),
+		ctx:  trace.ContextWithSpanContext(context.Background(), spanContext),
+	})
+
+	logger.Info("first")
+	var record map[string]any
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatalf("failed to decode the log record with %v", err)
+	}
+	if record["trace_id"] != spanContext.TraceID().String() || record["span_id"] != spanContext.SpanID().String() {
+		t.Errorf("log record does not have the ids of the span: %v", record)
+	}
+
+	buffer.Reset()
+	level.Set(slog.LevelWarn)
+	logger.Info("second")
+	if buffer.Len() != 0 {
+		t.Errorf("an info record was logged after raising the level to warn: %s", buffer.String())
+	}
+}
+
+func TestAccessLogIsSampledForSuccessfulRequestsOnly(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buffer, nil))
+	previous := logConfig
+	logConfig.SampleRates = map[string]float64{"GET /api/{shortUrlId}": 0}
+	defer func() { logConfig = previous }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/{shortUrlId}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("shortUrlId") == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("body"))
+	})
+	handler := LoggingMiddleware(logger, mux)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/found", nil))
+	if buffer.Len() != 0 {
+		t.Errorf("a successful request on a route with a sample rate of 0 was logged: %s", buffer.String())
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/missing", nil))
+	var record map[string]any
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatalf("failed to decode the access log line with %v", err)
+	}
+	if record["status"] != float64(http.StatusNotFound) || record["bytes"] != float64(4) || record["route"] != "GET /api/{shortUrlId}" {
+		t.Errorf("access log line is %v", record)
+	}
+}
@@ -2,21 +2,19 @@ package middleware
 
 import (
 	"log/slog"
-	"os"
+	"math/rand/v2"
 	"net/http"
 	"context"
+	"time"
 )
 
 type contextKey string
 const loggerKey contextKey = contextKey("logger")
 
+// BuildLogger creates a logger with the outputs and level set by ConfigureLogging.
+// Records that are logged with a context get the ids of its span
 func BuildLogger() *slog.Logger {
-	logger := slog.New(slog.NewJSONHandler(
-		os.Stdout, 
-		&slog.HandlerOptions{
-			Level: slog.LevelDebug,
-		},
-	))
+	logger := slog.New(newLogHandler(logConfig))
 	return logger
 }
 
@@ -25,7 +23,11 @@ func LoggingMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
 	// over the logger and the next middleware handler
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// create a bound logger with some request metadata
-		boundLogger := logger.With(
+		// records logged without a context get the span of the request
+		boundLogger := slog.New(requestHandler{
+			next: logger.Handler(),
+			ctx:  r.Context(),
+		}).With(
 			"method", r.Method,
 			"path", r.URL.Path,
 			requestIdHeader, IdFromRequest(r),
@@ -36,10 +38,38 @@ func LoggingMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
 		// log some metadata about the request
 		boundLogger.Debug("received request")
 		// add call the next handler
-		next.ServeHTTP(w, r)
+		start := time.Now()
+		recorder := NewResponseRecorder(w)
+		next.ServeHTTP(recorder, r)
+		logAccess(ctx, boundLogger, r, recorder, time.Since(start))
 	})
 }
 
+// logAccess writes one line per completed request. Successful requests on routes
+// with a sample rate are only logged with that probability, responses with an
+// error status are always logged
+func logAccess(ctx context.Context, logger *slog.Logger, r *http.Request, recorder *ResponseRecorder, duration time.Duration) {
+	status := recorder.Status()
+	level := slog.LevelInfo
+	switch {
+	case status >= http.StatusInternalServerError:
+		level = slog.LevelError
+	case status >= http.StatusBadRequest:
+		level = slog.LevelWarn
+	default:
+		// the mux sets the pattern of the matched route on the request
+		if rate, ok := logConfig.SampleRates[r.Pattern]; ok && rand.Float64() >= rate {
+			return
+		}
+	}
+	logger.Log(ctx, level, "completed request",
+		"route", r.Pattern,
+		"status", status,
+		"bytes", recorder.Bytes(),
+		"duration_ms", float64(duration.Microseconds())/1000,
+	)
+}
+
 func GetLoggerFromContext(ctx context.Context) *slog.Logger {
 	logger, ok := ctx.Value(loggerKey).(*slog.Logger)
 	if !ok {
@@ -1,11 +1,32 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
+	"regexp"
+
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"townsag/url_shortener/api/util"
 )
 
-var requestIdHeader string = "X-Request-ID"
+var requestIdHeader string = util.REQUEST_ID_HEADER
+
+const requestIdKey contextKey = contextKey("requestId")
+
+// MAX_REQUEST_ID_LENGTH bounds client supplied ids, they end up in every log line
+// and in the audit log
+const MAX_REQUEST_ID_LENGTH int = 128
+
+// client supplied ids are kept when they are safe to log and to put in a header,
+// which covers uuids, trace ids and the ids of common load balancers
+var requestIdPattern = regexp.MustCompile(`^[a-zA-Z0-9._:@/+=-]+$`)
+
+func isValidRequestId(requestId string) bool {
+	return len(requestId) <= MAX_REQUEST_ID_LENGTH && requestIdPattern.MatchString(requestId)
+}
 
 func RequestIdMiddleware(next http.Handler) http.Handler {
 	// remember the pattern
@@ -17,19 +38,26 @@ func RequestIdMiddleware(next http.Handler) http.Handler {
 	// implements the required method for it to conform to the http.Handler interface
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		requestId := r.Header.Get(requestIdHeader)
-		if requestId == "" {
+		// invalid ids are replaced instead of rejected, the request itself is fine
+		if !isValidRequestId(requestId) {
 			requestId = uuid.New().String()
 			r.Header.Set(requestIdHeader, requestId)
 		}
-		next.ServeHTTP(w, r)
+		// the id is echoed so that clients can quote it when reporting a problem
+		w.Header().Set(requestIdHeader, requestId)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", requestId))
+		ctx := context.WithValue(r.Context(), requestIdKey, requestId)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-/*
-Still not sure if this is the right approach, I like the idea of encapsulating the
-logic of fetching the id inside of the middleware package but this might be unecissary?
-*/
-func IdFromRequest(r *http.Request) (string) {
-	requestId := r.Header.Get(requestIdHeader)
+// IdFromContext returns the id that RequestIdMiddleware assigned to the request,
+// it is empty outside of the middleware
+func IdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey).(string)
 	return requestId
-}
\ No newline at end of file
+}
+
+func IdFromRequest(r *http.Request) string {
+	return IdFromContext(r.Context())
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIdIsValidatedAndEchoed(t *testing.T) {
+	var seen string
+	handler := RequestIdMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = IdFromRequest(r)
+	}))
+	for _, test := range []struct {
+		provided string
+		kept     bool
+	}{
+		{provided: "f3b0c9e2-77d1-4a50-9b8e-1e4f3c2d1a00", kept: true},
+		{provided: "Root=1-67891233-abcdef012345678912345678", kept: true},
+		{provided: "", kept: false},
+		{provided: "contains spaces and <script>", kept: false},
+		{provided: strings.Repeat("a", MAX_REQUEST_ID_LENGTH+1), kept: false},
+	} {
+		req := httptest.NewRequest("GET", "/api/healthy", nil)
+		req.Header.Set("X-Request-ID", test.provided)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		echoed := rr.Header().Get("X-Request-ID")
+		if echoed != seen || !isValidRequestId(echoed) {
+			t.Errorf("request id %q was echoed as %q and stored as %q", test.provided, echoed, seen)
+		}
+		if (echoed == test.provided) != test.kept {
+			t.Errorf("request id %q was echoed as %q, expected it to be kept: %v", test.provided, echoed, test.kept)
+		}
+	}
+}
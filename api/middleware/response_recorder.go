@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// ResponseRecorder remembers the status code and the number of body bytes that
+// were written by a handler
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+func (rec *ResponseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *ResponseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush is needed by streaming handlers that check for http.Flusher directly,
+// http.ResponseController reaches the underlying writer through Unwrap
+func (rec *ResponseRecorder) Flush() {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Status returns the status code of the response, a handler that did not write
+// anything responds with 200
+func (rec *ResponseRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Bytes returns the number of bytes of the response body
+func (rec *ResponseRecorder) Bytes() int {
+	return rec.bytes
+}
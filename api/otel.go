@@ -3,26 +3,205 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
-	// "go.opentelemetry.io/otel/exporters/stdout/stdoutlog"
-	// "go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
-	// "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
-	// "go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/log/global"
 	"go.opentelemetry.io/otel/propagation"
-	// "go.opentelemetry.io/otel/sdk/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
 	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
+	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+
+	"townsag/url_shortener/api/util"
+)
+
+const SERVICE_NAME string = "url-shortener"
+
+const (
+	EXPORTER_OTLP       string = "otlp"
+	EXPORTER_CONSOLE    string = "console"
+	EXPORTER_PROMETHEUS string = "prometheus"
+	EXPORTER_NONE       string = "none"
 )
 
+const (
+	PROTOCOL_GRPC string = "grpc"
+	PROTOCOL_HTTP string = "http/protobuf"
+)
+
+// telemetryConfig is read from the standard OTEL_* environment variables. The
+// endpoint, headers, batch delay and metric export interval are not part of it,
+// the sdk and the otlp exporters read OTEL_EXPORTER_OTLP_ENDPOINT,
+// OTEL_BSP_SCHEDULE_DELAY and OTEL_METRIC_EXPORT_INTERVAL themselves
+type telemetryConfig struct {
+	tracesExporter   string
+	metricsExporters []string
+	protocol         string
+	sampler          trace.Sampler
+	resource         *resource.Resource
+	// prometheusAddr is where /metrics is served when the prometheus exporter is
+	// one of the metrics exporters
+	prometheusAddr string
+}
+
+// parseExporter accepts stdout as another name for the console exporter
+func parseExporter(name string, exporter string, allowed ...string) (string, error) {
+	exporter = strings.TrimSpace(exporter)
+	if exporter == "stdout" {
+		exporter = EXPORTER_CONSOLE
+	}
+	if !slices.Contains(allowed, exporter) {
+		return "", fmt.Errorf("invalid %s: %q, must be one of %s", name, exporter, strings.Join(allowed, ", "))
+	}
+	return exporter, nil
+}
+
+// getTelemetryConfiguration selects the exporters, the sampler and the resource.
+// OTEL_TRACES_EXPORTER is otlp, console (or stdout) or none so that the service
+// can run without a collector. OTEL_METRICS_EXPORTER is a comma separated list
+// that can also contain prometheus, for example otlp,prometheus
+func getTelemetryConfiguration(ctx context.Context) (telemetryConfig, error) {
+	var config telemetryConfig
+	var err error
+	config.tracesExporter, err = parseExporter(
+		"OTEL_TRACES_EXPORTER",
+		util.GetEnvWithDefault("OTEL_TRACES_EXPORTER", EXPORTER_OTLP),
+		EXPORTER_OTLP, EXPORTER_CONSOLE, EXPORTER_NONE,
+	)
+	if err != nil {
+		return config, err
+	}
+	for _, raw := range strings.Split(util.GetEnvWithDefault("OTEL_METRICS_EXPORTER", EXPORTER_OTLP), ",") {
+		exporter, err := parseExporter(
+			"OTEL_METRICS_EXPORTER", raw,
+			EXPORTER_OTLP, EXPORTER_CONSOLE, EXPORTER_PROMETHEUS, EXPORTER_NONE,
+		)
+		if err != nil {
+			return config, err
+		}
+		if exporter != EXPORTER_NONE {
+			config.metricsExporters = append(config.metricsExporters, exporter)
+		}
+	}
+	config.prometheusAddr = net.JoinHostPort(
+		util.GetEnvWithDefault("OTEL_EXPORTER_PROMETHEUS_HOST", "localhost"),
+		util.GetEnvWithDefault("OTEL_EXPORTER_PROMETHEUS_PORT", "9464"),
+	)
+	config.protocol = util.GetEnvWithDefault("OTEL_EXPORTER_OTLP_PROTOCOL", PROTOCOL_GRPC)
+	if config.protocol != PROTOCOL_GRPC && config.protocol != PROTOCOL_HTTP {
+		return config, fmt.Errorf(
+			"invalid OTEL_EXPORTER_OTLP_PROTOCOL: %q, must be %s or %s",
+			config.protocol, PROTOCOL_GRPC, PROTOCOL_HTTP,
+		)
+	}
+	if config.sampler, err = getSampler(); err != nil {
+		return config, err
+	}
+	// attributes from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the
+	// defaults because the env detector runs last
+	config.resource, err = resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceName(SERVICE_NAME),
+			semconv.ServiceVersion(serviceVersion()),
+			semconv.ServiceInstanceID(serviceInstanceId()),
+		),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return config, fmt.Errorf("unable to create the otel resource: %w", err)
+	}
+	return config, nil
+}
+
+// getSampler reads OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG. The default
+// follows the sampling decision of the caller and samples every root span
+func getSampler() (trace.Sampler, error) {
+	ratio := 1.0
+	if raw := util.GetEnvWithDefault("OTEL_TRACES_SAMPLER_ARG", ""); raw != "" {
+		var err error
+		ratio, err = strconv.ParseFloat(raw, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG: %q, must be a ratio between 0 and 1", raw)
+		}
+	}
+	switch sampler := util.GetEnvWithDefault("OTEL_TRACES_SAMPLER", "parentbased_traceidratio"); sampler {
+	case "always_on":
+		return trace.AlwaysSample(), nil
+	case "always_off":
+		return trace.NeverSample(), nil
+	case "traceidratio":
+		return trace.TraceIDRatioBased(ratio), nil
+	case "parentbased_always_on":
+		return trace.ParentBased(trace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return trace.ParentBased(trace.NeverSample()), nil
+	case "parentbased_traceidratio":
+		return trace.ParentBased(trace.TraceIDRatioBased(ratio)), nil
+	default:
+		return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER: %q", sampler)
+	}
+}
+
+// serviceVersion is the vcs revision the binary was built from, it can be
+// overridden with service.version in OTEL_RESOURCE_ATTRIBUTES
+func serviceVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
+}
+
+// serviceInstanceId is the hostname, which is the container id in docker, so
+// that replicas of the service can be told apart
+func serviceInstanceId() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return uuid.New().String()
+}
+
 // setupOTelSDK bootstraps the OpenTelemetry pipeline.
 // If it does not return an error, make sure to call shutdown for proper cleanup.
-func setupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, err error) {
+// The logger provider is only set up when logs are exported over otlp
+func setupOTelSDK(ctx context.Context, exportLogs bool) (shutdown func(context.Context) error, err error) {
 	var shutdownFuncs []func(context.Context) error
 
+	config, err := getTelemetryConfiguration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// shutdown calls cleanup functions registered via shutdownFuncs.
 	// The errors from the calls are joined.
 	// Each registered cdleanup will be invoked once.
@@ -49,7 +228,7 @@ func setupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 
 	// Set up trace provider.
 	// tracer provider is the factory object that creates the tracer object
-	tracerProvider, err := newTracerProvider(ctx)
+	tracerProvider, err := newTracerProvider(ctx, config)
 	if err != nil {
 		handleErr(err)
 		return
@@ -58,24 +237,31 @@ func setupOTelSDK(ctx context.Context) (shutdown func(context.Context) error, er
 	otel.SetTracerProvider(tracerProvider)
 
 	// Set up meter provider.
-	meterProvider, err := newMeterProvider(ctx)
+	meterProvider, metricsHandler, err := newMeterProvider(ctx, config)
 	if err != nil {
 		handleErr(err)
 		return
 	}
 	shutdownFuncs = append(shutdownFuncs, meterProvider.Shutdown)
 	otel.SetMeterProvider(meterProvider)
+	if metricsHandler != nil {
+		metricsServer := startMetricsServer(config.prometheusAddr, metricsHandler)
+		shutdownFuncs = append(shutdownFuncs, metricsServer.Shutdown)
+	}
 
 	// Set up logger provider.
-	// not sure to what extent I will be using this because my understanding is that logs are emitted by normal application 
-	// logging libraries and then captured in another way
-	// loggerProvider, err := newLoggerProvider()
-	// if err != nil {
-	// 	handleErr(err)
-	// 	return
-	// }
-	// shutdownFuncs = append(shutdownFuncs, loggerProvider.Shutdown)
-	// global.SetLoggerProvider(loggerProvider)
+	// the slog loggers built by the middleware package write to this provider
+	// through the otelslog bridge when the otlp log output is enabled
+	if exportLogs {
+		var loggerProvider *sdklog.LoggerProvider
+		loggerProvider, err = newLoggerProvider(ctx, config)
+		if err != nil {
+			handleErr(err)
+			return
+		}
+		shutdownFuncs = append(shutdownFuncs, loggerProvider.Shutdown)
+		global.SetLoggerProvider(loggerProvider)
+	}
 
 	return
 }
@@ -87,42 +273,107 @@ func newPropagator() propagation.TextMapPropagator {
 	)
 }
 
-func newTracerProvider(ctx context.Context) (*trace.TracerProvider, error) {
-	traceExporter, err := otlptracegrpc.New(ctx)
+func newTracerProvider(ctx context.Context, config telemetryConfig) (*trace.TracerProvider, error) {
+	options := []trace.TracerProviderOption{
+		trace.WithSampler(config.sampler),
+		trace.WithResource(config.resource),
+	}
+	// without an exporter spans are still created, their ids end up in the logs
+	var traceExporter trace.SpanExporter
+	var err error
+	switch {
+	case config.tracesExporter == EXPORTER_CONSOLE:
+		traceExporter, err = stdouttrace.New()
+	case config.tracesExporter == EXPORTER_OTLP && config.protocol == PROTOCOL_HTTP:
+		traceExporter, err = otlptracehttp.New(ctx)
+	case config.tracesExporter == EXPORTER_OTLP:
+		traceExporter, err = otlptracegrpc.New(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if traceExporter != nil {
+		// the batch timeout is read from OTEL_BSP_SCHEDULE_DELAY, the default is 5s
+		options = append(options, trace.WithBatcher(traceExporter))
+	}
+	return trace.NewTracerProvider(options...), nil
+}
 
-	tracerProvider := trace.NewTracerProvider(
-		trace.WithBatcher(traceExporter,
-			// Default is 5s. Set to 1s for demonstrative purposes.
-			trace.WithBatchTimeout(time.Second)),
-	)
-	return tracerProvider, nil
+// newMeterProvider adds a reader for every metrics exporter. The returned
+// handler serves the prometheus exporter, it is nil when prometheus is not one
+// of the exporters
+func newMeterProvider(ctx context.Context, config telemetryConfig) (*metric.MeterProvider, http.Handler, error) {
+	options := []metric.Option{metric.WithResource(config.resource)}
+	var handler http.Handler
+	for _, exporter := range config.metricsExporters {
+		var metricExporter metric.Exporter
+		var err error
+		switch {
+		case exporter == EXPORTER_PROMETHEUS:
+			// the prometheus exporter is a reader that collects on every scrape, a
+			// registry of its own keeps the go runtime collectors out of /metrics
+			registry := prometheus.NewRegistry()
+			reader, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+			if err != nil {
+				return nil, nil, err
+			}
+			options = append(options, metric.WithReader(reader))
+			// exemplars are only written in the openmetrics format
+			handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+			continue
+		case exporter == EXPORTER_CONSOLE:
+			metricExporter, err = stdoutmetric.New()
+		case exporter == EXPORTER_OTLP && config.protocol == PROTOCOL_HTTP:
+			metricExporter, err = otlpmetrichttp.New(ctx)
+		case exporter == EXPORTER_OTLP:
+			metricExporter, err = otlpmetricgrpc.New(ctx)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		// the interval is read from OTEL_METRIC_EXPORT_INTERVAL, the default is 1m
+		options = append(options, metric.WithReader(metric.NewPeriodicReader(metricExporter)))
+	}
+	// measurements that are recorded in a sampled span keep its trace id as an
+	// exemplar, which links the metrics in grafana to the traces in tempo
+	options = append(options, metric.WithExemplarFilter(exemplar.TraceBasedFilter))
+	return metric.NewMeterProvider(options...), handler, nil
 }
 
-func newMeterProvider(ctx context.Context) (*metric.MeterProvider, error) {
-	metricExporter, err := otlpmetricgrpc.New(ctx)
+// startMetricsServer serves the prometheus exporter on its own port so that the
+// metrics are not reachable through the public api
+func startMetricsServer(addr string, handler http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", handler)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Printf("serving prometheus metrics on %s", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("prometheus metrics server stopped: %s", err)
+		}
+	}()
+	return server
+}
+
+func newLoggerProvider(ctx context.Context, config telemetryConfig) (*sdklog.LoggerProvider, error) {
+	var logExporter sdklog.Exporter
+	var err error
+	if config.protocol == PROTOCOL_HTTP {
+		logExporter, err = otlploghttp.New(ctx)
+	} else {
+		logExporter, err = otlploggrpc.New(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	meterProvider := metric.NewMeterProvider(
-		metric.WithReader(metric.NewPeriodicReader(metricExporter,
-			// Default is 1m. Set to 3s for demonstrative purposes.
-			metric.WithInterval(3*time.Second))),
+	loggerProvider := sdklog.NewLoggerProvider(
+		sdklog.WithResource(config.resource),
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(logExporter)),
 	)
-	return meterProvider, nil
+	return loggerProvider, nil
 }
-
-// func newLoggerProvider() (*log.LoggerProvider, error) {
-// 	logExporter, err := stdoutlog.New()
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	loggerProvider := log.NewLoggerProvider(
-// 		log.WithProcessor(log.NewBatchProcessor(logExporter)),
-// 	)
-// 	return loggerProvider, nil
-// }
@@ -1,9 +1,182 @@
 -- name: InsertMapping :one
-INSERT INTO url_mapping (id, long_url)
-VALUES ($1, $2)
+INSERT INTO url_mapping (id, long_url, redirect_status, forward_query, forward_path, utm_query, password_hash, title, created_by)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 ON CONFLICT (id) DO NOTHING
-RETURNING id;
+RETURNING *;
+
+-- name: ImportMapping :one
+INSERT INTO url_mapping (id, long_url, title, redirect_status, created_at, visits, created_by)
+VALUES (@id, @long_url, @title, @redirect_status, COALESCE(sqlc.narg('created_at')::TIMESTAMP, NOW()), @visits, @created_by)
+ON CONFLICT (id) DO NOTHING
+RETURNING *;
 
 -- name: SelectMapping :one
 SELECT * FROM url_mapping
-WHERE id = $1 LIMIT 1;
\ No newline at end of file
+WHERE id = $1 LIMIT 1;
+
+-- name: SelectMappingForUpdate :one
+SELECT * FROM url_mapping
+WHERE id = $1
+FOR UPDATE;
+
+-- name: SelectPasswordHash :one
+SELECT password_hash FROM url_mapping
+WHERE id = $1;
+
+-- name: UpdateMappingStatus :one
+UPDATE url_mapping
+SET status = $2, status_code = $3, status_message = $4, status_changed_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: CountMappingsByStatus :many
+SELECT
+    status,
+    COUNT(*) AS mappings,
+    COALESCE(SUM(visits), 0)::BIGINT AS visits,
+    COALESCE(SUM(bot_visits), 0)::BIGINT AS bot_visits
+FROM url_mapping
+GROUP BY status;
+
+-- name: CountMappingsCreatedLastDay :one
+SELECT COUNT(*) FROM url_mapping
+WHERE created_at >= NOW() - INTERVAL '24 hours';
+
+-- name: ListTopMappings :many
+SELECT * FROM url_mapping
+ORDER BY visits DESC NULLS LAST, created_at DESC
+LIMIT $1;
+
+-- name: ListRecentMappings :many
+SELECT * FROM url_mapping
+ORDER BY created_at DESC
+LIMIT $1;
+
+-- name: ListInactiveMappings :many
+SELECT * FROM url_mapping
+WHERE status <> 'active'
+ORDER BY status_changed_at DESC NULLS LAST
+LIMIT $1;
+
+-- name: DeleteMapping :one
+DELETE FROM url_mapping
+WHERE id = $1
+RETURNING *;
+
+-- name: InsertAuditEvent :exec
+INSERT INTO audit_events (request_id, actor, client_ip, action, mapping_id, before_value, after_value)
+VALUES ($1, $2, $3, $4, $5, $6, $7);
+
+-- name: ListAuditEvents :many
+SELECT * FROM audit_events
+WHERE (sqlc.narg('mapping_id')::TEXT IS NULL OR mapping_id = sqlc.narg('mapping_id'))
+    AND (sqlc.narg('actor')::TEXT IS NULL OR actor = sqlc.narg('actor'))
+    AND (sqlc.narg('action')::TEXT IS NULL OR action = sqlc.narg('action'))
+    AND (sqlc.narg('request_id')::TEXT IS NULL OR request_id = sqlc.narg('request_id'))
+    AND (sqlc.narg('since')::TIMESTAMP IS NULL OR occurred_at >= sqlc.narg('since'))
+    AND (sqlc.narg('until')::TIMESTAMP IS NULL OR occurred_at < sqlc.narg('until'))
+    AND (sqlc.narg('before_id')::BIGINT IS NULL OR id < sqlc.narg('before_id'))
+ORDER BY id DESC
+LIMIT sqlc.arg('max_events');
+
+-- name: InsertClickEvents :copyfrom
+INSERT INTO click_events (mapping_id, occurred_at, referrer, user_agent, is_bot, bot_reason)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: LockMappingsInOrder :exec
+SELECT id FROM url_mapping
+WHERE id = ANY(@ids::TEXT[])
+ORDER BY id
+FOR UPDATE;
+
+-- name: IncrementVisits :exec
+UPDATE url_mapping
+SET
+    visits = COALESCE(url_mapping.visits, 0) + clicks.visits,
+    bot_visits = url_mapping.bot_visits + clicks.bot_visits
+FROM (
+    SELECT
+        unnest(@ids::TEXT[]) AS id,
+        unnest(@visits::INTEGER[]) AS visits,
+        unnest(@bot_visits::INTEGER[]) AS bot_visits
+) AS clicks
+WHERE url_mapping.id = clicks.id;
+
+-- name: UpsertHourlyRollups :exec
+INSERT INTO click_rollup_hourly (mapping_id, bucket, referrer_host, device_class, clicks)
+SELECT
+    unnest(@mapping_ids::TEXT[]),
+    unnest(@buckets::TIMESTAMP[]),
+    unnest(@referrer_hosts::TEXT[]),
+    unnest(@device_classes::TEXT[]),
+    unnest(@clicks::BIGINT[])
+ON CONFLICT (mapping_id, bucket, referrer_host, device_class)
+DO UPDATE SET clicks = click_rollup_hourly.clicks + EXCLUDED.clicks;
+
+-- name: UpsertDailyRollups :exec
+INSERT INTO click_rollup_daily (mapping_id, bucket, referrer_host, device_class, clicks)
+SELECT
+    unnest(@mapping_ids::TEXT[]),
+    unnest(@buckets::TIMESTAMP[]),
+    unnest(@referrer_hosts::TEXT[]),
+    unnest(@device_classes::TEXT[]),
+    unnest(@clicks::BIGINT[])
+ON CONFLICT (mapping_id, bucket, referrer_host, device_class)
+DO UPDATE SET clicks = click_rollup_daily.clicks + EXCLUDED.clicks;
+
+-- name: ListHourlyClicks :many
+SELECT
+    bucket,
+    COALESCE(SUM(clicks) FILTER (WHERE device_class <> 'bot'), 0)::BIGINT AS clicks,
+    COALESCE(SUM(clicks) FILTER (WHERE device_class = 'bot'), 0)::BIGINT AS bot_clicks
+FROM click_rollup_hourly
+WHERE mapping_id = @mapping_id AND bucket >= @since AND bucket < @until
+GROUP BY bucket
+ORDER BY bucket;
+
+-- name: ListDailyClicks :many
+SELECT
+    bucket,
+    COALESCE(SUM(clicks) FILTER (WHERE device_class <> 'bot'), 0)::BIGINT AS clicks,
+    COALESCE(SUM(clicks) FILTER (WHERE device_class = 'bot'), 0)::BIGINT AS bot_clicks
+FROM click_rollup_daily
+WHERE mapping_id = @mapping_id AND bucket >= @since AND bucket < @until
+GROUP BY bucket
+ORDER BY bucket;
+
+-- name: ListDailyClicksByReferrer :many
+SELECT referrer_host, SUM(clicks)::BIGINT AS clicks
+FROM click_rollup_daily
+WHERE mapping_id = @mapping_id AND bucket >= @since AND bucket < @until
+    AND device_class <> 'bot'
+GROUP BY referrer_host
+ORDER BY clicks DESC, referrer_host
+LIMIT @max_rows;
+
+-- name: ListDailyClicksByDevice :many
+SELECT device_class, SUM(clicks)::BIGINT AS clicks
+FROM click_rollup_daily
+WHERE mapping_id = @mapping_id AND bucket >= @since AND bucket < @until
+GROUP BY device_class
+ORDER BY clicks DESC, device_class;
+
+-- name: DeleteClickEventsBefore :execrows
+DELETE FROM click_events
+WHERE id IN (
+    SELECT old.id FROM click_events AS old
+    WHERE old.occurred_at < @cutoff
+    LIMIT @max_rows
+);
+
+-- name: InsertBlocklistEntry :exec
+INSERT INTO blocklist_entries (entry)
+VALUES ($1)
+ON CONFLICT (entry) DO NOTHING;
+
+-- name: DeleteBlocklistEntry :execrows
+DELETE FROM blocklist_entries
+WHERE entry = $1;
+
+-- name: ListBlocklistEntries :many
+SELECT entry FROM blocklist_entries
+ORDER BY entry;
@@ -1,6 +1,110 @@
 CREATE TABLE url_mapping (
-    id VARCHAR(8) PRIMARY KEY,
+    id VARCHAR(64) PRIMARY KEY,
     long_url TEXT NOT NULL,
     created_at TIMESTAMP NOT NULL DEFAULT NOW(),
-    visits INTEGER DEFAULT 0
-);
\ No newline at end of file
+    -- visits only counts clicks that were classified as human, see bot_visits
+    visits INTEGER DEFAULT 0,
+    redirect_status INTEGER NOT NULL DEFAULT 302
+        CHECK (redirect_status IN (301, 302, 307, 308)),
+    -- append the query string of the short url request to the long url
+    forward_query BOOLEAN NOT NULL DEFAULT FALSE,
+    -- append any path after the short url id to the path of the long url
+    forward_path BOOLEAN NOT NULL DEFAULT FALSE,
+    -- url encoded utm parameters that are added to every redirect
+    utm_query TEXT NOT NULL DEFAULT '',
+    -- bcrypt hash of the password that protects the mapping, null when the
+    -- mapping is public
+    password_hash TEXT,
+    -- optional human readable description shown on the preview page
+    title TEXT NOT NULL DEFAULT '',
+    -- links that are not active are kept for evidence but no longer redirect
+    status TEXT NOT NULL DEFAULT 'active'
+        CHECK (status IN ('active', 'disabled', 'quarantined')),
+    -- response returned instead of the redirect when the link is not active
+    status_code INTEGER NOT NULL DEFAULT 410
+        CHECK (status_code IN (410, 451)),
+    status_message TEXT NOT NULL DEFAULT '',
+    status_changed_at TIMESTAMP,
+    -- actor that created the mapping, see audit_events.actor
+    created_by TEXT NOT NULL DEFAULT 'anonymous',
+    -- clicks from crawlers and link unfurlers
+    bot_visits INTEGER NOT NULL DEFAULT 0
+);
+
+-- append only record of every change to a mapping. mapping_id is not a foreign
+-- key so that the events of deleted mappings are kept
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    request_id TEXT NOT NULL DEFAULT '',
+    -- admin for requests authenticated with the admin token, otherwise anonymous
+    actor TEXT NOT NULL,
+    client_ip TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL
+        CHECK (action IN ('create', 'update_status', 'delete')),
+    mapping_id VARCHAR(64) NOT NULL,
+    -- admin view of the mapping before and after the change, null when the
+    -- mapping did not exist
+    before_value JSONB,
+    after_value JSONB
+);
+
+CREATE INDEX audit_events_mapping_id_idx ON audit_events (mapping_id, id);
+
+CREATE FUNCTION reject_audit_event_change() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION reject_audit_event_change();
+
+-- one row for every redirect, written in batches by the click event pipeline.
+-- mapping_id is not a foreign key so that clicks outlive deleted mappings
+CREATE TABLE click_events (
+    id BIGSERIAL PRIMARY KEY,
+    mapping_id VARCHAR(64) NOT NULL,
+    occurred_at TIMESTAMP NOT NULL,
+    referrer TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    is_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    -- why the click was classified as a bot, see analytics.ClassifyRequest. Empty
+    -- for clicks from people
+    bot_reason TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX click_events_mapping_id_idx ON click_events (mapping_id, occurred_at);
+-- used by the retention job that deletes old click events
+CREATE INDEX click_events_occurred_at_idx ON click_events (occurred_at);
+
+-- click counts per mapping and hour or day, maintained alongside click_events so
+-- that dashboards never scan raw events. bucket is the start of the hour or day
+-- in UTC and referrer_host is empty for clicks without a referrer. Clicks from
+-- bots are counted with the device class bot
+CREATE TABLE click_rollup_hourly (
+    mapping_id VARCHAR(64) NOT NULL,
+    bucket TIMESTAMP NOT NULL,
+    referrer_host TEXT NOT NULL,
+    device_class TEXT NOT NULL,
+    clicks BIGINT NOT NULL,
+    PRIMARY KEY (mapping_id, bucket, referrer_host, device_class)
+);
+
+CREATE TABLE click_rollup_daily (
+    mapping_id VARCHAR(64) NOT NULL,
+    bucket TIMESTAMP NOT NULL,
+    referrer_host TEXT NOT NULL,
+    device_class TEXT NOT NULL,
+    clicks BIGINT NOT NULL,
+    PRIMARY KEY (mapping_id, bucket, referrer_host, device_class)
+);
+
+-- blocklist entries added through the admin api. Every instance reloads them
+-- periodically so that an edit applies everywhere and survives restarts, entries
+-- from BLOCKLIST_FILE are not stored here
+CREATE TABLE blocklist_entries (
+    entry TEXT PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
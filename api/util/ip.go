@@ -0,0 +1,89 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPConfig names the header that a reverse proxy uses to pass on the address
+// of the client. The header is only read for requests from one of the trusted
+// proxies, any other client could set it to an address of its choice
+type ClientIPConfig struct {
+	Header         string
+	TrustedProxies []netip.Prefix
+}
+
+var clientIPConfig ClientIPConfig
+
+// ConfigureClientIP must be called before the server starts handling requests
+func ConfigureClientIP(config ClientIPConfig) {
+	clientIPConfig = config
+}
+
+// ParseTrustedProxies reads a comma separated list of addresses and cidr ranges
+func ParseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(raw string) bool {
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range clientIPConfig.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made the request without the port.
+// Behind a trusted proxy the address is read from the configured header. Headers
+// such as X-Forwarded-For list every hop, the rightmost address that is not a
+// trusted proxy is the first one that was not added by our own proxies
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if clientIPConfig.Header == "" || !isTrustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values(clientIPConfig.Header), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" || isTrustedProxy(hop) {
+			continue
+		}
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// a malformed hop could be chosen by the client, use the proxy instead
+			return host
+		}
+		return hop
+	}
+	return host
+}
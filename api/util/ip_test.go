@@ -0,0 +1,39 @@
+package util
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ConfigureClientIP(ClientIPConfig{Header: "X-Forwarded-For", TrustedProxies: proxies})
+	defer ConfigureClientIP(ClientIPConfig{})
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		// the header of a client that does not connect through a proxy is ignored
+		{remoteAddr: "203.0.113.7:1234", forwarded: "198.51.100.1", expected: "203.0.113.7"},
+		{remoteAddr: "10.0.0.2:1234", forwarded: "198.51.100.1", expected: "198.51.100.1"},
+		// addresses added by the client in front of the real one are skipped
+		{remoteAddr: "10.0.0.2:1234", forwarded: "1.2.3.4, 198.51.100.1, 192.168.1.1", expected: "198.51.100.1"},
+		{remoteAddr: "10.0.0.2:1234", forwarded: "", expected: "10.0.0.2"},
+		{remoteAddr: "10.0.0.2:1234", forwarded: "not-an-ip", expected: "10.0.0.2"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := ClientIP(req); ip != test.expected {
+			t.Errorf("client ip of %s forwarded for %q: expected: %s, received: %s", test.remoteAddr, test.forwarded, test.expected, ip)
+		}
+	}
+}
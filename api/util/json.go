@@ -17,24 +17,11 @@ import (
 
 const ONE_MB int = 1048576
 
-// create a struct type for malformed request that satisfies the Error interface
-type MalformedRequest struct {
-	Msg string
-	Status int
-}
-
-func (m *MalformedRequest) Error() string {
-	return m.Msg
-}
-
 func DecodeJSONBody(w http.ResponseWriter, r *http.Request, destination interface{}) error {
 	// verify that the request does include json body
 	if r.Header.Get("Content-Type") != "application/json" {
-		// return a malformed request object
-		return &MalformedRequest{
-			Msg: "Content-Type header must be application/json",
-			Status: http.StatusUnsupportedMediaType,
-		}
+		// return a problem that the handler writes as it is
+		return NewProblem(http.StatusUnsupportedMediaType, "Content-Type header must be application/json")
 	}
 
 	// cap the size of the request body to one megabyte
@@ -53,23 +40,23 @@ func DecodeJSONBody(w http.ResponseWriter, r *http.Request, destination interfac
 			// "An error matches target if the error's concrete value is assignable to the value pointed to by target"
 		case errors.As(err, &syntaxError):
 			msg := fmt.Sprintf("request body contains a syntax error at position: %d", syntaxError.Offset)
-			return &MalformedRequest{Msg: msg, Status: http.StatusBadRequest}
+			return NewProblem(http.StatusBadRequest, msg)
 		case errors.Is(err, io.ErrUnexpectedEOF):
 			msg := "request body contains badly formatted json"
-			return &MalformedRequest{Msg: msg, Status: http.StatusBadRequest}
+			return NewProblem(http.StatusBadRequest, msg)
 		case errors.As(err, &unmarshalTypeError):
 			msg := fmt.Sprintf("request body contains and invalid value for the field %q at position %d", unmarshalTypeError.Field, unmarshalTypeError.Offset)
-			return &MalformedRequest{Msg: msg, Status: http.StatusBadRequest}
+			return NewProblem(http.StatusBadRequest, msg).WithField(unmarshalTypeError.Field)
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 			msg := fmt.Sprintf("request body contains unknown field: %s", fieldName)
-			return &MalformedRequest{Msg: msg, Status: http.StatusBadRequest}
+			return NewProblem(http.StatusBadRequest, msg).WithField(strings.Trim(fieldName, `"`))
 		case errors.Is(err, io.EOF):
 			msg := "request body must not be empty"
-			return &MalformedRequest{Msg: msg, Status: http.StatusBadRequest}
+			return NewProblem(http.StatusBadRequest, msg)
 		case errors.As(err, &maxBytesError):
 			msg := fmt.Sprintf("request body must not exceed %d bytes", ONE_MB)
-			return &MalformedRequest{Msg: msg, Status: http.StatusRequestEntityTooLarge}
+			return NewProblem(http.StatusRequestEntityTooLarge, msg)
 		default:
 			return err
 		}
@@ -79,7 +66,7 @@ func DecodeJSONBody(w http.ResponseWriter, r *http.Request, destination interfac
 	// ^create an instance of the Any type
 	if !errors.Is(err, io.EOF) {
 		msg := "request body must not have more than one JSON object"
-		return &MalformedRequest{Msg: msg, Status: http.StatusBadRequest}
+		return NewProblem(http.StatusBadRequest, msg)
 	}
 
 	return nil
@@ -0,0 +1,97 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const PROBLEM_CONTENT_TYPE string = "application/problem+json"
+
+// REQUEST_ID_HEADER carries the id of a request, the request id middleware echoes
+// it on every response
+const REQUEST_ID_HEADER string = "X-Request-ID"
+
+// PROBLEM_TYPE_DEFAULT means that the problem has no semantics beyond its status
+// code, see RFC 9457 section 4.2.1
+const PROBLEM_TYPE_DEFAULT string = "about:blank"
+
+// FieldError names a field of the request that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Problem is the body of every error response, it follows RFC 9457. It is also
+// returned as an error by validation functions so that handlers can write it
+// as it is
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	RequestId string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Type:   PROBLEM_TYPE_DEFAULT,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// WithField records that the problem was caused by a field of the request, the
+// detail of the problem is used as the message of the field
+func (p *Problem) WithField(field string) *Problem {
+	p.Errors = append(p.Errors, FieldError{Field: field, Message: p.Detail})
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return p.Title
+	}
+	return p.Detail
+}
+
+// WriteProblem writes the problem as application/problem+json. The request id
+// is taken from the response headers when the problem does not have one
+func WriteProblem(w http.ResponseWriter, problem *Problem) {
+	WriteProblemWith(w, problem, nil)
+}
+
+// WriteProblemWith adds the fields of extension as extension members next to the
+// members of the problem, the members of the problem win on conflicts
+func WriteProblemWith(w http.ResponseWriter, problem *Problem, extension any) {
+	body := *problem
+	if body.RequestId == "" {
+		body.RequestId = w.Header().Get(REQUEST_ID_HEADER)
+	}
+	var encoded any = &body
+	if extension != nil {
+		if members, err := mergeMembers(extension, &body); err == nil {
+			encoded = members
+		}
+	}
+	w.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+	w.WriteHeader(body.Status)
+	json.NewEncoder(w).Encode(encoded)
+}
+
+// mergeMembers encodes each value as a json object and merges the objects, later
+// values override the members of earlier ones
+func mergeMembers(values ...any) (map[string]json.RawMessage, error) {
+	members := map[string]json.RawMessage{}
+	for _, value := range values {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(encoded, &members); err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
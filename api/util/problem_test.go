@@ -0,0 +1,45 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteProblem(t *testing.T) {
+	rr := httptest.NewRecorder()
+	rr.Header().Set(REQUEST_ID_HEADER, "request-1")
+	WriteProblemWith(
+		rr,
+		NewProblem(http.StatusBadRequest, "title must not be longer than 512 bytes").WithField("title"),
+		map[string]any{"rows": 3, "status": 200},
+	)
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != PROBLEM_CONTENT_TYPE {
+		t.Errorf("problem was written with content type %q", contentType)
+	}
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("problem was written with status %d", rr.Code)
+	}
+	var body map[string]any
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode the problem with %v", err)
+	}
+	expected := map[string]any{
+		"type":      PROBLEM_TYPE_DEFAULT,
+		"title":     "Bad Request",
+		"status":    float64(http.StatusBadRequest),
+		"requestId": "request-1",
+		"rows":      float64(3),
+	}
+	for member, value := range expected {
+		if body[member] != value {
+			t.Errorf("member %s of the problem is %v, expected %v", member, body[member], value)
+		}
+	}
+	errors, ok := body["errors"].([]any)
+	if !ok || len(errors) != 1 || errors[0].(map[string]any)["field"] != "title" {
+		t.Errorf("field errors of the problem are %v", body["errors"])
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"townsag/url_shortener/api/analytics"
+	"townsag/url_shortener/api/middleware"
+)
+
+// runWorker consumes the click event stream until it receives SIGINT or SIGTERM.
+// Any number of workers can run at the same time, they share the entries of the
+// stream through the consumer group
+func runWorker() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the level and outputs of the loggers are set before any logger is built
+	logConfig, err := getLoggingConfiguration()
+	if err != nil {
+		log.Fatalf("error parsing the logging config: %s", err)
+	}
+	middleware.ConfigureLogging(logConfig)
+
+	otelShutdown, err := setupOTelSDK(ctx, logConfig.Otlp)
+	if err != nil {
+		log.Fatalf("failed to bootstrap OTEL SDK: %s", err)
+	}
+	defer otelShutdown(context.Background())
+
+	pool, rdb, err := connectToStores(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+	defer rdb.Close()
+
+	config, err := getClickStreamConfiguration()
+	if err != nil {
+		log.Fatalf("error parsing the click stream config: %s", err)
+	}
+	consumer, err := analytics.NewStreamConsumer(
+		rdb,
+		newClickStore(pool, rdb),
+		config,
+		middleware.BuildLogger(),
+	)
+	if err != nil {
+		log.Fatalf("failed to create the click stream consumer: %s", err)
+	}
+	if err = startRetentionJob(ctx, pool); err != nil {
+		log.Fatalf("failed to start the click event retention job: %s", err)
+	}
+	log.Printf("consuming click events from stream %s as %s", config.Stream, config.Consumer)
+	if err = consumer.Run(ctx); err != nil {
+		log.Fatalf("click stream consumer stopped: %s", err)
+	}
+	log.Println("shutting down")
+}
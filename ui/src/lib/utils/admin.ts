@@ -0,0 +1,59 @@
+// helpers for calling the authenticated /api/admin routes from the admin dashboard
+
+const tokenKey = 'adminToken';
+
+export function loadToken(): string {
+    return sessionStorage.getItem(tokenKey) ?? '';
+}
+
+export function saveToken(token: string): void {
+    sessionStorage.setItem(tokenKey, token);
+}
+
+export class AdminApiError extends Error {
+    status: number;
+
+    constructor(status: number, message: string) {
+        super(message);
+        this.status = status;
+    }
+}
+
+export async function adminFetch<T>(token: string, path: string, init: RequestInit = {}): Promise<T> {
+    const headers = new Headers(init.headers);
+    headers.set('Authorization', `Bearer ${token}`);
+    if (init.body) {
+        headers.set('Content-Type', 'application/json');
+    }
+    const response = await fetch(path, { ...init, headers });
+    const data = await response.json();
+    if (!response.ok) {
+        // errors are application/problem+json, see util/problem.go in the api
+        throw new AdminApiError(response.status, data.detail ?? data.title ?? response.statusText);
+    }
+    return data as T;
+}
+
+export interface Stats {
+    mappings: { total: number; active: number; disabled: number; quarantined: number };
+    totalVisits: number;
+    totalBotVisits: number;
+    createdLast24Hours: number;
+    blocklistEntries: number;
+    cache?: { hits: number; misses: number; hitRatio: number };
+}
+
+export interface Link {
+    shortUrlId: string;
+    longUrl: string;
+    title: string;
+    createdAt: string;
+    visits: number;
+    botVisits: number;
+    redirectStatus: number;
+    passwordProtected: boolean;
+    linkStatus: 'active' | 'disabled' | 'quarantined';
+    statusChangedAt?: string;
+}
+
+export type LinkStatus = Link['linkStatus'];